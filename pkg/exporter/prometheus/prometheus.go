@@ -0,0 +1,464 @@
+// Package prometheus exposes the events and statistics of a tracer as
+// Prometheus metrics.
+//
+// An Exporter is a tracer.BatchCallback: pass it to tracer.NewTracerBatch,
+// then give it the tracer with SetTracer so the loss and probe miss counters
+// are included, and serve it over HTTP:
+//
+//	e := prometheus.New(prometheus.Options{})
+//	t, err := tracer.NewTracerBatch(e)
+//	...
+//	e.SetTracer(t)
+//	http.Handle("/metrics", e)
+//
+// Metrics are written in the Prometheus text exposition format, so this
+// package doesn't depend on the Prometheus client library.
+package prometheus
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/weaveworks/tcptracer-bpf/pkg/tracer"
+)
+
+// otherLabel replaces the label values of the series created once MaxSeries
+// is reached.
+const otherLabel = "other"
+
+// DefaultDurationBuckets are the connection duration histogram buckets, in
+// seconds, used when Options.DurationBuckets is empty.
+var DefaultDurationBuckets = []float64{.001, .01, .1, 1, 10, 60, 600, 3600}
+
+// Options configures an Exporter.
+type Options struct {
+	// RemotePortLabel adds the remote port of outbound connections as a
+	// label of the opened and closed connection counters. The remote port of
+	// inbound connections is usually an ephemeral port of the client, so it
+	// is left empty.
+	RemotePortLabel bool
+	// MaxSeries is the maximum number of label sets per connection counter.
+	// Once reached, events with new label sets are counted in a single
+	// series where all labels are "other". Defaults to 10000.
+	MaxSeries int
+	// MaxTrackedConnections is the maximum number of open connections kept
+	// to compute connection durations. Once reached, the oldest connection
+	// is forgotten and counted as untracked, so that the connections whose
+	// close event was lost don't fill it up. Defaults to 65536.
+	MaxTrackedConnections int
+	// DurationBuckets are the upper bounds of the connection duration
+	// histogram buckets, in seconds.
+	DurationBuckets []float64
+	// Next, if not nil, receives the events after they are accounted.
+	Next tracer.BatchCallback
+}
+
+// StatsSource provides the tracer statistics. *tracer.Tracer implements it.
+type StatsSource interface {
+	Stats() (tracer.Stats, error)
+}
+
+type connLabels struct {
+	comm  string
+	netns uint32
+	port  uint16
+}
+
+// connKey identifies an open connection to match its close event. Unlike
+// the tuple, the socket id is not reused while the connection is open.
+type connKey uint64
+
+type connStart struct {
+	key       connKey
+	timestamp uint64
+	direction string
+}
+
+// counterVec is a counter with a bounded number of label sets.
+type counterVec struct {
+	values   map[connLabels]uint64
+	overflow uint64
+}
+
+func (c *counterVec) inc(l connLabels, maxSeries int) {
+	if _, ok := c.values[l]; !ok && len(c.values) >= maxSeries {
+		c.overflow++
+		return
+	}
+	c.values[l]++
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// Exporter counts the connection events and serves them, along with the
+// tracer statistics, as Prometheus metrics.
+type Exporter struct {
+	opts Options
+
+	mu          sync.Mutex
+	opened      counterVec
+	accepted    counterVec
+	closed      counterVec
+	closeReason map[tracer.CloseReason]uint64
+	lostV4      uint64
+	lostV6      uint64
+	// connections holds the *connStart of the open connections, in the
+	// order list, the oldest first
+	connections map[connKey]*list.Element
+	order       list.List
+	untracked   uint64
+	durations   map[string]*histogram
+	stats       StatsSource
+}
+
+// New creates an Exporter.
+func New(opts Options) *Exporter {
+	if opts.MaxSeries <= 0 {
+		opts.MaxSeries = 10000
+	}
+	if opts.MaxTrackedConnections <= 0 {
+		opts.MaxTrackedConnections = 65536
+	}
+	if len(opts.DurationBuckets) == 0 {
+		opts.DurationBuckets = DefaultDurationBuckets
+	}
+
+	return &Exporter{
+		opts:        opts,
+		opened:      counterVec{values: make(map[connLabels]uint64)},
+		accepted:    counterVec{values: make(map[connLabels]uint64)},
+		closed:      counterVec{values: make(map[connLabels]uint64)},
+		closeReason: make(map[tracer.CloseReason]uint64),
+		connections: make(map[connKey]*list.Element),
+		durations:   make(map[string]*histogram),
+	}
+}
+
+// SetTracer sets the source of the loss and kprobe miss counters.
+func (e *Exporter) SetTracer(s StatsSource) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stats = s
+}
+
+// TCPEventsBatch implements tracer.BatchCallback.
+func (e *Exporter) TCPEventsBatch(events []tracer.Event) {
+	e.mu.Lock()
+	for i := range events {
+		e.account(&events[i])
+	}
+	e.mu.Unlock()
+
+	if e.opts.Next != nil {
+		e.opts.Next.TCPEventsBatch(events)
+	}
+}
+
+// LostV4 implements tracer.BatchCallback.
+func (e *Exporter) LostV4(count uint64) {
+	e.mu.Lock()
+	e.lostV4 += count
+	e.mu.Unlock()
+
+	if e.opts.Next != nil {
+		e.opts.Next.LostV4(count)
+	}
+}
+
+// LostV6 implements tracer.BatchCallback.
+func (e *Exporter) LostV6(count uint64) {
+	e.mu.Lock()
+	e.lostV6 += count
+	e.mu.Unlock()
+
+	if e.opts.Next != nil {
+		e.opts.Next.LostV6(count)
+	}
+}
+
+func (e *Exporter) account(ev *tracer.Event) {
+	l := connLabels{
+		comm:  ev.Comm,
+		netns: ev.NetNS,
+	}
+	k := connKey(ev.SockID)
+
+	switch ev.Type {
+	case tracer.EventConnect:
+		if e.opts.RemotePortLabel {
+			l.port = ev.DPort
+		}
+		e.opened.inc(l, e.opts.MaxSeries)
+		e.trackConnection(k, ev.Timestamp, "outbound")
+	case tracer.EventAccept:
+		e.accepted.inc(l, e.opts.MaxSeries)
+		e.trackConnection(k, ev.Timestamp, "inbound")
+	case tracer.EventClose:
+		elem, ok := e.connections[k]
+		var start *connStart
+		if ok {
+			start = e.order.Remove(elem).(*connStart)
+			delete(e.connections, k)
+		}
+		// the direction of untracked connections is unknown
+		if e.opts.RemotePortLabel && start != nil && start.direction == "outbound" {
+			l.port = ev.DPort
+		}
+		e.closed.inc(l, e.opts.MaxSeries)
+		e.closeReason[ev.CloseReason]++
+		if start != nil && ev.Timestamp >= start.timestamp {
+			e.observeDuration(start.direction, float64(ev.Timestamp-start.timestamp)/1e9)
+		}
+	}
+}
+
+func (e *Exporter) trackConnection(k connKey, timestamp uint64, direction string) {
+	if elem, ok := e.connections[k]; ok {
+		e.order.Remove(elem)
+	} else if len(e.connections) >= e.opts.MaxTrackedConnections {
+		oldest := e.order.Remove(e.order.Front()).(*connStart)
+		delete(e.connections, oldest.key)
+		e.untracked++
+	}
+	e.connections[k] = e.order.PushBack(&connStart{
+		key:       k,
+		timestamp: timestamp,
+		direction: direction,
+	})
+}
+
+func (e *Exporter) observeDuration(direction string, seconds float64) {
+	h, ok := e.durations[direction]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(e.opts.DurationBuckets))}
+		e.durations[direction] = h
+	}
+	for i, le := range e.opts.DurationBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := e.WriteTo(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format. If
+// the tracer statistics can't be read, they are left out and
+// tcptracer_stats_error is set to 1.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	var stats *tracer.Stats
+	var statsErr bool
+	e.mu.Lock()
+	source := e.stats
+	e.mu.Unlock()
+	if source != nil {
+		if s, err := source.Stats(); err != nil {
+			statsErr = true
+		} else {
+			stats = &s
+		}
+	}
+
+	// render into a buffer so that a slow client doesn't hold the lock
+	buf := &bytes.Buffer{}
+
+	e.mu.Lock()
+	e.writeConnCounter(buf, "tcptracer_connections_opened_total", "Outbound TCP connections established.", &e.opened, e.opts.RemotePortLabel)
+	e.writeConnCounter(buf, "tcptracer_connections_accepted_total", "Inbound TCP connections accepted.", &e.accepted, false)
+	e.writeConnCounter(buf, "tcptracer_connections_closed_total", "TCP connections closed.", &e.closed, e.opts.RemotePortLabel)
+	e.writeCloseReasons(buf)
+	e.writeDurations(buf)
+	writeHeader(buf, "tcptracer_connections_untracked_total", "TCP connections whose duration is not measured because MaxTrackedConnections was reached.", "counter")
+	writeSample(buf, "tcptracer_connections_untracked_total", nil, float64(e.untracked))
+	lostV4, lostV6 := e.lostV4, e.lostV6
+	e.mu.Unlock()
+
+	writeHeader(buf, "tcptracer_events_lost_total", "Events lost before reaching the callback.", "counter")
+	if stats != nil {
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "ipv4", "where", "kernel"}, float64(stats.KernelLostV4))
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "ipv6", "where", "kernel"}, float64(stats.KernelLostV6))
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "ipv4", "where", "queue"}, float64(stats.DroppedV4))
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "ipv6", "where", "queue"}, float64(stats.DroppedV6))
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "ipv4", "where", "decode"}, float64(stats.InvalidV4))
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "ipv6", "where", "decode"}, float64(stats.InvalidV6))
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "unix", "where", "kernel"}, float64(stats.KernelLostUnix))
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "unix", "where", "queue"}, float64(stats.DroppedUnix))
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "unix", "where", "decode"}, float64(stats.InvalidUnix))
+	} else {
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "ipv4", "where", "kernel"}, float64(lostV4))
+		writeSample(buf, "tcptracer_events_lost_total", []string{"family", "ipv6", "where", "kernel"}, float64(lostV6))
+	}
+
+	if stats != nil {
+		writeDelivered(buf, "tcptracer_events_delivered_total", "Events delivered to the callback.", stats.Delivered)
+		writeDelivered(buf, "tcptracer_unix_events_delivered_total", "AF_UNIX socket events delivered to the callback.", stats.DeliveredUnix)
+
+		writeHeader(buf, "tcptracer_kprobe_misses_total", "Missed kprobe and kretprobe hits.", "counter")
+		probes := make([]string, 0, len(stats.ProbeMisses))
+		for p := range stats.ProbeMisses {
+			probes = append(probes, p)
+		}
+		sort.Strings(probes)
+		for _, p := range probes {
+			writeSample(buf, "tcptracer_kprobe_misses_total", []string{"probe", p}, float64(stats.ProbeMisses[p]))
+		}
+	}
+
+	if source != nil {
+		writeHeader(buf, "tcptracer_stats_error", "Whether the tracer statistics could not be read.", "gauge")
+		writeSample(buf, "tcptracer_stats_error", nil, boolToFloat(statsErr))
+	}
+
+	return buf.WriteTo(w)
+}
+
+func writeDelivered(w *bytes.Buffer, name, help string, delivered map[tracer.EventType]uint64) {
+	writeHeader(w, name, help, "counter")
+	types := make([]int, 0, len(delivered))
+	for t := range delivered {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		n := delivered[tracer.EventType(t)]
+		writeSample(w, name, []string{"type", tracer.EventType(t).String()}, float64(n))
+	}
+}
+
+// writeConnCounter writes the series of c, with a remote_port label if
+// portLabel is true. The label is empty for the port 0, used for the
+// connections whose remote port is not reported.
+func (e *Exporter) writeConnCounter(w *bytes.Buffer, name, help string, c *counterVec, portLabel bool) {
+	writeHeader(w, name, help, "counter")
+
+	labels := make([]connLabels, 0, len(c.values))
+	for l := range c.values {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].comm != labels[j].comm {
+			return labels[i].comm < labels[j].comm
+		}
+		if labels[i].netns != labels[j].netns {
+			return labels[i].netns < labels[j].netns
+		}
+		return labels[i].port < labels[j].port
+	})
+
+	for _, l := range labels {
+		pairs := []string{"comm", l.comm, "netns", strconv.FormatUint(uint64(l.netns), 10)}
+		if portLabel {
+			port := ""
+			if l.port != 0 {
+				port = strconv.FormatUint(uint64(l.port), 10)
+			}
+			pairs = append(pairs, "remote_port", port)
+		}
+		writeSample(w, name, pairs, float64(c.values[l]))
+	}
+	if c.overflow > 0 {
+		pairs := []string{"comm", otherLabel, "netns", otherLabel}
+		if portLabel {
+			pairs = append(pairs, "remote_port", otherLabel)
+		}
+		writeSample(w, name, pairs, float64(c.overflow))
+	}
+}
+
+func (e *Exporter) writeCloseReasons(w *bytes.Buffer) {
+	const name = "tcptracer_connections_closed_by_reason_total"
+	writeHeader(w, name, "TCP connections closed, by reason.", "counter")
+
+	reasons := make([]int, 0, len(e.closeReason))
+	for r := range e.closeReason {
+		reasons = append(reasons, int(r))
+	}
+	sort.Ints(reasons)
+	for _, r := range reasons {
+		reason := tracer.CloseReason(r)
+		writeSample(w, name, []string{"reason", reason.String()}, float64(e.closeReason[reason]))
+	}
+}
+
+func (e *Exporter) writeDurations(w *bytes.Buffer) {
+	const name = "tcptracer_connection_duration_seconds"
+	writeHeader(w, name, "Duration of the TCP connections, from connect or accept to close.", "histogram")
+
+	directions := make([]string, 0, len(e.durations))
+	for d := range e.durations {
+		directions = append(directions, d)
+	}
+	sort.Strings(directions)
+
+	for _, d := range directions {
+		h := e.durations[d]
+		for i, le := range e.opts.DurationBuckets {
+			writeSample(w, name+"_bucket", []string{"direction", d, "le", formatFloat(le)}, float64(h.buckets[i]))
+		}
+		writeSample(w, name+"_bucket", []string{"direction", d, "le", "+Inf"}, float64(h.count))
+		writeSample(w, name+"_sum", []string{"direction", d}, h.sum)
+		writeSample(w, name+"_count", []string{"direction", d}, float64(h.count))
+	}
+}
+
+func writeHeader(w *bytes.Buffer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeSample writes a sample line. labels holds label names and values,
+// alternately.
+func writeSample(w *bytes.Buffer, name string, labels []string, value float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(escapeLabelValue(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(w, "%s %s\n", b.String(), formatFloat(value))
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
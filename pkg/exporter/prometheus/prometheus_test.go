@@ -0,0 +1,128 @@
+package prometheus
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/weaveworks/tcptracer-bpf/pkg/tracer"
+)
+
+type fakeStats struct {
+	stats tracer.Stats
+	err   error
+}
+
+func (f fakeStats) Stats() (tracer.Stats, error) {
+	return f.stats, f.err
+}
+
+func writeMetrics(t *testing.T, e *Exporter) string {
+	var buf bytes.Buffer
+	if _, err := e.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestWriteToStatsError(t *testing.T) {
+	e := New(Options{})
+	e.TCPEventsBatch([]tracer.Event{{Type: tracer.EventConnect, Comm: "curl", SockID: 1}})
+	e.LostV4(3)
+
+	e.SetTracer(fakeStats{err: errors.New("no map with name tcptracer_stats")})
+	out := writeMetrics(t, e)
+	for _, want := range []string{
+		`tcptracer_connections_opened_total{comm="curl",netns="0"} 1`,
+		`tcptracer_events_lost_total{family="ipv4",where="kernel"} 3`,
+		"tcptracer_stats_error 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "tcptracer_events_delivered_total{") {
+		t.Errorf("tracer stats written despite the error:\n%s", out)
+	}
+
+	e.SetTracer(fakeStats{stats: tracer.Stats{
+		Delivered:     map[tracer.EventType]uint64{tracer.EventConnect: 1},
+		DeliveredUnix: map[tracer.EventType]uint64{tracer.EventAccept: 2},
+		QueueStats:    tracer.QueueStats{DroppedUnix: 4},
+	}})
+	out = writeMetrics(t, e)
+	for _, want := range []string{
+		`tcptracer_events_delivered_total{type="connect"} 1`,
+		`tcptracer_unix_events_delivered_total{type="accept"} 2`,
+		`tcptracer_events_lost_total{family="unix",where="queue"} 4`,
+		"tcptracer_stats_error 0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestUntrackedConnections(t *testing.T) {
+	e := New(Options{MaxTrackedConnections: 2})
+	var events []tracer.Event
+	for id := uint64(1); id <= 5; id++ {
+		events = append(events, tracer.Event{Type: tracer.EventAccept, SockID: id, Timestamp: id * 1e9})
+	}
+	e.TCPEventsBatch(events)
+
+	// the oldest connections are forgotten, as if their close event was
+	// lost
+	out := writeMetrics(t, e)
+	if want := "tcptracer_connections_untracked_total 3\n"; !strings.Contains(out, want) {
+		t.Errorf("missing %q in:\n%s", want, out)
+	}
+
+	// closing a tracked connection makes room for a new one, the close of
+	// a forgotten one doesn't
+	e.TCPEventsBatch([]tracer.Event{
+		{Type: tracer.EventClose, SockID: 1, Timestamp: 10e9},
+		{Type: tracer.EventClose, SockID: 5, Timestamp: 10e9},
+		{Type: tracer.EventAccept, SockID: 6, Timestamp: 11e9},
+		{Type: tracer.EventClose, SockID: 4, Timestamp: 12e9},
+	})
+	out = writeMetrics(t, e)
+	for _, want := range []string{
+		"tcptracer_connections_untracked_total 3\n",
+		`tcptracer_connection_duration_seconds_count{direction="inbound"} 2` + "\n",
+		`tcptracer_connection_duration_seconds_sum{direction="inbound"} 13` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestRemotePortLabel(t *testing.T) {
+	e := New(Options{RemotePortLabel: true})
+	e.TCPEventsBatch([]tracer.Event{
+		{Type: tracer.EventConnect, Comm: "curl", SockID: 1, SPort: 50000, DPort: 443},
+		{Type: tracer.EventAccept, Comm: "nginx", SockID: 2, SPort: 80, DPort: 50001},
+		{Type: tracer.EventAccept, Comm: "nginx", SockID: 3, SPort: 80, DPort: 50002},
+		{Type: tracer.EventClose, Comm: "curl", SockID: 1, SPort: 50000, DPort: 443},
+		{Type: tracer.EventClose, Comm: "nginx", SockID: 2, SPort: 80, DPort: 50001},
+		// opened before the exporter
+		{Type: tracer.EventClose, Comm: "nginx", SockID: 4, SPort: 80, DPort: 50003},
+	})
+
+	out := writeMetrics(t, e)
+	for _, want := range []string{
+		`tcptracer_connections_opened_total{comm="curl",netns="0",remote_port="443"} 1`,
+		`tcptracer_connections_accepted_total{comm="nginx",netns="0"} 2`,
+		`tcptracer_connections_closed_total{comm="curl",netns="0",remote_port="443"} 1`,
+		`tcptracer_connections_closed_total{comm="nginx",netns="0",remote_port=""} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "5000") {
+		t.Errorf("ephemeral port in the labels:\n%s", out)
+	}
+}
@@ -0,0 +1,211 @@
+// +build linux
+
+package tracer
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	bpflib "github.com/iovisor/gobpf/elf"
+)
+
+// Map element commands of the bpf syscall. BPF_MAP_GET_NEXT_KEY is not
+// wrapped by gobpf, and its wrappers of the others don't tell a missing
+// element from a failure.
+const (
+	bpfMapLookupElem = 1
+	bpfMapDeleteElem = 3
+	bpfMapGetNextKey = 4
+)
+
+// bpfMapElemAttr is the part of union bpf_attr used by the map element
+// commands, see include/uapi/linux/bpf.h.
+type bpfMapElemAttr struct {
+	MapFd uint32
+	_     uint32
+	Key   uint64
+	// NextKey is value for the other commands
+	NextKey uint64
+	Flags   uint64
+}
+
+// mapNextKey stores in nextKey the key following key in mp, or its first
+// key if key is nil. It returns false once all the keys have been seen.
+func mapNextKey(mp *bpflib.Map, key, nextKey unsafe.Pointer) (bool, error) {
+	attr := bpfMapElemAttr{
+		MapFd:   uint32(mp.Fd()),
+		Key:     uint64(uintptr(key)),
+		NextKey: uint64(uintptr(nextKey)),
+	}
+	_, _, errno := syscall.Syscall(sysBPF, bpfMapGetNextKey, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(nextKey)
+	if errno == syscall.ENOENT {
+		return false, nil
+	}
+	if errno != 0 {
+		return false, errno
+	}
+	return true, nil
+}
+
+// mapLookupElem reads the value of key in mp into value. It returns false if
+// the key is not in mp.
+func mapLookupElem(mp *bpflib.Map, key, value unsafe.Pointer) (bool, error) {
+	return mapElemCmd(bpfMapLookupElem, mp, key, value)
+}
+
+// mapDeleteElem removes key from mp. It returns false if the key was not in
+// mp.
+func mapDeleteElem(mp *bpflib.Map, key unsafe.Pointer) (bool, error) {
+	return mapElemCmd(bpfMapDeleteElem, mp, key, nil)
+}
+
+func mapElemCmd(cmd uintptr, mp *bpflib.Map, key, value unsafe.Pointer) (bool, error) {
+	attr := bpfMapElemAttr{
+		MapFd:   uint32(mp.Fd()),
+		Key:     uint64(uintptr(key)),
+		NextKey: uint64(uintptr(value)),
+	}
+	_, _, errno := syscall.Syscall(sysBPF, cmd, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	if errno == syscall.ENOENT {
+		return false, nil
+	}
+	if errno != 0 {
+		return false, errno
+	}
+	return true, nil
+}
+
+// aggregateKey mirrors the layout of struct aggregate_key_t in
+// tcptracer-bpf.h.
+type aggregateKey struct {
+	DAddr [16]byte
+	NetNS uint32
+	Pid   uint32
+	Type  EventType
+	DPort uint16
+	IPv6  uint8
+	_     uint8
+}
+
+func (k *aggregateKey) aggregate(count uint64) Aggregate {
+	a := Aggregate{
+		Type:  k.Type,
+		Pid:   k.Pid,
+		NetNS: k.NetNS,
+		DPort: k.DPort,
+		Count: count,
+	}
+	if k.IPv6 != 0 {
+		a.DAddr = make(net.IP, net.IPv6len)
+		copy(a.DAddr, k.DAddr[:])
+	} else {
+		// the address is in the low 32 bits of the second u64
+		var b [4]byte
+		nativeEndian.PutUint32(b[:], uint32(nativeEndian.Uint64(k.DAddr[8:])))
+		a.DAddr = net.IPv4(b[0], b[1], b[2], b[3])
+	}
+	return a
+}
+
+// aggregateCount is the counter of an entry of the aggregates map.
+type aggregateCount struct {
+	key   aggregateKey
+	count uint64
+}
+
+// aggregateReader reads the counters of the aggregates map. The eBPF
+// programs only increment them: the reader reports the difference with the
+// previous read, and removes the entries that did not change, so that the
+// map doesn't fill up. An event counted between the read and the removal of
+// its entry is lost.
+type aggregateReader struct {
+	mp *bpflib.Map
+
+	mu   sync.Mutex
+	prev map[aggregateKey]uint64
+}
+
+func newAggregateReader(mp *bpflib.Map) *aggregateReader {
+	return &aggregateReader{
+		mp:   mp,
+		prev: make(map[aggregateKey]uint64),
+	}
+}
+
+func (r *aggregateReader) read() ([]Aggregate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// the keys are listed before any is deleted: the iteration restarts
+	// from the first key when the current one is deleted
+	var keys []aggregateKey
+	var key, next aggregateKey
+	keyp := unsafe.Pointer(nil)
+	for {
+		ok, err := mapNextKey(r.mp, keyp, unsafe.Pointer(&next))
+		if err != nil {
+			return nil, fmt.Errorf("error listing aggregates: %v", err)
+		}
+		if !ok {
+			break
+		}
+		keys = append(keys, next)
+		key = next
+		keyp = unsafe.Pointer(&key)
+	}
+
+	counts := make([]aggregateCount, 0, len(keys))
+	for i := range keys {
+		c := aggregateCount{key: keys[i]}
+		ok, err := mapLookupElem(r.mp, unsafe.Pointer(&c.key), unsafe.Pointer(&c.count))
+		if err != nil {
+			return nil, fmt.Errorf("error reading aggregates: %v", err)
+		}
+		if ok {
+			counts = append(counts, c)
+		}
+	}
+
+	prev := r.prev
+	ret, unchanged := r.delta(counts)
+	for i := range unchanged {
+		if _, err := mapDeleteElem(r.mp, unsafe.Pointer(&unchanged[i].key)); err != nil {
+			// the next read reports the counts of this one again
+			r.prev = prev
+			return nil, fmt.Errorf("error removing aggregates: %v", err)
+		}
+	}
+	return ret, nil
+}
+
+// delta returns the aggregates counted since the previous call, and the
+// entries that did not change, to be removed from the map. The entries
+// missing from counts were removed.
+func (r *aggregateReader) delta(counts []aggregateCount) ([]Aggregate, []aggregateCount) {
+	var ret []Aggregate
+	var unchanged []aggregateCount
+	seen := make(map[aggregateKey]uint64, len(counts))
+	for _, c := range counts {
+		prev := r.prev[c.key]
+		if c.count < prev {
+			// removed and added again
+			prev = 0
+		}
+		if c.count == prev {
+			unchanged = append(unchanged, c)
+			continue
+		}
+		seen[c.key] = c.count
+		ret = append(ret, c.key.aggregate(c.count-prev))
+	}
+	r.prev = seen
+	return ret, unchanged
+}
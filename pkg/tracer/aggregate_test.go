@@ -0,0 +1,118 @@
+// +build linux
+
+package tracer
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func v4AggregateKey(ip net.IP, dport uint16) aggregateKey {
+	k := aggregateKey{
+		NetNS: testNetNS,
+		Pid:   4242,
+		Type:  EventConnect,
+		DPort: dport,
+	}
+	// as the eBPF program stores it: in the low 32 bits of daddr_l
+	ip4 := ip.To4()
+	nativeEndian.PutUint64(k.DAddr[8:], uint64(nativeEndian.Uint32(ip4)))
+	return k
+}
+
+func TestAggregateKey(t *testing.T) {
+	k := v4AggregateKey(net.ParseIP("10.1.2.3"), 80)
+	want := Aggregate{
+		Type:  EventConnect,
+		Pid:   4242,
+		NetNS: testNetNS,
+		DAddr: net.ParseIP("10.1.2.3"),
+		DPort: 80,
+		Count: 5,
+	}
+	if got := k.aggregate(5); !reflect.DeepEqual(got, want) {
+		t.Errorf("IPv4: got %+v, want %+v", got, want)
+	}
+
+	ip6 := net.ParseIP("2001:db8::1")
+	k = aggregateKey{
+		NetNS: testNetNS,
+		Pid:   4242,
+		Type:  EventAccept,
+		DPort: 443,
+		IPv6:  1,
+	}
+	copy(k.DAddr[:], ip6)
+	want = Aggregate{
+		Type:  EventAccept,
+		Pid:   4242,
+		NetNS: testNetNS,
+		DAddr: ip6,
+		DPort: 443,
+		Count: 1,
+	}
+	if got := k.aggregate(1); !reflect.DeepEqual(got, want) {
+		t.Errorf("IPv6: got %+v, want %+v", got, want)
+	}
+}
+
+func TestAggregateDelta(t *testing.T) {
+	a := v4AggregateKey(net.ParseIP("10.0.0.1"), 80)
+	b := v4AggregateKey(net.ParseIP("10.0.0.2"), 443)
+	r := newAggregateReader(nil)
+
+	for _, tt := range []struct {
+		name      string
+		counts    []aggregateCount
+		want      map[aggregateKey]uint64
+		unchanged []aggregateKey
+	}{
+		{
+			name:   "first read",
+			counts: []aggregateCount{{a, 3}, {b, 1}},
+			want:   map[aggregateKey]uint64{a: 3, b: 1},
+		},
+		{
+			name:      "increase",
+			counts:    []aggregateCount{{a, 5}, {b, 1}},
+			want:      map[aggregateKey]uint64{a: 2},
+			unchanged: []aggregateKey{b},
+		},
+		{
+			// b was removed, it counts from 0 again
+			name:      "removed",
+			counts:    []aggregateCount{{a, 5}, {b, 2}},
+			want:      map[aggregateKey]uint64{b: 2},
+			unchanged: []aggregateKey{a},
+		},
+		{
+			// a was removed and added again between two reads
+			name:   "reset",
+			counts: []aggregateCount{{a, 1}, {b, 4}},
+			want:   map[aggregateKey]uint64{a: 1, b: 2},
+		},
+	} {
+		ret, unchanged := r.delta(tt.counts)
+
+		got := make(map[aggregateKey]uint64)
+		for _, agg := range ret {
+			for _, c := range tt.counts {
+				if reflect.DeepEqual(c.key.aggregate(agg.Count), agg) {
+					got[c.key] = agg.Count
+				}
+			}
+		}
+		if len(got) != len(ret) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want counts %v", tt.name, ret, tt.want)
+		}
+
+		var gotUnchanged []aggregateKey
+		for _, c := range unchanged {
+			gotUnchanged = append(gotUnchanged, c.key)
+		}
+		if !reflect.DeepEqual(gotUnchanged, tt.unchanged) {
+			t.Errorf("%s: unchanged %v, want %v", tt.name, gotUnchanged, tt.unchanged)
+		}
+	}
+}
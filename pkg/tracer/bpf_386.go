@@ -0,0 +1,6 @@
+// +build linux,386
+
+package tracer
+
+// The syscall package doesn't define SYS_BPF on 386.
+const sysBPF = 357
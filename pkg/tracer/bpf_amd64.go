@@ -0,0 +1,6 @@
+// +build linux,amd64
+
+package tracer
+
+// The syscall package doesn't define SYS_BPF on amd64.
+const sysBPF = 321
@@ -0,0 +1,6 @@
+// +build linux,arm
+
+package tracer
+
+// The syscall package doesn't define SYS_BPF on arm.
+const sysBPF = 386
@@ -0,0 +1,7 @@
+// +build linux
+// +build mips mipsle
+
+package tracer
+
+// The syscall package doesn't define SYS_BPF on mips and mipsle.
+const sysBPF = 4355
@@ -0,0 +1,7 @@
+// +build linux,!amd64,!386,!arm,!ppc64,!ppc64le,!mips,!mipsle
+
+package tracer
+
+import "syscall"
+
+const sysBPF = syscall.SYS_BPF
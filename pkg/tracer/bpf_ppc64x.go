@@ -0,0 +1,7 @@
+// +build linux
+// +build ppc64 ppc64le
+
+package tracer
+
+// The syscall package doesn't define SYS_BPF on ppc64 and ppc64le.
+const sysBPF = 361
@@ -0,0 +1,358 @@
+// +build linux
+
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+)
+
+// BTF kinds, see include/uapi/linux/btf.h
+const (
+	btfKindInt      = 1
+	btfKindPtr      = 2
+	btfKindArray    = 3
+	btfKindStruct   = 4
+	btfKindUnion    = 5
+	btfKindEnum     = 6
+	btfKindFwd      = 7
+	btfKindTypedef  = 8
+	btfKindVolatile = 9
+	btfKindConst    = 10
+	btfKindRestrict = 11
+	btfKindFunc     = 12
+	btfKindFuncProt = 13
+	btfKindVar      = 14
+	btfKindDatasec  = 15
+	btfKindFloat    = 16
+	btfKindDeclTag  = 17
+	btfKindTypeTag  = 18
+	btfKindEnum64   = 19
+)
+
+const btfMagic = 0xeb9f
+
+// btfType is struct btf_type followed by its members, for structs and
+// unions.
+type btfType struct {
+	name     string
+	kind     uint32
+	typ      uint32 // size, or type referred to for modifiers and typedefs
+	members  []btfMember
+	bitfield bool
+}
+
+type btfMember struct {
+	name      string
+	typ       uint32
+	bitOffset uint32
+}
+
+// btfSpec holds the types of a BTF blob. Type ids start at 1.
+type btfSpec struct {
+	types   []btfType
+	structs map[string]uint32
+}
+
+// loadBTF parses the types of the BTF blob at path. Only the information
+// needed to find the offsets of struct members is kept.
+func loadBTF(path string) (*btfSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseBTF(data)
+}
+
+func parseBTF(data []byte) (*btfSpec, error) {
+	if len(data) < 24 {
+		return nil, fmt.Errorf("BTF header too short")
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	if binary.LittleEndian.Uint16(data[0:2]) != btfMagic {
+		bo = binary.BigEndian
+		if bo.Uint16(data[0:2]) != btfMagic {
+			return nil, fmt.Errorf("invalid BTF magic")
+		}
+	}
+	hdrLen := bo.Uint32(data[4:8])
+	typeOff := hdrLen + bo.Uint32(data[8:12])
+	typeLen := bo.Uint32(data[12:16])
+	strOff := hdrLen + bo.Uint32(data[16:20])
+	strLen := bo.Uint32(data[20:24])
+	if uint64(typeOff)+uint64(typeLen) > uint64(len(data)) || uint64(strOff)+uint64(strLen) > uint64(len(data)) {
+		return nil, fmt.Errorf("BTF sections out of bounds")
+	}
+	types := data[typeOff : typeOff+typeLen]
+	strs := data[strOff : strOff+strLen]
+
+	str := func(off uint32) string {
+		if off >= uint32(len(strs)) {
+			return ""
+		}
+		s := strs[off:]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		return string(s)
+	}
+
+	spec := &btfSpec{
+		// type 0 is void
+		types:   []btfType{{}},
+		structs: make(map[string]uint32),
+	}
+	for off := 0; off+12 <= len(types); {
+		info := bo.Uint32(types[off+4 : off+8])
+		t := btfType{
+			name:     str(bo.Uint32(types[off : off+4])),
+			kind:     (info >> 24) & 0x1f,
+			typ:      bo.Uint32(types[off+8 : off+12]),
+			bitfield: info>>31 == 1,
+		}
+		vlen := int(info & 0xffff)
+		off += 12
+
+		var extra int
+		switch t.kind {
+		case btfKindInt, btfKindVar, btfKindDeclTag:
+			extra = 4
+		case btfKindArray:
+			extra = 12
+		case btfKindStruct, btfKindUnion:
+			extra = 12 * vlen
+			if off+extra > len(types) {
+				return nil, fmt.Errorf("BTF type section truncated")
+			}
+			for i := 0; i < vlen; i++ {
+				m := types[off+12*i:]
+				t.members = append(t.members, btfMember{
+					name:      str(bo.Uint32(m[0:4])),
+					typ:       bo.Uint32(m[4:8]),
+					bitOffset: bo.Uint32(m[8:12]),
+				})
+			}
+		case btfKindEnum, btfKindFuncProt:
+			extra = 8 * vlen
+		case btfKindDatasec, btfKindEnum64:
+			extra = 12 * vlen
+		case btfKindPtr, btfKindFwd, btfKindTypedef, btfKindVolatile, btfKindConst,
+			btfKindRestrict, btfKindFunc, btfKindFloat, btfKindTypeTag:
+		default:
+			return nil, fmt.Errorf("unknown BTF kind %d", t.kind)
+		}
+		off += extra
+
+		if t.kind == btfKindStruct && t.name != "" {
+			if _, ok := spec.structs[t.name]; !ok {
+				spec.structs[t.name] = uint32(len(spec.types))
+			}
+		}
+		spec.types = append(spec.types, t)
+	}
+
+	return spec, nil
+}
+
+// size returns the size in bytes of t, for the kinds which have one.
+func (t *btfType) size() (uint32, bool) {
+	switch t.kind {
+	case btfKindInt, btfKindStruct, btfKindUnion, btfKindEnum, btfKindFloat, btfKindEnum64:
+		return t.typ, true
+	}
+	return 0, false
+}
+
+// resolve skips the typedefs and type modifiers.
+func (s *btfSpec) resolve(id uint32) (*btfType, error) {
+	for i := 0; i < 32; i++ {
+		if int(id) >= len(s.types) {
+			return nil, fmt.Errorf("invalid BTF type id %d", id)
+		}
+		t := &s.types[id]
+		switch t.kind {
+		case btfKindTypedef, btfKindVolatile, btfKindConst, btfKindRestrict, btfKindTypeTag:
+			id = t.typ
+		default:
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("BTF type id %d: too many indirections", id)
+}
+
+// memberOffset returns the offset in bytes of the member of t called name,
+// looking into anonymous structs and unions.
+func (s *btfSpec) memberOffset(t *btfType, name string) (uint32, *btfType, bool) {
+	for _, m := range t.members {
+		bitOffset := m.bitOffset
+		if t.bitfield {
+			bitOffset &= 0xffffff
+		}
+		if m.name == name {
+			mt, err := s.resolve(m.typ)
+			if err != nil || bitOffset%8 != 0 {
+				return 0, nil, false
+			}
+			return bitOffset / 8, mt, true
+		}
+		if m.name != "" {
+			continue
+		}
+		mt, err := s.resolve(m.typ)
+		if err != nil || (mt.kind != btfKindStruct && mt.kind != btfKindUnion) {
+			continue
+		}
+		if off, ft, ok := s.memberOffset(mt, name); ok {
+			return bitOffset/8 + off, ft, true
+		}
+	}
+	return 0, nil, false
+}
+
+// offsetOf returns the offset in bytes of the member at path in the struct
+// called structName, e.g. offsetOf("tcp_sock", "inet_conn", "icsk_ca_ops").
+func (s *btfSpec) offsetOf(structName string, path ...string) (uint64, error) {
+	off, _, err := s.member(structName, path...)
+	return off, err
+}
+
+// sizeOf returns the size in bytes of the member at path in the struct
+// called structName.
+func (s *btfSpec) sizeOf(structName string, path ...string) (uint32, error) {
+	_, t, err := s.member(structName, path...)
+	if err != nil {
+		return 0, err
+	}
+	size, ok := t.size()
+	if !ok {
+		return 0, fmt.Errorf("member %v of struct %s has no size", path, structName)
+	}
+	return size, nil
+}
+
+// member returns the offset in bytes and the type of the member at path in
+// the struct called structName.
+func (s *btfSpec) member(structName string, path ...string) (uint64, *btfType, error) {
+	id, ok := s.structs[structName]
+	if !ok {
+		return 0, nil, fmt.Errorf("struct %s not found", structName)
+	}
+	t := &s.types[id]
+	var total uint64
+	for _, name := range path {
+		off, mt, ok := s.memberOffset(t, name)
+		if !ok {
+			return 0, nil, fmt.Errorf("member %s of struct %s not found", name, structName)
+		}
+		total += uint64(off)
+		t = mt
+	}
+	return total, t, nil
+}
+
+// btfOffset is an offset of the status to set from the BTF blob.
+type btfOffset struct {
+	dst        *uint64
+	structName string
+	path       []string
+}
+
+// setBTFOffsets sets the offsets of the status that are not guessed, from
+// the BTF blob at path. The features whose offsets are not all found stay
+// disabled.
+func setBTFOffsets(status *tcpTracerStatus, path string) error {
+	spec, err := loadBTF(path)
+	if err != nil {
+		return err
+	}
+
+	tcpErr := spec.setOffsets(tcpStatsOffsets(status))
+	if tcpErr == nil {
+		status.TCPStatsReady = 1
+	}
+	var upidNr uint64
+	unixErr := spec.setOffsets(unixOffsets(status, &upidNr))
+	if unixErr == nil {
+		// the pid in the initial namespace is pid->numbers[0].nr
+		status.OffsetPidNr += upidNr
+		status.UnixReady = 1
+	}
+	listenErr := spec.setOffsets(listenOffsets(status))
+	if listenErr == nil {
+		// the eBPF program reads the backlogs as u32, older kernels
+		// have u16 ones
+		listenErr = spec.checkSizes(4, "sock", "sk_ack_backlog", "sk_max_ack_backlog")
+	}
+	if listenErr == nil {
+		status.ListenReady = 1
+	}
+
+	if tcpErr != nil {
+		return tcpErr
+	}
+	if unixErr != nil {
+		return unixErr
+	}
+	return listenErr
+}
+
+func (s *btfSpec) setOffsets(offsets []btfOffset) error {
+	for _, o := range offsets {
+		off, err := s.offsetOf(o.structName, o.path...)
+		if err != nil {
+			return err
+		}
+		*o.dst = off
+	}
+	return nil
+}
+
+// checkSizes returns an error unless the members of the struct called
+// structName are size bytes.
+func (s *btfSpec) checkSizes(size uint32, structName string, members ...string) error {
+	for _, name := range members {
+		got, err := s.sizeOf(structName, name)
+		if err != nil {
+			return err
+		}
+		if got != size {
+			return fmt.Errorf("member %s of struct %s is %d bytes, not %d", name, structName, got, size)
+		}
+	}
+	return nil
+}
+
+func tcpStatsOffsets(status *tcpTracerStatus) []btfOffset {
+	return []btfOffset{
+		{&status.OffsetSrtt, "tcp_sock", []string{"srtt_us"}},
+		{&status.OffsetMdev, "tcp_sock", []string{"mdev_us"}},
+		{&status.OffsetTotalRetrans, "tcp_sock", []string{"total_retrans"}},
+		{&status.OffsetSndCwnd, "tcp_sock", []string{"snd_cwnd"}},
+		{&status.OffsetCaOps, "tcp_sock", []string{"inet_conn", "icsk_ca_ops"}},
+		{&status.OffsetCaName, "tcp_congestion_ops", []string{"name"}},
+	}
+}
+
+func unixOffsets(status *tcpTracerStatus, upidNr *uint64) []btfOffset {
+	return []btfOffset{
+		{&status.OffsetSocketSk, "socket", []string{"sk"}},
+		{&status.OffsetPeerPid, "sock", []string{"sk_peer_pid"}},
+		{&status.OffsetPidNr, "pid", []string{"numbers"}},
+		{upidNr, "upid", []string{"nr"}},
+		{&status.OffsetUnixAddr, "unix_sock", []string{"addr"}},
+		{&status.OffsetUnixAddrLen, "unix_address", []string{"len"}},
+		{&status.OffsetUnixAddrName, "unix_address", []string{"name"}},
+		{&status.OffsetPidTasks, "pid", []string{"tasks"}},
+		{&status.OffsetTaskPidLinks, "task_struct", []string{"pid_links"}},
+		{&status.OffsetTaskComm, "task_struct", []string{"comm"}},
+	}
+}
+
+func listenOffsets(status *tcpTracerStatus) []btfOffset {
+	return []btfOffset{
+		{&status.OffsetAckBacklog, "sock", []string{"sk_ack_backlog"}},
+		{&status.OffsetMaxAckBacklog, "sock", []string{"sk_max_ack_backlog"}},
+	}
+}
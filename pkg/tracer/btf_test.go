@@ -0,0 +1,280 @@
+// +build linux
+
+package tracer
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// btfBuilder writes a BTF blob, one type at a time. Type ids start at 1, in
+// the order of the calls.
+type btfBuilder struct {
+	bo    binary.ByteOrder
+	types []byte
+	strs  []byte
+}
+
+func newBTFBuilder(bo binary.ByteOrder) *btfBuilder {
+	// the string at offset 0 is the empty name
+	return &btfBuilder{bo: bo, strs: []byte{0}}
+}
+
+func (b *btfBuilder) str(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	off := uint32(len(b.strs))
+	b.strs = append(append(b.strs, s...), 0)
+	return off
+}
+
+func (b *btfBuilder) u32(v uint32) {
+	var buf [4]byte
+	b.bo.PutUint32(buf[:], v)
+	b.types = append(b.types, buf[:]...)
+}
+
+func (b *btfBuilder) typ(name string, kind uint32, kindFlag bool, vlen int, sizeOrType uint32) {
+	info := kind<<24 | uint32(vlen)
+	if kindFlag {
+		info |= 1 << 31
+	}
+	b.u32(b.str(name))
+	b.u32(info)
+	b.u32(sizeOrType)
+}
+
+func (b *btfBuilder) intType(name string, size uint32) {
+	b.typ(name, btfKindInt, false, 0, size)
+	b.u32(size * 8)
+}
+
+type btfTestMember struct {
+	name string
+	typ  uint32
+	// offset is the bit offset, or the bitfield size << 24 | bit offset
+	// with kind_flag
+	offset uint32
+}
+
+func (b *btfBuilder) composite(name string, kind uint32, kindFlag bool, size uint32, members ...btfTestMember) {
+	b.typ(name, kind, kindFlag, len(members), size)
+	for _, m := range members {
+		b.u32(b.str(m.name))
+		b.u32(m.typ)
+		b.u32(m.offset)
+	}
+}
+
+func (b *btfBuilder) blob() []byte {
+	hdr := make([]byte, 24)
+	b.bo.PutUint16(hdr[0:2], btfMagic)
+	hdr[2] = 1 // version
+	b.bo.PutUint32(hdr[4:8], 24)
+	b.bo.PutUint32(hdr[8:12], 0)
+	b.bo.PutUint32(hdr[12:16], uint32(len(b.types)))
+	b.bo.PutUint32(hdr[16:20], uint32(len(b.types)))
+	b.bo.PutUint32(hdr[20:24], uint32(len(b.strs)))
+	return append(append(hdr, b.types...), b.strs...)
+}
+
+// testBTF returns a blob with:
+//
+//	struct sock {				// kind_flag set
+//		volatile const u32 x;		// 0
+//		union {				// 8
+//			struct {
+//				unsigned int a;	// 8
+//				short unsigned int b; // 12
+//			};
+//			unsigned int u;		// 8
+//		};
+//		unsigned int sk_ack_backlog;	// 16
+//		short unsigned int sk_max_ack_backlog; // 20
+//		unsigned int flags:4;		// bit 180
+//		unsigned int bits:8;		// 23
+//	};
+//	struct outer {
+//		unsigned int pad;
+//		inner_t in;			// typedef struct inner, 4
+//	};
+//	struct inner { unsigned int pad; unsigned int z; };	// z at 4
+func testBTF(bo binary.ByteOrder, backlogType uint32) []byte {
+	b := newBTFBuilder(bo)
+	b.intType("unsigned int", 4)              // 1
+	b.intType("short unsigned int", 2)        // 2
+	b.typ("u32", btfKindTypedef, false, 0, 1) // 3
+	b.typ("", btfKindConst, false, 0, 3)      // 4
+	b.typ("", btfKindVolatile, false, 0, 4)   // 5
+	b.composite("", btfKindStruct, false, 8,  // 6
+		btfTestMember{"a", 1, 0},
+		btfTestMember{"b", 2, 32})
+	b.composite("", btfKindUnion, false, 8, // 7
+		btfTestMember{"", 6, 0},
+		btfTestMember{"u", 1, 0})
+	// an enum and a function prototype, whose entries are skipped
+	b.typ("state", btfKindEnum, false, 2, 4) // 8
+	b.u32(b.str("ONE"))
+	b.u32(1)
+	b.u32(b.str("TWO"))
+	b.u32(2)
+	b.typ("", btfKindFuncProt, false, 1, 1) // 9
+	b.u32(0)
+	b.u32(1)
+	b.typ("", btfKindPtr, false, 0, 10)          // 10
+	b.composite("sock", btfKindStruct, true, 32, // 11
+		btfTestMember{"x", 5, 0},
+		btfTestMember{"", 7, 64},
+		btfTestMember{"sk_ack_backlog", 1, 128},
+		btfTestMember{"sk_max_ack_backlog", backlogType, 160},
+		btfTestMember{"flags", 1, 4<<24 | 180},
+		btfTestMember{"bits", 1, 8<<24 | 184})
+	b.composite("inner", btfKindStruct, false, 8, // 12
+		btfTestMember{"pad", 1, 0},
+		btfTestMember{"z", 1, 32})
+	b.typ("inner_t", btfKindTypedef, false, 0, 12) // 13
+	b.composite("outer", btfKindStruct, false, 12, // 14
+		btfTestMember{"pad", 1, 0},
+		btfTestMember{"in", 13, 32})
+	return b.blob()
+}
+
+func TestBTFOffsets(t *testing.T) {
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		spec, err := parseBTF(testBTF(bo, 2))
+		if err != nil {
+			t.Fatalf("%v: %v", bo, err)
+		}
+
+		for _, tt := range []struct {
+			structName string
+			path       []string
+			want       uint64
+			wantSize   uint32
+		}{
+			{"sock", []string{"x"}, 0, 4},
+			{"sock", []string{"a"}, 8, 4},
+			{"sock", []string{"b"}, 12, 2},
+			{"sock", []string{"u"}, 8, 4},
+			{"sock", []string{"sk_ack_backlog"}, 16, 4},
+			{"sock", []string{"sk_max_ack_backlog"}, 20, 2},
+			{"sock", []string{"bits"}, 23, 4},
+			{"outer", []string{"in", "z"}, 8, 4},
+		} {
+			off, err := spec.offsetOf(tt.structName, tt.path...)
+			if err != nil {
+				t.Errorf("%v: %s %v: %v", bo, tt.structName, tt.path, err)
+				continue
+			}
+			if off != tt.want {
+				t.Errorf("%v: %s %v at %d, want %d", bo, tt.structName, tt.path, off, tt.want)
+			}
+			size, err := spec.sizeOf(tt.structName, tt.path...)
+			if err != nil || size != tt.wantSize {
+				t.Errorf("%v: %s %v is %d bytes (%v), want %d", bo, tt.structName, tt.path, size, err, tt.wantSize)
+			}
+		}
+
+		for _, tt := range []struct {
+			structName string
+			path       []string
+		}{
+			{"task_struct", []string{"comm"}},
+			{"sock", []string{"missing"}},
+			// not on a byte boundary
+			{"sock", []string{"flags"}},
+			{"outer", []string{"in", "missing"}},
+		} {
+			if off, err := spec.offsetOf(tt.structName, tt.path...); err == nil {
+				t.Errorf("%v: %s %v found at %d", bo, tt.structName, tt.path, off)
+			}
+		}
+	}
+}
+
+func TestBTFResolve(t *testing.T) {
+	b := newBTFBuilder(binary.LittleEndian)
+	b.typ("loop", btfKindTypedef, false, 0, 1)    // 1
+	b.typ("dangling", btfKindConst, false, 0, 42) // 2
+	spec, err := parseBTF(b.blob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spec.resolve(1); err == nil {
+		t.Error("no error resolving a typedef loop")
+	}
+	if _, err := spec.resolve(2); err == nil {
+		t.Error("no error resolving an invalid type id")
+	}
+}
+
+func TestParseBTFInvalid(t *testing.T) {
+	blob := testBTF(binary.LittleEndian, 1)
+	hdrTypeLen := func(data []byte, typeLen uint32) []byte {
+		data = append([]byte(nil), data...)
+		binary.LittleEndian.PutUint32(data[12:16], typeLen)
+		return data
+	}
+
+	// struct outer is the last type, cut in the middle of its members
+	b := newBTFBuilder(binary.LittleEndian)
+	b.composite("outer", btfKindStruct, false, 8, btfTestMember{"pad", 1, 0}, btfTestMember{"z", 1, 32})
+	truncated := b.blob()
+	binary.LittleEndian.PutUint32(truncated[12:16], uint32(len(b.types)-4))
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"short header", blob[:20]},
+		{"bad magic", append([]byte{0, 0}, blob[2:]...)},
+		{"type section out of bounds", hdrTypeLen(blob, uint32(len(blob)))},
+		{"string section out of bounds", blob[:len(blob)-1]},
+		{"members truncated", truncated},
+	} {
+		if _, err := parseBTF(tt.data); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestSetBTFListenOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcptracer-btf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		name        string
+		backlogType uint32
+		wantReady   uint64
+	}{
+		{"u32 backlogs", 1, 1},
+		// reading u32 would mix both counters
+		{"u16 backlog", 2, 0},
+	} {
+		path := filepath.Join(dir, "vmlinux")
+		if err := ioutil.WriteFile(path, testBTF(binary.LittleEndian, tt.backlogType), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var status tcpTracerStatus
+		// the blob has no tcp_sock, the TCP statistics are not found
+		if err := setBTFOffsets(&status, path); err == nil {
+			t.Errorf("%s: no error without struct tcp_sock", tt.name)
+		}
+		if status.ListenReady != tt.wantReady {
+			t.Errorf("%s: ListenReady is %d, want %d", tt.name, status.ListenReady, tt.wantReady)
+		}
+		if status.OffsetAckBacklog != 16 || status.OffsetMaxAckBacklog != 20 {
+			t.Errorf("%s: backlog offsets %d, %d, want 16, 20", tt.name, status.OffsetAckBacklog, status.OffsetMaxAckBacklog)
+		}
+		if status.TCPStatsReady != 0 || status.UnixReady != 0 {
+			t.Errorf("%s: TCP statistics or AF_UNIX sockets ready without their structs", tt.name)
+		}
+	}
+}
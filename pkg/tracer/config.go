@@ -0,0 +1,103 @@
+package tracer
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxBatchSize is the maximum number of events delivered in a single
+// TCPEventsBatch call.
+const maxBatchSize = 256
+
+// Config holds the tunables of a Tracer.
+type Config struct {
+	// QueueSize is the number of events, per address family and for the
+	// AF_UNIX sockets, buffered between the perf ring buffer readers and
+	// the callback.
+	QueueSize int
+	// QueuePolicy decides what happens when the queue is full.
+	QueuePolicy QueuePolicy
+	// Guess configures the guessing of the kernel struct offsets.
+	Guess GuessConfig
+	// StateChanges enables the EventStateChange events, sent for every
+	// TCP state transition. This can be a lot of events on busy hosts.
+	StateChanges bool
+	// UDP enables the tracing of the UDP flows, delivered to the callback,
+	// which must implement UDPCallback. The UDP probes, which run for
+	// every UDP packet sent or received, are only enabled then.
+	UDP bool
+	// UDPIdleTimeout is how long a UDP flow has to be idle before its end
+	// event.
+	UDPIdleTimeout time.Duration
+	// EphemeralPortThreshold is the fraction of ip_local_port_range in use
+	// by the connections towards a destination above which the callback
+	// is notified, if it implements PortUsageCallback. 0 disables the
+	// notifications.
+	EphemeralPortThreshold float64
+	// Aggregate makes the eBPF programs count the events per type,
+	// process, network namespace and remote address and port instead of
+	// sending them, to be read with Tracer.Poll. The UDP flow, SYN
+	// received and listen overflow events are still sent. The ephemeral
+	// port usage is not tracked, and GuessConfig.Verify is not supported.
+	Aggregate bool
+	// SampleRate makes the eBPF programs send the events of 1 in
+	// SampleRate connections, chosen by their SockID so that all the
+	// events of a connection are sent or none. The UDP flow, SYN received
+	// and listen overflow events are not sampled, nor counted in
+	// aggregation mode. The ephemeral port usage only counts the sampled
+	// connections. 0 and 1 send all the events.
+	SampleRate uint16
+	// RateLimit is the number of events per second sent for a process,
+	// with bursts of RateBurst events, after sampling. The AF_UNIX socket
+	// events, which are not sampled, share the limit of their process.
+	// The events above the limit are counted by Tracer.SuppressedEvents.
+	// 0 disables the limit.
+	RateLimit uint32
+	// RateBurst defaults to RateLimit. It requires RateLimit.
+	RateBurst uint32
+}
+
+// validate returns an error if cfg can't be used with cb.
+func (cfg Config) validate(cb BatchCallback) error {
+	if cfg.UDP {
+		if _, ok := underlyingCallback(cb).(UDPCallback); !ok {
+			return fmt.Errorf("tracing UDP flows requires a callback implementing UDPCallback")
+		}
+	}
+	if cfg.Aggregate && cfg.Guess.Verify {
+		return fmt.Errorf("the verification of the offsets is not supported in aggregation mode")
+	}
+	if cfg.RateBurst > 0 && cfg.RateLimit == 0 {
+		return fmt.Errorf("RateBurst requires RateLimit")
+	}
+	if cfg.EphemeralPortThreshold < 0 || cfg.EphemeralPortThreshold > 1 {
+		return fmt.Errorf("EphemeralPortThreshold %v is not between 0 and 1", cfg.EphemeralPortThreshold)
+	}
+	return nil
+}
+
+// DefaultConfig returns the configuration used by NewTracer.
+func DefaultConfig() Config {
+	return Config{
+		QueueSize:      4096,
+		QueuePolicy:    QueueBlock,
+		Guess:          DefaultGuessConfig(),
+		UDPIdleTimeout: 30 * time.Second,
+	}
+}
+
+// QueueStats tells apart events lost in the kernel, because the perf ring
+// buffers were full, from events dropped in userspace by the QueuePolicy.
+// Events too short to be decoded are counted as invalid. The AF_UNIX socket
+// events have their own queue, with the same size and policy.
+type QueueStats struct {
+	KernelLostV4   uint64
+	KernelLostV6   uint64
+	KernelLostUnix uint64
+	DroppedV4      uint64
+	DroppedV6      uint64
+	DroppedUnix    uint64
+	InvalidV4      uint64
+	InvalidV6      uint64
+	InvalidUnix    uint64
+}
@@ -0,0 +1,37 @@
+package tracer
+
+import "testing"
+
+type tcpOnlyCallback struct{}
+
+func (tcpOnlyCallback) TCPEventV4(TcpV4) {}
+func (tcpOnlyCallback) TCPEventV6(TcpV6) {}
+func (tcpOnlyCallback) LostV4(uint64)    {}
+func (tcpOnlyCallback) LostV6(uint64)    {}
+
+func TestConfigValidate(t *testing.T) {
+	verify := DefaultConfig()
+	verify.Guess.Verify = true
+
+	for _, tt := range []struct {
+		name    string
+		cfg     Config
+		cb      BatchCallback
+		wantErr bool
+	}{
+		{name: "defaults", cfg: DefaultConfig(), cb: &recorder{}},
+		{name: "UDP", cfg: Config{UDP: true}, cb: &recorder{}},
+		{name: "UDP without UDPCallback", cfg: Config{UDP: true}, cb: callbackAdapter{tcpOnlyCallback{}}, wantErr: true},
+		{name: "verify", cfg: verify, cb: &recorder{}},
+		{name: "verify in aggregation mode", cfg: Config{Aggregate: true, Guess: verify.Guess}, cb: &recorder{}, wantErr: true},
+		{name: "rate limit", cfg: Config{RateLimit: 10, RateBurst: 20}, cb: &recorder{}},
+		{name: "burst without limit", cfg: Config{RateBurst: 20}, cb: &recorder{}, wantErr: true},
+		{name: "port threshold", cfg: Config{EphemeralPortThreshold: 0.8}, cb: &recorder{}},
+		{name: "negative port threshold", cfg: Config{EphemeralPortThreshold: -0.1}, cb: &recorder{}, wantErr: true},
+		{name: "port threshold above 1", cfg: Config{EphemeralPortThreshold: 80}, cb: &recorder{}, wantErr: true},
+	} {
+		if err := tt.cfg.validate(tt.cb); (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
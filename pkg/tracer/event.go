@@ -1,76 +1,322 @@
 package tracer
 
 import (
-	"encoding/binary"
-	"net"
-	"unsafe"
+	"bytes"
+	"container/list"
+	"fmt"
+	"time"
 )
 
-/*
-#include "../../tcptracer-bpf.h"
-*/
-import "C"
+// Sizes of struct tcp_ipv4_event_t and struct tcp_ipv6_event_t
+const (
+	tcpIPv4EventSize = 136
+	tcpIPv6EventSize = 160
+)
 
-func tcpV4ToGo(data *[]byte) (ret TcpV4) {
-	eventC := (*C.struct_tcp_ipv4_event_t)(unsafe.Pointer(&(*data)[0]))
+// sockInfo mirrors the layout of struct sock_info_t in tcptracer-bpf.h.
+type sockInfo struct {
+	SockID   uint64
+	Ino      uint64
+	UID      uint32
+	Mark     uint32
+	IfIndex  uint32
+	State    uint8
+	OldState uint8
+	_        [2]byte
+}
 
-	ret.Timestamp = uint64(eventC.timestamp)
-	ret.CPU = uint64(eventC.cpu)
-	ret.Type = EventType(eventC._type)
-	ret.Pid = uint32(eventC.pid & 0xffffffff)
-	ret.Comm = C.GoString(&eventC.comm[0])
+func (i *sockInfo) unmarshal(data []byte) {
+	i.SockID = nativeEndian.Uint64(data[0:8])
+	i.Ino = nativeEndian.Uint64(data[8:16])
+	i.UID = nativeEndian.Uint32(data[16:20])
+	i.Mark = nativeEndian.Uint32(data[20:24])
+	i.IfIndex = nativeEndian.Uint32(data[24:28])
+	i.State = data[28]
+	i.OldState = data[29]
+}
 
-	saddrbuf := make([]byte, 4)
-	daddrbuf := make([]byte, 4)
+// tcpStats mirrors the layout of struct tcp_stats_t in tcptracer-bpf.h.
+type tcpStats struct {
+	SrttUs       uint32
+	MdevUs       uint32
+	TotalRetrans uint32
+	SndCwnd      uint32
+	CAName       [16]byte
+}
 
-	binary.LittleEndian.PutUint32(saddrbuf, uint32(eventC.saddr))
-	binary.LittleEndian.PutUint32(daddrbuf, uint32(eventC.daddr))
+func (t *tcpStats) unmarshal(data []byte) {
+	t.SrttUs = nativeEndian.Uint32(data[0:4])
+	t.MdevUs = nativeEndian.Uint32(data[4:8])
+	t.TotalRetrans = nativeEndian.Uint32(data[8:12])
+	t.SndCwnd = nativeEndian.Uint32(data[12:16])
+	copy(t.CAName[:], data[16:32])
+}
 
-	ret.SAddr = net.IPv4(saddrbuf[0], saddrbuf[1], saddrbuf[2], saddrbuf[3])
-	ret.DAddr = net.IPv4(daddrbuf[0], daddrbuf[1], daddrbuf[2], daddrbuf[3])
+// tcpIPv4Event mirrors the layout of struct tcp_ipv4_event_t in
+// tcptracer-bpf.h. Addresses are kept as raw bytes since the kernel stores
+// them in network byte order.
+type tcpIPv4Event struct {
+	Timestamp   uint64
+	CPU         uint64
+	Type        uint32
+	Pid         uint32
+	Comm        [16]byte
+	SAddr       [4]byte
+	DAddr       [4]byte
+	SPort       uint16
+	DPort       uint16
+	NetNS       uint32
+	Fd          uint32
+	CloseReason uint8
+	Shutdown    uint8
+	SampleRate  uint16
+	Info        sockInfo
+	Latency     uint64
+	TCP         tcpStats
+}
 
-	ret.SPort = uint16(eventC.sport)
-	ret.DPort = uint16(eventC.dport)
-	ret.NetNS = uint32(eventC.netns)
-	ret.Fd = uint32(eventC.fd)
+// tcpIPv6Event mirrors the layout of struct tcp_ipv6_event_t in
+// tcptracer-bpf.h. The saddr_h/saddr_l and daddr_h/daddr_l pairs are read as
+// a single 16 bytes address each.
+type tcpIPv6Event struct {
+	Timestamp   uint64
+	CPU         uint64
+	Type        uint32
+	Pid         uint32
+	Comm        [16]byte
+	SAddr       [16]byte
+	DAddr       [16]byte
+	SPort       uint16
+	DPort       uint16
+	NetNS       uint32
+	Fd          uint32
+	CloseReason uint8
+	Shutdown    uint8
+	SampleRate  uint16
+	Info        sockInfo
+	Latency     uint64
+	TCP         tcpStats
+}
 
-	return
+// unmarshal decodes data without going through reflection so that it
+// doesn't allocate.
+func (e *tcpIPv4Event) unmarshal(data []byte) error {
+	if len(data) < tcpIPv4EventSize {
+		return fmt.Errorf("tcp_ipv4_event_t too short: %d bytes", len(data))
+	}
+	e.Timestamp = nativeEndian.Uint64(data[0:8])
+	e.CPU = nativeEndian.Uint64(data[8:16])
+	e.Type = nativeEndian.Uint32(data[16:20])
+	e.Pid = nativeEndian.Uint32(data[20:24])
+	copy(e.Comm[:], data[24:40])
+	copy(e.SAddr[:], data[40:44])
+	copy(e.DAddr[:], data[44:48])
+	e.SPort = nativeEndian.Uint16(data[48:50])
+	e.DPort = nativeEndian.Uint16(data[50:52])
+	e.NetNS = nativeEndian.Uint32(data[52:56])
+	e.Fd = nativeEndian.Uint32(data[56:60])
+	e.CloseReason = data[60]
+	e.Shutdown = data[61]
+	e.SampleRate = nativeEndian.Uint16(data[62:64])
+	e.Info.unmarshal(data[64:96])
+	e.Latency = nativeEndian.Uint64(data[96:104])
+	e.TCP.unmarshal(data[104:136])
+	return nil
 }
 
-func tcpV4Timestamp(data *[]byte) uint64 {
-	eventC := (*C.struct_tcp_ipv4_event_t)(unsafe.Pointer(&(*data)[0]))
-	return uint64(eventC.timestamp)
+// unmarshal decodes data without going through reflection so that it
+// doesn't allocate.
+func (e *tcpIPv6Event) unmarshal(data []byte) error {
+	if len(data) < tcpIPv6EventSize {
+		return fmt.Errorf("tcp_ipv6_event_t too short: %d bytes", len(data))
+	}
+	e.Timestamp = nativeEndian.Uint64(data[0:8])
+	e.CPU = nativeEndian.Uint64(data[8:16])
+	e.Type = nativeEndian.Uint32(data[16:20])
+	e.Pid = nativeEndian.Uint32(data[20:24])
+	copy(e.Comm[:], data[24:40])
+	copy(e.SAddr[:], data[40:56])
+	copy(e.DAddr[:], data[56:72])
+	e.SPort = nativeEndian.Uint16(data[72:74])
+	e.DPort = nativeEndian.Uint16(data[74:76])
+	e.NetNS = nativeEndian.Uint32(data[76:80])
+	e.Fd = nativeEndian.Uint32(data[80:84])
+	e.CloseReason = data[84]
+	e.Shutdown = data[85]
+	e.SampleRate = nativeEndian.Uint16(data[86:88])
+	e.Info.unmarshal(data[88:120])
+	e.Latency = nativeEndian.Uint64(data[120:128])
+	e.TCP.unmarshal(data[128:160])
+	return nil
+}
+
+// commToString converts a NUL terminated comm buffer to a string, like
+// C.GoString would.
+func commToString(comm []byte) string {
+	if i := bytes.IndexByte(comm, 0); i >= 0 {
+		comm = comm[:i]
+	}
+	return string(comm)
+}
+
+// maxInternedComms bounds the number of comm strings kept by a
+// commInterner. The least recently used one is evicted when it is full.
+const maxInternedComms = 4096
+
+// commInterner returns the same string for identical comm buffers, so that
+// only the first event of a given process allocates its comm.
+type commInterner struct {
+	comms map[[16]byte]*list.Element
+	// lru holds the *internedComm, the most recently used first
+	lru list.List
+}
+
+type internedComm struct {
+	comm [16]byte
+	s    string
+}
+
+func (c *commInterner) intern(comm [16]byte) string {
+	if elem, ok := c.comms[comm]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*internedComm).s
+	}
+	if c.comms == nil {
+		c.comms = make(map[[16]byte]*list.Element)
+	}
+	if len(c.comms) >= maxInternedComms {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.comms, oldest.Value.(*internedComm).comm)
+	}
+	s := commToString(comm[:])
+	c.comms[comm] = c.lru.PushFront(&internedComm{comm: comm, s: s})
+	return s
 }
 
-func tcpV6ToGo(data *[]byte) (ret TcpV6) {
-	eventC := (*C.struct_tcp_ipv6_event_t)(unsafe.Pointer(&(*data)[0]))
+// eventDecoder decodes raw perf events into a reusable batch of Event.
+type eventDecoder struct {
+	comms   commInterner
+	caNames commInterner
+	events  []Event
+	v4      tcpIPv4Event
+	v6      tcpIPv6Event
+}
 
-	ret.Timestamp = uint64(eventC.timestamp)
-	ret.CPU = uint64(eventC.cpu)
-	ret.Type = EventType(eventC._type)
-	ret.Pid = uint32(eventC.pid & 0xffffffff)
-	ret.Comm = C.GoString(&eventC.comm[0])
+func newEventDecoder(size int) *eventDecoder {
+	return &eventDecoder{
+		events: make([]Event, 0, size),
+	}
+}
 
-	saddrbuf := make([]byte, 16)
-	daddrbuf := make([]byte, 16)
+// reset empties the batch. Events returned previously must not be used
+// anymore.
+func (d *eventDecoder) reset() {
+	d.events = d.events[:0]
+}
 
-	binary.LittleEndian.PutUint64(saddrbuf, uint64(eventC.saddr_h))
-	binary.LittleEndian.PutUint64(saddrbuf[8:], uint64(eventC.saddr_l))
-	binary.LittleEndian.PutUint64(daddrbuf, uint64(eventC.daddr_h))
-	binary.LittleEndian.PutUint64(daddrbuf[8:], uint64(eventC.daddr_l))
+// appendV4 decodes a tcp_ipv4_event_t and adds it to the batch.
+func (d *eventDecoder) appendV4(data []byte) error {
+	if err := d.v4.unmarshal(data); err != nil {
+		return err
+	}
+	d.events = append(d.events, Event{})
+	e := &d.events[len(d.events)-1]
 
-	ret.SAddr = net.IP(saddrbuf)
-	ret.DAddr = net.IP(daddrbuf)
+	e.Timestamp = d.v4.Timestamp
+	e.CPU = d.v4.CPU
+	e.Type = EventType(d.v4.Type)
+	e.Pid = d.v4.Pid
+	e.Comm = d.comms.intern(d.v4.Comm)
 
-	ret.SPort = uint16(eventC.sport)
-	ret.DPort = uint16(eventC.dport)
-	ret.NetNS = uint32(eventC.netns)
-	ret.Fd = uint32(eventC.fd)
+	e.SAddr = ipv4MappedPrefix
+	copy(e.SAddr[12:], d.v4.SAddr[:])
+	e.DAddr = ipv4MappedPrefix
+	copy(e.DAddr[12:], d.v4.DAddr[:])
 
-	return
+	e.SPort = d.v4.SPort
+	e.DPort = d.v4.DPort
+	e.NetNS = d.v4.NetNS
+	e.Fd = d.v4.Fd
+	e.CloseReason = CloseReason(d.v4.CloseReason)
+	e.Shutdown = ShutdownDirection(d.v4.Shutdown)
+	e.SampleRate = d.v4.SampleRate
+	e.setSockInfo(&d.v4.Info)
+	e.setLatency(d.v4.Latency)
+	d.setTCPStats(e, &d.v4.TCP)
+	return nil
+}
+
+// appendV6 decodes a tcp_ipv6_event_t and adds it to the batch.
+func (d *eventDecoder) appendV6(data []byte) error {
+	if err := d.v6.unmarshal(data); err != nil {
+		return err
+	}
+	d.events = append(d.events, Event{})
+	e := &d.events[len(d.events)-1]
+
+	e.Timestamp = d.v6.Timestamp
+	e.CPU = d.v6.CPU
+	e.Type = EventType(d.v6.Type)
+	e.Pid = d.v6.Pid
+	e.Comm = d.comms.intern(d.v6.Comm)
+	e.IPv6 = true
+
+	e.SAddr = d.v6.SAddr
+	e.DAddr = d.v6.DAddr
+
+	e.SPort = d.v6.SPort
+	e.DPort = d.v6.DPort
+	e.NetNS = d.v6.NetNS
+	e.Fd = d.v6.Fd
+	e.CloseReason = CloseReason(d.v6.CloseReason)
+	e.Shutdown = ShutdownDirection(d.v6.Shutdown)
+	e.SampleRate = d.v6.SampleRate
+	e.setSockInfo(&d.v6.Info)
+	e.setLatency(d.v6.Latency)
+	d.setTCPStats(e, &d.v6.TCP)
+	return nil
+}
+
+func tcpV4Timestamp(data *[]byte) uint64 {
+	if len(*data) < 8 {
+		return 0
+	}
+	return nativeEndian.Uint64((*data)[0:8])
 }
 
 func tcpV6Timestamp(data *[]byte) uint64 {
-	eventC := (*C.struct_tcp_ipv6_event_t)(unsafe.Pointer(&(*data)[0]))
-	return uint64(eventC.timestamp)
+	if len(*data) < 8 {
+		return 0
+	}
+	return nativeEndian.Uint64((*data)[0:8])
+}
+
+func (e *Event) setSockInfo(i *sockInfo) {
+	e.SockID = i.SockID
+	e.Ino = i.Ino
+	e.UID = i.UID
+	e.Mark = i.Mark
+	e.IfIndex = i.IfIndex
+	e.State = TCPState(i.State)
+	e.OldState = TCPState(i.OldState)
+}
+
+// setLatency sets the latency field matching the event type.
+func (e *Event) setLatency(ns uint64) {
+	switch e.Type {
+	case EventConnect:
+		e.ConnectLatency = time.Duration(ns)
+	case EventAccept:
+		e.AcceptQueueLatency = time.Duration(ns)
+	}
+}
+
+// setTCPStats sets the TCP statistics, as reported by TCP_INFO.
+func (d *eventDecoder) setTCPStats(e *Event, t *tcpStats) {
+	e.SRTT = time.Duration(t.SrttUs>>3) * time.Microsecond
+	e.RTTVar = time.Duration(t.MdevUs>>2) * time.Microsecond
+	e.Retransmits = t.TotalRetrans
+	e.SndCwnd = t.SndCwnd
+	e.CongestionAlgorithm = d.caNames.intern(t.CAName)
 }
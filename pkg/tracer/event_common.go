@@ -2,6 +2,7 @@ package tracer
 
 import (
 	"net"
+	"time"
 )
 
 type EventType uint32
@@ -12,6 +13,37 @@ const (
 	EventAccept              = 2
 	EventClose               = 3
 	EventFdInstall           = 4
+
+	// EventResetSent and EventResetReceived are sent when a connection is
+	// aborted with a reset, in addition to its close event. Their State is
+	// the state of the socket when the reset was sent or received.
+	EventResetSent     = 5
+	EventResetReceived = 6
+
+	// EventStateChange is sent for every TCP state transition when enabled
+	// with Config.StateChanges. OldState and State are the states before
+	// and after the transition. The tuple is incomplete until connect()
+	// has picked the source port, and for listening sockets.
+	EventStateChange = 7
+
+	// EventShutdown is sent when shutdown() is called on a connection,
+	// with the directions that are shut down.
+	EventShutdown = 8
+
+	// EventBind is sent when bind() is called explicitly on a socket, with
+	// the local address and port it is bound to. The remote address and
+	// port are zero.
+	EventBind = 11
+
+	// EventListenOverflow is sent when a SYN, or the ACK completing a
+	// handshake, is dropped because the accept queue of a listening
+	// socket is full. EventSynRecv is sent when a listening socket
+	// receives SYNs. They are sent at most once per second and listening
+	// socket, the counters are read with Tracer.ListenerStats. Their
+	// remote address and port are zero, and their Pid is the one of the
+	// process interrupted to handle the packet.
+	EventListenOverflow = 12
+	EventSynRecv        = 13
 )
 
 func (e EventType) String() string {
@@ -24,6 +56,133 @@ func (e EventType) String() string {
 		return "close"
 	case EventFdInstall:
 		return "fdinstall"
+	case EventResetSent:
+		return "resetsent"
+	case EventResetReceived:
+		return "resetreceived"
+	case EventStateChange:
+		return "statechange"
+	case EventShutdown:
+		return "shutdown"
+	case EventBind:
+		return "bind"
+	case EventListenOverflow:
+		return "listenoverflow"
+	case EventSynRecv:
+		return "synrecv"
+	default:
+		return "unknown"
+	}
+}
+
+// CloseReason is why a connection was closed, as found from its TCP state
+// transitions.
+type CloseReason uint8
+
+// These constants should be in sync with the equivalent definitions in the ebpf program.
+const (
+	CloseUnknown CloseReason = 0
+	// CloseActive is a graceful close, where this side sent the first FIN.
+	CloseActive = 1
+	// ClosePassive is a graceful close, where the peer sent the first FIN.
+	ClosePassive = 2
+	// CloseReset is a reset received from the peer.
+	CloseReset = 3
+	// CloseAbort is a connection closed without FIN nor reset received:
+	// a retransmission or keepalive timeout, or a reset sent because the
+	// socket was disconnected or destroyed before close(). A close() with
+	// unread data or a zero SO_LINGER timeout is reported as CloseActive,
+	// followed by an EventResetSent.
+	CloseAbort = 4
+	// CloseHandshakeFailed is a connection closed before being
+	// established, e.g. refused or timed out.
+	CloseHandshakeFailed = 5
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseActive:
+		return "active"
+	case ClosePassive:
+		return "passive"
+	case CloseReset:
+		return "reset"
+	case CloseAbort:
+		return "abort"
+	case CloseHandshakeFailed:
+		return "handshake_failed"
+	default:
+		return "unknown"
+	}
+}
+
+// ShutdownDirection is the direction of a connection passed to shutdown(),
+// as the RCV_SHUTDOWN and SEND_SHUTDOWN flags of include/net/sock.h.
+type ShutdownDirection uint8
+
+const (
+	ShutdownRead  ShutdownDirection = 1
+	ShutdownWrite                   = 2
+	ShutdownBoth                    = ShutdownRead | ShutdownWrite
+)
+
+func (d ShutdownDirection) String() string {
+	switch d {
+	case ShutdownRead:
+		return "read"
+	case ShutdownWrite:
+		return "write"
+	case ShutdownBoth:
+		return "both"
+	default:
+		return "none"
+	}
+}
+
+// TCPState is the state of a TCP socket, as in include/net/tcp_states.h.
+type TCPState uint8
+
+const (
+	TCPEstablished TCPState = 1
+	TCPSynSent              = 2
+	TCPSynRecv              = 3
+	TCPFinWait1             = 4
+	TCPFinWait2             = 5
+	TCPTimeWait             = 6
+	TCPClose                = 7
+	TCPCloseWait            = 8
+	TCPLastAck              = 9
+	TCPListen               = 10
+	TCPClosing              = 11
+	TCPNewSynRecv           = 12
+)
+
+func (s TCPState) String() string {
+	switch s {
+	case TCPEstablished:
+		return "ESTABLISHED"
+	case TCPSynSent:
+		return "SYN_SENT"
+	case TCPSynRecv:
+		return "SYN_RECV"
+	case TCPFinWait1:
+		return "FIN_WAIT1"
+	case TCPFinWait2:
+		return "FIN_WAIT2"
+	case TCPTimeWait:
+		return "TIME_WAIT"
+	case TCPClose:
+		return "CLOSE"
+	case TCPCloseWait:
+		return "CLOSE_WAIT"
+	case TCPLastAck:
+		return "LAST_ACK"
+	case TCPListen:
+		return "LISTEN"
+	case TCPClosing:
+		return "CLOSING"
+	case TCPNewSynRecv:
+		return "NEW_SYN_RECV"
 	default:
 		return "unknown"
 	}
@@ -42,6 +201,28 @@ type TcpV4 struct {
 	DPort     uint16    // Remote TCP port
 	NetNS     uint32    // Network namespace ID (as in /proc/$pid/ns/net)
 	Fd        uint32    // File descriptor for fd_install events
+	SockID    uint64    // Identifier of the socket, unique while it exists
+	Ino       uint64    // Inode of the socket (as in /proc/$pid/fd/: socket:[$ino])
+	UID       uint32    // Owner of the socket
+	Mark      uint32    // Socket mark (SO_MARK)
+	IfIndex   uint32    // Interface the socket is bound to (SO_BINDTODEVICE), or 0
+	State     TCPState  // TCP state, when the event was generated
+	OldState  TCPState  // TCP state before the transition, for state change and connect events
+
+	CloseReason CloseReason       // Why the connection was closed, for close events
+	Shutdown    ShutdownDirection // Directions shut down, for shutdown events
+	SampleRate  uint16            // Events are sent for 1 in SampleRate connections
+
+	ConnectLatency     time.Duration // Time from connect() to the established connection, for connect events
+	AcceptQueueLatency time.Duration // Time spent in the accept queue, for accept events
+
+	// TCP statistics for close events, as reported by TCP_INFO. They are
+	// only available if the kernel exposes its BTF type information.
+	SRTT                time.Duration // Smoothed round trip time
+	RTTVar              time.Duration // Round trip time variation
+	Retransmits         uint32        // Total retransmitted segments
+	SndCwnd             uint32        // Congestion window, in segments
+	CongestionAlgorithm string        // Congestion control algorithm, e.g. "cubic"
 }
 
 // TcpV6 represents a TCP event (connect, accept or close) on IPv6
@@ -57,4 +238,291 @@ type TcpV6 struct {
 	DPort     uint16    // Remote TCP port
 	NetNS     uint32    // Network namespace ID (as in /proc/$pid/ns/net)
 	Fd        uint32    // File descriptor for fd_install events
+	SockID    uint64    // Identifier of the socket, unique while it exists
+	Ino       uint64    // Inode of the socket (as in /proc/$pid/fd/: socket:[$ino])
+	UID       uint32    // Owner of the socket
+	Mark      uint32    // Socket mark (SO_MARK)
+	IfIndex   uint32    // Interface the socket is bound to (SO_BINDTODEVICE), or 0
+	State     TCPState  // TCP state, when the event was generated
+	OldState  TCPState  // TCP state before the transition, for state change and connect events
+
+	CloseReason CloseReason       // Why the connection was closed, for close events
+	Shutdown    ShutdownDirection // Directions shut down, for shutdown events
+	SampleRate  uint16            // Events are sent for 1 in SampleRate connections
+
+	ConnectLatency     time.Duration // Time from connect() to the established connection, for connect events
+	AcceptQueueLatency time.Duration // Time spent in the accept queue, for accept events
+
+	// TCP statistics for close events, as reported by TCP_INFO. They are
+	// only available if the kernel exposes its BTF type information.
+	SRTT                time.Duration // Smoothed round trip time
+	RTTVar              time.Duration // Round trip time variation
+	Retransmits         uint32        // Total retransmitted segments
+	SndCwnd             uint32        // Congestion window, in segments
+	CongestionAlgorithm string        // Congestion control algorithm, e.g. "cubic"
+}
+
+// Aggregate is the number of events of a type sent for the connections of a
+// process towards a remote address and port, counted by the eBPF programs
+// in aggregation mode (see Config.Aggregate).
+type Aggregate struct {
+	Type  EventType // Type of the events
+	Pid   uint32    // Process ID, who triggered the events
+	NetNS uint32    // Network namespace ID (as in /proc/$pid/ns/net)
+	DAddr net.IP    // Remote IP address
+	DPort uint16    // Remote TCP port
+	Count uint64    // Number of events since the previous Poll
+}
+
+// ipv4MappedPrefix is the ::ffff:0:0/96 prefix used to store IPv4 addresses
+// in Event.
+var ipv4MappedPrefix = [16]byte{10: 0xff, 11: 0xff}
+
+// Event represents a TCP event on IPv4 or IPv6 as delivered to a
+// BatchCallback. Addresses are stored in fixed-size arrays, IPv4 addresses
+// being stored as IPv4-mapped IPv6 addresses, so decoding an event does not
+// allocate.
+type Event struct {
+	Timestamp uint64    // Monotonic timestamp
+	CPU       uint64    // CPU index
+	Type      EventType // connect, accept or close
+	Pid       uint32    // Process ID, who triggered the event
+	Comm      string    // The process command (as in /proc/$pid/comm)
+	IPv6      bool      // Whether the event comes from an IPv6 socket
+	SAddr     [16]byte  // Local IP address
+	DAddr     [16]byte  // Remote IP address
+	SPort     uint16    // Local TCP port
+	DPort     uint16    // Remote TCP port
+	NetNS     uint32    // Network namespace ID (as in /proc/$pid/ns/net)
+	Fd        uint32    // File descriptor for fd_install events
+	SockID    uint64    // Identifier of the socket, unique while it exists
+	Ino       uint64    // Inode of the socket (as in /proc/$pid/fd/: socket:[$ino])
+	UID       uint32    // Owner of the socket
+	Mark      uint32    // Socket mark (SO_MARK)
+	IfIndex   uint32    // Interface the socket is bound to (SO_BINDTODEVICE), or 0
+	State     TCPState  // TCP state, when the event was generated
+	OldState  TCPState  // TCP state before the transition, for state change and connect events
+
+	CloseReason CloseReason       // Why the connection was closed, for close events
+	Shutdown    ShutdownDirection // Directions shut down, for shutdown events
+	SampleRate  uint16            // Events are sent for 1 in SampleRate connections
+
+	ConnectLatency     time.Duration // Time from connect() to the established connection, for connect events
+	AcceptQueueLatency time.Duration // Time spent in the accept queue, for accept events
+
+	// TCP statistics for close events, as reported by TCP_INFO. They are
+	// only available if the kernel exposes its BTF type information.
+	SRTT                time.Duration // Smoothed round trip time
+	RTTVar              time.Duration // Round trip time variation
+	Retransmits         uint32        // Total retransmitted segments
+	SndCwnd             uint32        // Congestion window, in segments
+	CongestionAlgorithm string        // Congestion control algorithm, e.g. "cubic"
+}
+
+// SourceIP returns the local IP address. The returned slice points into the
+// event and must be copied if it is retained.
+func (e *Event) SourceIP() net.IP {
+	return net.IP(e.SAddr[:])
+}
+
+// DestIP returns the remote IP address. The returned slice points into the
+// event and must be copied if it is retained.
+func (e *Event) DestIP() net.IP {
+	return net.IP(e.DAddr[:])
+}
+
+func (e *Event) tcpV4() TcpV4 {
+	return TcpV4{
+		Timestamp: e.Timestamp,
+		CPU:       e.CPU,
+		Type:      e.Type,
+		Pid:       e.Pid,
+		Comm:      e.Comm,
+		SAddr:     net.IPv4(e.SAddr[12], e.SAddr[13], e.SAddr[14], e.SAddr[15]),
+		DAddr:     net.IPv4(e.DAddr[12], e.DAddr[13], e.DAddr[14], e.DAddr[15]),
+		SPort:     e.SPort,
+		DPort:     e.DPort,
+		NetNS:     e.NetNS,
+		Fd:        e.Fd,
+		SockID:    e.SockID,
+		Ino:       e.Ino,
+		UID:       e.UID,
+		Mark:      e.Mark,
+		IfIndex:   e.IfIndex,
+		State:     e.State,
+		OldState:  e.OldState,
+
+		CloseReason: e.CloseReason,
+		Shutdown:    e.Shutdown,
+		SampleRate:  e.SampleRate,
+
+		ConnectLatency:     e.ConnectLatency,
+		AcceptQueueLatency: e.AcceptQueueLatency,
+
+		SRTT:                e.SRTT,
+		RTTVar:              e.RTTVar,
+		Retransmits:         e.Retransmits,
+		SndCwnd:             e.SndCwnd,
+		CongestionAlgorithm: e.CongestionAlgorithm,
+	}
+}
+
+func (e *Event) tcpV6() TcpV6 {
+	saddr := make(net.IP, 16)
+	daddr := make(net.IP, 16)
+	copy(saddr, e.SAddr[:])
+	copy(daddr, e.DAddr[:])
+
+	return TcpV6{
+		Timestamp: e.Timestamp,
+		CPU:       e.CPU,
+		Type:      e.Type,
+		Pid:       e.Pid,
+		Comm:      e.Comm,
+		SAddr:     saddr,
+		DAddr:     daddr,
+		SPort:     e.SPort,
+		DPort:     e.DPort,
+		NetNS:     e.NetNS,
+		Fd:        e.Fd,
+		SockID:    e.SockID,
+		Ino:       e.Ino,
+		UID:       e.UID,
+		Mark:      e.Mark,
+		IfIndex:   e.IfIndex,
+		State:     e.State,
+		OldState:  e.OldState,
+
+		CloseReason: e.CloseReason,
+		Shutdown:    e.Shutdown,
+		SampleRate:  e.SampleRate,
+
+		ConnectLatency:     e.ConnectLatency,
+		AcceptQueueLatency: e.AcceptQueueLatency,
+
+		SRTT:                e.SRTT,
+		RTTVar:              e.RTTVar,
+		Retransmits:         e.Retransmits,
+		SndCwnd:             e.SndCwnd,
+		CongestionAlgorithm: e.CongestionAlgorithm,
+	}
+}
+
+// UDPEventType is the kind of a UDP flow event.
+type UDPEventType uint32
+
+const (
+	// UDPFlowStart is sent for the first packet seen of a flow.
+	UDPFlowStart UDPEventType = 1
+	// UDPFlowEnd is sent once a flow has been idle for
+	// Config.UDPIdleTimeout.
+	UDPFlowEnd = 2
+)
+
+func (t UDPEventType) String() string {
+	switch t {
+	case UDPFlowStart:
+		return "start"
+	case UDPFlowEnd:
+		return "end"
+	default:
+		return "unknown"
+	}
+}
+
+// UdpV4 represents a UDP flow event on IPv4. A flow is identified by its
+// tuple and network namespace, both directions included.
+type UdpV4 struct {
+	Timestamp uint64       // Monotonic timestamp of the first packet, or of the last one reported for end events
+	CPU       uint64       // CPU index
+	Type      UDPEventType // start or end
+	Pid       uint32       // Process ID, who sent or received the first packet
+	Comm      string       // The process command (as in /proc/$pid/comm)
+	SAddr     net.IP       // Local IP address, unspecified for sockets bound to any address
+	DAddr     net.IP       // Remote IP address
+	SPort     uint16       // Local UDP port
+	DPort     uint16       // Remote UDP port
+	NetNS     uint32       // Network namespace ID (as in /proc/$pid/ns/net)
+	SockID    uint64       // Identifier of the socket, unique while it exists
+	Ino       uint64       // Inode of the socket (as in /proc/$pid/fd/: socket:[$ino])
+	UID       uint32       // Owner of the socket
+	Outbound  bool         // Whether the first packet was sent rather than received
+}
+
+// UdpV6 represents a UDP flow event on IPv6. A flow is identified by its
+// tuple and network namespace, both directions included.
+type UdpV6 struct {
+	Timestamp uint64       // Monotonic timestamp of the first packet, or of the last one reported for end events
+	CPU       uint64       // CPU index
+	Type      UDPEventType // start or end
+	Pid       uint32       // Process ID, who sent or received the first packet
+	Comm      string       // The process command (as in /proc/$pid/comm)
+	SAddr     net.IP       // Local IP address, unspecified for sockets bound to any address
+	DAddr     net.IP       // Remote IP address
+	SPort     uint16       // Local UDP port
+	DPort     uint16       // Remote UDP port
+	NetNS     uint32       // Network namespace ID (as in /proc/$pid/ns/net)
+	SockID    uint64       // Identifier of the socket, unique while it exists
+	Ino       uint64       // Inode of the socket (as in /proc/$pid/fd/: socket:[$ino])
+	UID       uint32       // Owner of the socket
+	Outbound  bool         // Whether the first packet was sent rather than received
+}
+
+func (e *Event) udpV4(typ UDPEventType) UdpV4 {
+	return UdpV4{
+		Timestamp: e.Timestamp,
+		CPU:       e.CPU,
+		Type:      typ,
+		Pid:       e.Pid,
+		Comm:      e.Comm,
+		SAddr:     net.IPv4(e.SAddr[12], e.SAddr[13], e.SAddr[14], e.SAddr[15]),
+		DAddr:     net.IPv4(e.DAddr[12], e.DAddr[13], e.DAddr[14], e.DAddr[15]),
+		SPort:     e.SPort,
+		DPort:     e.DPort,
+		NetNS:     e.NetNS,
+		SockID:    e.SockID,
+		Ino:       e.Ino,
+		UID:       e.UID,
+		Outbound:  e.Type == eventUDPSend,
+	}
+}
+
+func (e *Event) udpV6(typ UDPEventType) UdpV6 {
+	saddr := make(net.IP, 16)
+	daddr := make(net.IP, 16)
+	copy(saddr, e.SAddr[:])
+	copy(daddr, e.DAddr[:])
+
+	return UdpV6{
+		Timestamp: e.Timestamp,
+		CPU:       e.CPU,
+		Type:      typ,
+		Pid:       e.Pid,
+		Comm:      e.Comm,
+		SAddr:     saddr,
+		DAddr:     daddr,
+		SPort:     e.SPort,
+		DPort:     e.DPort,
+		NetNS:     e.NetNS,
+		SockID:    e.SockID,
+		Ino:       e.Ino,
+		UID:       e.UID,
+		Outbound:  e.Type == eventUDPSend,
+	}
+}
+
+// UnixEvent represents a connect, accept or close event of an AF_UNIX stream
+// socket.
+type UnixEvent struct {
+	Timestamp uint64    // Monotonic timestamp
+	CPU       uint64    // CPU index
+	Type      EventType // connect, accept or close
+	Pid       uint32    // Process ID, who triggered the event
+	Comm      string    // The process command (as in /proc/$pid/comm)
+	PeerPid   uint32    // Process ID of the peer: who connected, or who called listen() for connected sockets
+	PeerComm  string    // The peer process command, read when connecting or accepting, empty if it exited
+	Path      string    // Path of the socket, or its abstract name prefixed with "@"
+	NetNS     uint32    // Network namespace ID (as in /proc/$pid/ns/net)
+	SockID    uint64    // Identifier of the socket, unique while it exists
+	Ino       uint64    // Inode of the socket (as in /proc/$pid/fd/: socket:[$ino])
 }
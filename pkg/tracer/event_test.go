@@ -0,0 +1,401 @@
+// +build linux
+
+package tracer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The blobs below are events and status as written by the eBPF program on a
+// little endian machine, one line per field of the C struct.
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func skipIfBigEndian(t testing.TB) {
+	if nativeEndian != binary.LittleEndian {
+		t.Skip("the recorded blobs are little endian")
+	}
+}
+
+var tcpIPv4EventBlob = mustDecodeHex(
+	"d202964900000000" + // timestamp
+		"0300000000000000" + // cpu
+		"01000000" + // type: connect
+		"92100000" + // pid
+		"6375726c000000000000000000000000" + // comm: "curl"
+		"0a000001" + // saddr: 10.0.0.1
+		"0a000002" + // daddr: 10.0.0.2
+		"caa8" + // sport
+		"5000" + // dport
+		"980000f0" + // netns
+		"07000000" + // fd
+		"00000100" + // close_reason, shutdown, sample_rate
+		"8877665544332211" + // sock_id
+		"40e2010000000000" + // ino
+		"e8030000" + // uid
+		"10000000" + // mark
+		"01000000" + // ifindex
+		"02000000" + // state, old_state, padding
+		"60e3160000000000" + // latency_ns: 1.5ms
+		"401f0000" + // srtt_us: 1ms << 3
+		"d0070000" + // mdev_us: 500us << 2
+		"02000000" + // total_retrans
+		"0a000000" + // snd_cwnd
+		"63756269630000000000000000000000", // ca_name: "cubic"
+)
+
+var tcpIPv6EventBlob = mustDecodeHex(
+	"d202964900000000" + // timestamp
+		"0100000000000000" + // cpu
+		"03000000" + // type: close
+		"92100000" + // pid
+		"6e67696e780000000000000000000000" + // comm: "nginx"
+		"20010db8000000000000000000000001" + // saddr: 2001:db8::1
+		"20010db8000000000000000000000002" + // daddr: 2001:db8::2
+		"bb01" + // sport
+		"22c8" + // dport
+		"980000f0" + // netns
+		"00000000" + // fd
+		"03030400" + // close_reason: reset, shutdown: both, sample_rate
+		"8877665544332211" + // sock_id
+		"40e2010000000000" + // ino
+		"e8030000" + // uid
+		"10000000" + // mark
+		"01000000" + // ifindex
+		"07010000" + // state, old_state, padding
+		"0000000000000000" + // latency_ns
+		"401f0000" + // srtt_us: 1ms << 3
+		"d0070000" + // mdev_us: 500us << 2
+		"02000000" + // total_retrans
+		"0a000000" + // snd_cwnd
+		"63756269630000000000000000000000", // ca_name: "cubic"
+)
+
+var tcpTracerStatusBlob = mustDecodeHex(
+	"0300000000000000" + // state: ready
+		"9310000092100000" + // pid_tgid
+		"0d00000000000000" + // what: socket inode
+		"0400000000000000" + // offset_saddr
+		"0000000000000000" + // offset_daddr
+		"0e03000000000000" + // offset_sport
+		"0c00000000000000" + // offset_dport
+		"3000000000000000" + // offset_netns
+		"8800000000000000" + // offset_ino
+		"1000000000000000" + // offset_family
+		"3800000000000000" + // offset_daddr_ipv6
+		"4800000000000000" + // offset_saddr_ipv6
+		"1200000000000000" + // offset_state
+		"0202000000000000" + // offset_protocol
+		"c002000000000000" + // offset_uid
+		"cc01000000000000" + // offset_mark
+		"1400000000000000" + // offset_bound_dev_if
+		"8802000000000000" + // offset_socket
+		"6000000000000000" + // offset_socket_ino
+		"0e03000000000000" + // offset_sport_ipv6
+		"0014000000000000" + // unavailable: uid and bound device
+		"0100000000000000" + // tcp_stats_ready
+		"3006000000000000" + // offset_srtt
+		"3406000000000000" + // offset_mdev
+		"cc06000000000000" + // offset_total_retrans
+		"6406000000000000" + // offset_snd_cwnd
+		"6807000000000000" + // offset_ca_ops
+		"1800000000000000" + // offset_ca_name
+		"0000000000000000" + // unix_ready
+		"0000000000000000" + // offset_socket_sk
+		"0000000000000000" + // offset_peer_pid
+		"0000000000000000" + // offset_pid_nr
+		"0000000000000000" + // offset_unix_addr
+		"0000000000000000" + // offset_unix_addr_len
+		"0000000000000000" + // offset_unix_addr_name
+		"0000000000000000" + // offset_pid_tasks
+		"0000000000000000" + // offset_task_pid_links
+		"0000000000000000" + // offset_task_comm
+		"0100000000000000" + // listen_ready
+		"5802000000000000" + // offset_ack_backlog
+		"5c02000000000000" + // offset_max_ack_backlog
+		"0000000000000000" + // err
+		"0807060504030201" + // sock_id_key
+		"cd81010000000000" + // socket_ino
+		"8758603100000000000000000000002a" + // daddr_ipv6
+		"00000000000000000000000000000001" + // saddr_ipv6: ::1
+		"980000f0" + // netns
+		"7f000001" + // saddr: 127.0.0.1
+		"7f000002" + // daddr: 127.0.0.2
+		"5d1e3c7a" + // uid
+		"7b0a1f5e" + // mark
+		"01000600" + // protocol: SOCK_STREAM, IPPROTO_TCP
+		"01000000" + // bound_dev_if
+		"3039" + // sport: 12345 in network byte order
+		"303a" + // sport_ipv6: 12346 in network byte order
+		"1f90" + // dport: 8080 in network byte order
+		"0200" + // family: AF_INET
+		"0200" + // tcp_state: SYN_SENT, padding
+		"0000", // padding
+)
+
+func TestAppendV4(t *testing.T) {
+	skipIfBigEndian(t)
+
+	if len(tcpIPv4EventBlob) != tcpIPv4EventSize {
+		t.Fatalf("blob is %d bytes, want %d", len(tcpIPv4EventBlob), tcpIPv4EventSize)
+	}
+
+	d := newEventDecoder(1)
+	if err := d.appendV4(tcpIPv4EventBlob); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(d.events))
+	}
+
+	want := Event{
+		Timestamp:      1234567890,
+		CPU:            3,
+		Type:           EventConnect,
+		Pid:            4242,
+		Comm:           "curl",
+		SPort:          43210,
+		DPort:          80,
+		NetNS:          testNetNS,
+		Fd:             7,
+		SampleRate:     1,
+		SockID:         0x1122334455667788,
+		Ino:            123456,
+		UID:            1000,
+		Mark:           0x10,
+		IfIndex:        1,
+		State:          TCPSynSent,
+		ConnectLatency: 1500 * time.Microsecond,
+
+		SRTT:                time.Millisecond,
+		RTTVar:              500 * time.Microsecond,
+		Retransmits:         2,
+		SndCwnd:             10,
+		CongestionAlgorithm: "cubic",
+	}
+	copy(want.SAddr[:], net.ParseIP("10.0.0.1").To16())
+	copy(want.DAddr[:], net.ParseIP("10.0.0.2").To16())
+	if !reflect.DeepEqual(d.events[0], want) {
+		t.Errorf("got %+v, want %+v", d.events[0], want)
+	}
+}
+
+func TestAppendV6(t *testing.T) {
+	skipIfBigEndian(t)
+
+	if len(tcpIPv6EventBlob) != tcpIPv6EventSize {
+		t.Fatalf("blob is %d bytes, want %d", len(tcpIPv6EventBlob), tcpIPv6EventSize)
+	}
+
+	d := newEventDecoder(1)
+	if err := d.appendV6(tcpIPv6EventBlob); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(d.events))
+	}
+
+	want := Event{
+		Timestamp:   1234567890,
+		CPU:         1,
+		Type:        EventClose,
+		Pid:         4242,
+		Comm:        "nginx",
+		IPv6:        true,
+		SPort:       443,
+		DPort:       51234,
+		NetNS:       testNetNS,
+		CloseReason: CloseReset,
+		Shutdown:    ShutdownBoth,
+		SampleRate:  4,
+		SockID:      0x1122334455667788,
+		Ino:         123456,
+		UID:         1000,
+		Mark:        0x10,
+		IfIndex:     1,
+		State:       TCPClose,
+		OldState:    TCPEstablished,
+
+		SRTT:                time.Millisecond,
+		RTTVar:              500 * time.Microsecond,
+		Retransmits:         2,
+		SndCwnd:             10,
+		CongestionAlgorithm: "cubic",
+	}
+	copy(want.SAddr[:], net.ParseIP("2001:db8::1"))
+	copy(want.DAddr[:], net.ParseIP("2001:db8::2"))
+	if !reflect.DeepEqual(d.events[0], want) {
+		t.Errorf("got %+v, want %+v", d.events[0], want)
+	}
+}
+
+func TestAppendShortEvents(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		append func(*eventDecoder, []byte) error
+		blob   []byte
+	}{
+		{"ipv4", (*eventDecoder).appendV4, tcpIPv4EventBlob},
+		{"ipv6", (*eventDecoder).appendV6, tcpIPv6EventBlob},
+	} {
+		for _, n := range []int{0, 8, len(tt.blob) / 2, len(tt.blob) - 1} {
+			d := newEventDecoder(1)
+			if err := tt.append(d, tt.blob[:n]); err == nil {
+				t.Errorf("%s: no error decoding %d bytes", tt.name, n)
+			}
+			if len(d.events) != 0 {
+				t.Errorf("%s: got %d events decoding %d bytes, want none", tt.name, len(d.events), n)
+			}
+		}
+
+		// perf samples may be padded after the event
+		d := newEventDecoder(1)
+		padded := append(append([]byte(nil), tt.blob...), 0, 0, 0, 0)
+		if err := tt.append(d, padded); err != nil {
+			t.Errorf("%s: error decoding padded event: %v", tt.name, err)
+		}
+	}
+}
+
+func TestCommInternerEviction(t *testing.T) {
+	var c commInterner
+	comm := func(i int) [16]byte {
+		var b [16]byte
+		copy(b[:], fmt.Sprintf("proc-%d", i))
+		return b
+	}
+
+	for i := 0; i < maxInternedComms; i++ {
+		c.intern(comm(i))
+	}
+	// use the oldest one again so that the second oldest is evicted
+	c.intern(comm(0))
+	if got := c.intern(comm(maxInternedComms)); got != fmt.Sprintf("proc-%d", maxInternedComms) {
+		t.Errorf("got %q", got)
+	}
+
+	if len(c.comms) != maxInternedComms || c.lru.Len() != maxInternedComms {
+		t.Fatalf("got %d comms and %d in the lru list, want %d", len(c.comms), c.lru.Len(), maxInternedComms)
+	}
+	if _, ok := c.comms[comm(0)]; !ok {
+		t.Error("recently used comm was evicted")
+	}
+	if _, ok := c.comms[comm(1)]; ok {
+		t.Error("least recently used comm was not evicted")
+	}
+}
+
+func benchmarkAppend(b *testing.B, appendEvent func(*eventDecoder, []byte) error, blob []byte) {
+	d := newEventDecoder(maxBatchSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(d.events) == maxBatchSize {
+			d.reset()
+		}
+		if err := appendEvent(d, blob); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendV4(b *testing.B) {
+	benchmarkAppend(b, (*eventDecoder).appendV4, tcpIPv4EventBlob)
+}
+
+func BenchmarkAppendV6(b *testing.B) {
+	benchmarkAppend(b, (*eventDecoder).appendV6, tcpIPv6EventBlob)
+}
+
+func TestStatusUnmarshal(t *testing.T) {
+	skipIfBigEndian(t)
+
+	var status tcpTracerStatus
+	if len(tcpTracerStatusBlob) != binary.Size(status) {
+		t.Fatalf("blob is %d bytes, want %d", len(tcpTracerStatusBlob), binary.Size(status))
+	}
+	if err := status.unmarshal(tcpTracerStatusBlob); err != nil {
+		t.Fatal(err)
+	}
+
+	want := tcpTracerStatus{
+		State:              stateReady,
+		PidTgid:            4242<<32 | 4243,
+		What:               guessSocketIno,
+		OffsetSaddr:        4,
+		OffsetSport:        782,
+		OffsetDport:        12,
+		OffsetNetns:        48,
+		OffsetIno:          136,
+		OffsetFamily:       16,
+		OffsetDaddrIPv6:    56,
+		OffsetSaddrIPv6:    72,
+		OffsetState:        18,
+		OffsetProtocol:     514,
+		OffsetUID:          704,
+		OffsetMark:         460,
+		OffsetBoundDevIf:   20,
+		OffsetSocket:       648,
+		OffsetSocketIno:    96,
+		OffsetSportIPv6:    782,
+		Unavailable:        1<<guessUID | 1<<guessBoundDevIf,
+		TCPStatsReady:      1,
+		OffsetSrtt:         1584,
+		OffsetMdev:         1588,
+		OffsetTotalRetrans: 1740,
+		OffsetSndCwnd:      1636,
+		OffsetCaOps:        1896,
+		OffsetCaName:       24,
+
+		ListenReady:         1,
+		OffsetAckBacklog:    600,
+		OffsetMaxAckBacklog: 604,
+
+		SockIDKey: 0x0102030405060708,
+		SocketIno: 98765,
+
+		DaddrIPv6:  ipv6ToUint32Arr(net.ParseIP("8758:6031::2a")),
+		SaddrIPv6:  ipv6ToUint32Arr(net.ParseIP("::1")),
+		Netns:      testNetNS,
+		Saddr:      nativeEndian.Uint32(net.ParseIP("127.0.0.1").To4()),
+		Daddr:      nativeEndian.Uint32(net.ParseIP("127.0.0.2").To4()),
+		UID:        guessUIDValue,
+		Mark:       guessMarkValue,
+		Protocol:   0x00060001,
+		BoundDevIf: 1,
+		Sport:      htons(12345),
+		SportIPv6:  htons(12346),
+		Dport:      htons(8080),
+		Family:     2,
+		TCPState:   uint8(TCPSynSent),
+	}
+	if status != want {
+		t.Errorf("got %+v, want %+v", status, want)
+	}
+
+	// the marshaled status is what the eBPF program reads
+	if got := status.marshal(); !reflect.DeepEqual(got, tcpTracerStatusBlob) {
+		t.Errorf("marshal:\ngot  %x\nwant %x", got, tcpTracerStatusBlob)
+	}
+}
+
+func TestStatusUnmarshalShort(t *testing.T) {
+	for _, n := range []int{0, 8, len(tcpTracerStatusBlob) - 1} {
+		var status tcpTracerStatus
+		if err := status.unmarshal(tcpTracerStatusBlob[:n]); err == nil {
+			t.Errorf("no error decoding %d bytes", n)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// +build linux
+
+package tracer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// netNSDir is where `ip netns add` mounts the named network namespaces.
+var netNSDir = "/run/netns"
+
+// InterfaceResolver maps interface indexes, such as Event.IfIndex, to
+// interface names. The interfaces are listed with netlink from the network
+// namespace of the event and cached.
+type InterfaceResolver struct {
+	mu    sync.Mutex
+	names map[uint32]map[uint32]string // netns -> ifindex -> name
+}
+
+// NewInterfaceResolver returns an empty InterfaceResolver. Entering other
+// network namespaces requires CAP_SYS_ADMIN.
+func NewInterfaceResolver() *InterfaceResolver {
+	return &InterfaceResolver{
+		names: make(map[uint32]map[uint32]string),
+	}
+}
+
+// Name returns the name of the interface ifindex in the network namespace
+// netns. The interfaces of the namespace are listed again when ifindex is
+// not cached, since it may have been created since.
+func (r *InterfaceResolver) Name(netns, ifindex uint32) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if name, ok := r.names[netns][ifindex]; ok {
+		return name, nil
+	}
+
+	names := make(map[uint32]string)
+	err := inNetNS(netns, func() error {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return err
+		}
+		for _, iface := range ifaces {
+			names[uint32(iface.Index)] = iface.Name
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error listing interfaces of netns %d: %v", netns, err)
+	}
+	r.names[netns] = names
+
+	name, ok := names[ifindex]
+	if !ok {
+		return "", fmt.Errorf("no interface %d in netns %d", ifindex, netns)
+	}
+	return name, nil
+}
+
+// RouteIfIndex returns the output interface of the route to dst in the
+// network namespace netns, for connections that are not bound to an
+// interface. The route is looked up when RouteIfIndex is called, it may
+// differ from the one used when the event was generated. Unlike the names,
+// routes are not cached: each call enters netns, see inNetNS.
+func (r *InterfaceResolver) RouteIfIndex(netns uint32, dst net.IP) (uint32, error) {
+	var ifindex uint32
+	err := inNetNS(netns, func() error {
+		var err error
+		ifindex, err = routeIfIndex(dst)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error getting route to %v in netns %d: %v", dst, netns, err)
+	}
+	return ifindex, nil
+}
+
+// Forget drops the interfaces cached for netns, for example once the
+// namespace is gone.
+func (r *InterfaceResolver) Forget(netns uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.names, netns)
+}
+
+// inNetNS runs f on a dedicated OS thread moved to the network namespace
+// netns. The thread is never given back to the Go runtime, which terminates
+// it once f returns: every call uses up an OS thread, and the next one
+// creates a new thread, even for the same netns.
+func inNetNS(netns uint32, f func() error) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		// Like in runInPrivateNetNS, the thread is never unlocked so
+		// that it is not reused in the wrong network namespace.
+		runtime.LockOSThread()
+
+		current, err := ownNetNS()
+		if err != nil {
+			errChan <- fmt.Errorf("error getting current netns: %v", err)
+			return
+		}
+		if current == uint64(netns) {
+			errChan <- f()
+			return
+		}
+
+		path, err := netNSPath(netns)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		_, _, errno := syscall.RawSyscall(sysSetns, uintptr(fd), syscall.CLONE_NEWNET, 0)
+		syscall.Close(fd)
+		if errno != 0 {
+			errChan <- fmt.Errorf("error entering netns %d: %v", netns, errno)
+			return
+		}
+
+		errChan <- f()
+	}()
+
+	return <-errChan
+}
+
+// netNSPath returns a path to the network namespace netns: a namespace
+// created with `ip netns add` or the namespace of a process.
+func netNSPath(netns uint32) (string, error) {
+	var paths []string
+	if files, err := ioutil.ReadDir(netNSDir); err == nil {
+		for _, f := range files {
+			paths = append(paths, filepath.Join(netNSDir, f.Name()))
+		}
+	}
+	proc, err := os.Open("/proc")
+	if err != nil {
+		return "", err
+	}
+	names, err := proc.Readdirnames(-1)
+	proc.Close()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if _, err := strconv.Atoi(name); err == nil {
+			paths = append(paths, filepath.Join("/proc", name, "ns/net"))
+		}
+	}
+
+	for _, path := range paths {
+		var s syscall.Stat_t
+		if err := syscall.Stat(path, &s); err == nil && s.Ino == uint64(netns) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("netns %d not found", netns)
+}
+
+func rtaAlign(n int) int {
+	return (n + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
+
+// routeIfIndex asks the kernel for the route to dst with a RTM_GETROUTE
+// netlink request, like `ip route get`, and returns its output interface.
+func routeIfIndex(dst net.IP) (uint32, error) {
+	family := syscall.AF_INET
+	addr := dst.To4()
+	if addr == nil {
+		family = syscall.AF_INET6
+		addr = dst.To16()
+	}
+	if addr == nil {
+		return 0, fmt.Errorf("invalid address %v", dst)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(fd)
+
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return 0, err
+	}
+
+	// struct nlmsghdr, struct rtmsg and a RTA_DST attribute
+	attrLen := syscall.SizeofRtAttr + len(addr)
+	msgLen := syscall.NLMSG_HDRLEN + syscall.SizeofRtMsg + rtaAlign(attrLen)
+	req := make([]byte, msgLen)
+	nativeEndian.PutUint32(req[0:4], uint32(msgLen))
+	nativeEndian.PutUint16(req[4:6], syscall.RTM_GETROUTE)
+	nativeEndian.PutUint16(req[6:8], syscall.NLM_F_REQUEST)
+	nativeEndian.PutUint32(req[8:12], 1)
+	rtm := req[syscall.NLMSG_HDRLEN:]
+	rtm[0] = byte(family)
+	rtm[1] = byte(len(addr) * 8)
+	rta := rtm[syscall.SizeofRtMsg:]
+	nativeEndian.PutUint16(rta[0:2], uint16(attrLen))
+	nativeEndian.PutUint16(rta[2:4], syscall.RTA_DST)
+	copy(rta[syscall.SizeofRtAttr:], addr)
+
+	if err := syscall.Sendto(fd, req, 0, sa); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return 0, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case syscall.NLMSG_ERROR:
+			if len(m.Data) >= 4 {
+				if errno := -int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return 0, syscall.Errno(errno)
+				}
+			}
+		case syscall.RTM_NEWROUTE:
+			attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+			if err != nil {
+				return 0, err
+			}
+			for _, a := range attrs {
+				if a.Attr.Type == syscall.RTA_OIF && len(a.Value) >= 4 {
+					return nativeEndian.Uint32(a.Value), nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("no output interface")
+}
@@ -0,0 +1,99 @@
+// +build linux
+
+package tracer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// inTestNetNS runs f in a new network namespace with its loopback interface
+// up. The namespace is named like with `ip netns add`, so that the resolver
+// can enter it from other threads. The test is skipped without the
+// privileges to create it. f doesn't run on the test goroutine, it must not
+// call t.Fatal.
+func inTestNetNS(t *testing.T, f func(netns uint32, lo *net.Interface)) {
+	dir, err := ioutil.TempDir("", "netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevDir := netNSDir
+	netNSDir = dir
+	defer func() { netNSDir = prevDir }()
+
+	created := false
+	err = runInPrivateNetNS(func() error {
+		created = true
+
+		netns, err := ownNetNS()
+		if err != nil {
+			return err
+		}
+		lo, err := net.InterfaceByName(loopbackInterface)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, "test")
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			return err
+		}
+		self := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), syscall.Gettid())
+		if err := syscall.Mount(self, path, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("error naming netns: %v", err)
+		}
+		defer syscall.Unmount(path, syscall.MNT_DETACH)
+
+		f(uint32(netns), lo)
+		return nil
+	})
+	if err != nil && !created {
+		t.Skipf("can't create a network namespace: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterfaceResolverName(t *testing.T) {
+	inTestNetNS(t, func(netns uint32, lo *net.Interface) {
+		r := NewInterfaceResolver()
+		name, err := r.Name(netns, uint32(lo.Index))
+		if err != nil {
+			t.Error(err)
+		} else if name != loopbackInterface {
+			t.Errorf("got interface %q, want %q", name, loopbackInterface)
+		}
+
+		// the namespace only has the loopback interface
+		if name, err := r.Name(netns, uint32(lo.Index)+1000); err == nil {
+			t.Errorf("got interface %q for a missing index", name)
+		}
+	})
+}
+
+func TestInterfaceResolverRoute(t *testing.T) {
+	inTestNetNS(t, func(netns uint32, lo *net.Interface) {
+		r := NewInterfaceResolver()
+		ifindex, err := r.RouteIfIndex(netns, net.ParseIP("127.0.0.1"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if ifindex != uint32(lo.Index) {
+			t.Errorf("got route through interface %d, want %d", ifindex, lo.Index)
+		}
+		name, err := r.Name(netns, ifindex)
+		if err != nil {
+			t.Error(err)
+		} else if name != loopbackInterface {
+			t.Errorf("got interface %q, want %q", name, loopbackInterface)
+		}
+	})
+}
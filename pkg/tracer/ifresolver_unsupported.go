@@ -0,0 +1,25 @@
+// +build !linux
+
+package tracer
+
+import (
+	"fmt"
+	"net"
+)
+
+type InterfaceResolver struct{}
+
+func NewInterfaceResolver() *InterfaceResolver {
+	return &InterfaceResolver{}
+}
+
+func (r *InterfaceResolver) Name(netns, ifindex uint32) (string, error) {
+	return "", fmt.Errorf("not supported on non-Linux systems")
+}
+
+func (r *InterfaceResolver) RouteIfIndex(netns uint32, dst net.IP) (uint32, error) {
+	return 0, fmt.Errorf("not supported on non-Linux systems")
+}
+
+func (r *InterfaceResolver) Forget(netns uint32) {
+}
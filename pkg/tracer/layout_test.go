@@ -0,0 +1,240 @@
+// +build linux
+
+package tracer
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// The tests below pin the structs shared with the eBPF program to their
+// definitions in tcptracer-bpf.h, computing the C layout from the header.
+
+const bpfHeader = "../../tcptracer-bpf.h"
+
+// cField is a member of a C struct, with its offset and size in bytes.
+type cField struct {
+	name   string
+	offset uintptr
+	size   uintptr
+}
+
+type cStruct struct {
+	fields []cField
+	size   uintptr
+	align  uintptr
+}
+
+var (
+	cCommentRe = regexp.MustCompile(`(?s)/\*.*?\*/|//[^\n]*`)
+	cDefineRe  = regexp.MustCompile(`(?m)^#define\s+(\w+)\s+(\d+)\s*$`)
+	cStructRe  = regexp.MustCompile(`(?s)struct\s+(\w+)\s*\{(.*?)\};`)
+	cMemberRe  = regexp.MustCompile(`^(struct\s+\w+|\w+)\s*(\*?)\s*(\w+)(?:\[(\w+)\])?$`)
+)
+
+var cScalarSizes = map[string]uintptr{
+	"char":  1,
+	"__u8":  1,
+	"__u16": 2,
+	"__u32": 4,
+	"__u64": 8,
+}
+
+// parseCStructs computes the layout of the structs of a C header, for a 64
+// bits target.
+func parseCStructs(t *testing.T, path string) map[string]cStruct {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := cCommentRe.ReplaceAllString(string(data), "")
+
+	defines := make(map[string]uintptr)
+	for _, m := range cDefineRe.FindAllStringSubmatch(src, -1) {
+		n, _ := strconv.ParseUint(m[2], 10, 64)
+		defines[m[1]] = uintptr(n)
+	}
+
+	structs := make(map[string]cStruct)
+	for _, m := range cStructRe.FindAllStringSubmatch(src, -1) {
+		var s cStruct
+		s.align = 1
+		for _, decl := range strings.Split(m[2], ";") {
+			decl = strings.Join(strings.Fields(decl), " ")
+			if decl == "" {
+				continue
+			}
+			mm := cMemberRe.FindStringSubmatch(decl)
+			if mm == nil {
+				t.Fatalf("struct %s: can't parse %q", m[1], decl)
+			}
+			typ, pointer, name, dim := mm[1], mm[2], mm[3], mm[4]
+
+			var size, align uintptr
+			switch {
+			case pointer != "":
+				size, align = 8, 8
+			case strings.HasPrefix(typ, "struct "):
+				inner, ok := structs[strings.TrimPrefix(typ, "struct ")]
+				if !ok {
+					t.Fatalf("struct %s: unknown type %q", m[1], typ)
+				}
+				size, align = inner.size, inner.align
+			default:
+				var ok bool
+				if size, ok = cScalarSizes[typ]; !ok {
+					t.Fatalf("struct %s: unknown type %q", m[1], typ)
+				}
+				align = size
+			}
+			if dim != "" {
+				n, ok := defines[dim]
+				if !ok {
+					v, err := strconv.ParseUint(dim, 10, 64)
+					if err != nil {
+						t.Fatalf("struct %s: unknown array size %q", m[1], dim)
+					}
+					n = uintptr(v)
+				}
+				size *= n
+			}
+
+			offset := (s.size + align - 1) / align * align
+			s.fields = append(s.fields, cField{name: name, offset: offset, size: size})
+			s.size = offset + size
+			if align > s.align {
+				s.align = align
+			}
+		}
+		s.size = (s.size + s.align - 1) / s.align * s.align
+		structs[m[1]] = s
+	}
+	return structs
+}
+
+// normalizeName makes the names of the Go and C fields comparable.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+// isCPadding returns whether a C field is only there for the alignment.
+func isCPadding(name string) bool {
+	return name == "dummy" || name == "padding"
+}
+
+func TestLayout(t *testing.T) {
+	if unsafe.Alignof(uint64(0)) != 8 {
+		t.Skip("the eBPF structs are laid out for 64 bits alignment")
+	}
+	structs := parseCStructs(t, bpfHeader)
+
+	for _, tt := range []struct {
+		cName string
+		value interface{}
+		// aliases maps the Go fields covering several C fields to the
+		// latter, such as the two halves of an IPv6 address
+		aliases map[string][]string
+	}{
+		{"sock_info_t", sockInfo{}, nil},
+		{"tcp_stats_t", tcpStats{}, nil},
+		{"tcp_ipv4_event_t", tcpIPv4Event{}, nil},
+		{"tcp_ipv6_event_t", tcpIPv6Event{}, map[string][]string{
+			"SAddr": {"saddr_h", "saddr_l"},
+			"DAddr": {"daddr_h", "daddr_l"},
+		}},
+		{"ipv4_tuple_t", ipv4Tuple{}, nil},
+		{"ipv6_tuple_t", ipv6Tuple{}, map[string][]string{
+			"SAddr": {"saddr_h", "saddr_l"},
+			"DAddr": {"daddr_h", "daddr_l"},
+		}},
+		{"tcptracer_config_t", tcpTracerConfig{}, nil},
+		{"ratelimit_t", rateLimit{}, nil},
+		{"aggregate_key_t", aggregateKey{}, map[string][]string{
+			"DAddr": {"daddr_h", "daddr_l"},
+		}},
+		{"unix_event_t", unixEvent{}, nil},
+		{"listen_stats_t", listenStats{}, nil},
+		{"tcptracer_status_t", tcpTracerStatus{}, nil},
+	} {
+		c, ok := structs[tt.cName]
+		if !ok {
+			t.Errorf("struct %s not found in %s", tt.cName, bpfHeader)
+			continue
+		}
+		typ := reflect.TypeOf(tt.value)
+
+		if size := typ.Size(); size != c.size {
+			t.Errorf("%s is %d bytes, struct %s is %d bytes", typ.Name(), size, tt.cName, c.size)
+		}
+		if size := binary.Size(tt.value); uintptr(size) != c.size {
+			t.Errorf("%s is encoded in %d bytes, struct %s is %d bytes", typ.Name(), size, tt.cName, c.size)
+		}
+
+		cFields := make(map[string]cField)
+		for _, f := range c.fields {
+			cFields[normalizeName(f.name)] = f
+		}
+		matched := make(map[string]bool)
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if f.Name == "_" {
+				continue
+			}
+			names, ok := tt.aliases[f.Name]
+			if !ok {
+				names = []string{f.Name}
+			}
+
+			var offset, size uintptr
+			for j, name := range names {
+				cf, ok := cFields[normalizeName(name)]
+				if !ok {
+					t.Errorf("%s.%s: no field %s in struct %s", typ.Name(), f.Name, name, tt.cName)
+					break
+				}
+				matched[cf.name] = true
+				if j == 0 {
+					offset = cf.offset
+				} else if cf.offset != offset+size {
+					t.Errorf("%s.%s: field %s of struct %s doesn't follow %s", typ.Name(), f.Name, cf.name, tt.cName, names[j-1])
+				}
+				size += cf.size
+			}
+			if f.Offset != offset || f.Type.Size() != size {
+				t.Errorf("%s.%s: offset %d, size %d, want offset %d, size %d as in struct %s",
+					typ.Name(), f.Name, f.Offset, f.Type.Size(), offset, size, tt.cName)
+			}
+		}
+		for _, f := range c.fields {
+			if !matched[f.name] && !isCPadding(f.name) {
+				t.Errorf("field %s of struct %s is missing from %s", f.name, tt.cName, typ.Name())
+			}
+		}
+	}
+}
+
+func TestEventSizes(t *testing.T) {
+	if unsafe.Alignof(uint64(0)) != 8 {
+		t.Skip("the eBPF structs are laid out for 64 bits alignment")
+	}
+	structs := parseCStructs(t, bpfHeader)
+
+	for _, tt := range []struct {
+		cName string
+		size  int
+	}{
+		{"tcp_ipv4_event_t", tcpIPv4EventSize},
+		{"tcp_ipv6_event_t", tcpIPv6EventSize},
+		{"unix_event_t", unixEventSize},
+	} {
+		if c := structs[tt.cName]; c.size != uintptr(tt.size) {
+			t.Errorf("struct %s is %d bytes, its size constant is %d", tt.cName, c.size, tt.size)
+		}
+	}
+}
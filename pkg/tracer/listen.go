@@ -0,0 +1,131 @@
+package tracer
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// ListenerStats are the counters of a listening socket, since it received
+// its first SYN. The drops are only counted if the kernel exposes its BTF
+// type information.
+type ListenerStats struct {
+	SockID uint64 // Identifier of the socket, as in its events
+	NetNS  uint32 // Network namespace ID
+	SAddr  net.IP // Local IP address, unspecified if listening on all addresses
+	SPort  uint16 // Local TCP port
+
+	SynRecv    uint64 // SYNs received
+	SynDropped uint64 // SYNs dropped because the accept queue was full
+	AckDropped uint64 // Handshakes not completed because the accept queue was full
+	Backlog    uint32 // Connections waiting in the accept queue
+	MaxBacklog uint32 // Limit of the accept queue, as passed to listen()
+}
+
+func (s *ListenerStats) dropped() uint64 {
+	return s.SynDropped + s.AckDropped
+}
+
+// listener identifies a listening socket found from its events.
+type listener struct {
+	ipv6  bool
+	saddr [16]byte
+	sport uint16
+	netns uint32
+}
+
+// maxListeners is the number of entries of the listenstats map, no more
+// listening sockets have counters.
+const maxListeners = 1024
+
+// listenerLookup reads the counters of a listening socket into s. It returns
+// false if the socket has none, because it isn't listening anymore.
+type listenerLookup func(sockID uint64, s *ListenerStats) bool
+
+// listenerTracker keeps the listening sockets seen in the SYN received and
+// listen overflow events, whose counters are in the listenstats map. The
+// sockets without counters are forgotten by snapshot, or when limit sockets
+// are tracked.
+type listenerTracker struct {
+	limit  int
+	lookup listenerLookup
+
+	mu        sync.Mutex
+	listeners map[uint64]listener
+}
+
+func newListenerTracker(limit int, lookup listenerLookup) *listenerTracker {
+	return &listenerTracker{
+		limit:     limit,
+		lookup:    lookup,
+		listeners: make(map[uint64]listener),
+	}
+}
+
+func (l *listenerTracker) observe(events []Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := range events {
+		e := &events[i]
+		if e.Type != EventSynRecv && e.Type != EventListenOverflow {
+			continue
+		}
+		if _, ok := l.listeners[e.SockID]; !ok && len(l.listeners) >= l.limit {
+			l.forgetClosed()
+			if len(l.listeners) >= l.limit {
+				continue
+			}
+		}
+		l.listeners[e.SockID] = listener{
+			ipv6:  e.IPv6,
+			saddr: e.SAddr,
+			sport: e.SPort,
+			netns: e.NetNS,
+		}
+	}
+}
+
+// forgetClosed removes the sockets without counters. l.mu must be held.
+func (l *listenerTracker) forgetClosed() {
+	var s ListenerStats
+	for id := range l.listeners {
+		if !l.lookup(id, &s) {
+			delete(l.listeners, id)
+		}
+	}
+}
+
+// snapshot returns the counters of the listening sockets, the ones with
+// the most drops first. The sockets without counters are forgotten.
+func (l *listenerTracker) snapshot() []ListenerStats {
+	l.mu.Lock()
+	ret := make([]ListenerStats, 0, len(l.listeners))
+	for id, ln := range l.listeners {
+		s := ListenerStats{
+			SockID: id,
+			NetNS:  ln.netns,
+			SPort:  ln.sport,
+		}
+		if !l.lookup(id, &s) {
+			delete(l.listeners, id)
+			continue
+		}
+		if ln.ipv6 {
+			s.SAddr = make(net.IP, net.IPv6len)
+			copy(s.SAddr, ln.saddr[:])
+		} else {
+			s.SAddr = net.IPv4(ln.saddr[12], ln.saddr[13], ln.saddr[14], ln.saddr[15])
+		}
+		ret = append(ret, s)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].dropped() != ret[j].dropped() {
+			return ret[i].dropped() > ret[j].dropped()
+		}
+		return ret[i].SynRecv > ret[j].SynRecv
+	})
+	return ret
+}
@@ -0,0 +1,118 @@
+package tracer
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fakeListenStats stands for the listenstats map, by socket id.
+type fakeListenStats map[uint64]ListenerStats
+
+func (f fakeListenStats) lookup(sockID uint64, s *ListenerStats) bool {
+	c, ok := f[sockID]
+	if !ok {
+		return false
+	}
+	s.SynRecv = c.SynRecv
+	s.SynDropped = c.SynDropped
+	s.AckDropped = c.AckDropped
+	s.Backlog = c.Backlog
+	s.MaxBacklog = c.MaxBacklog
+	return true
+}
+
+func listenEvent(typ EventType, sockID uint64, saddr string, sport uint16) Event {
+	ip := net.ParseIP(saddr)
+	e := Event{
+		Type:   typ,
+		SockID: sockID,
+		SPort:  sport,
+		NetNS:  testNetNS,
+		IPv6:   ip.To4() == nil,
+	}
+	copy(e.SAddr[:], ip.To16())
+	return e
+}
+
+func TestListenerTracker(t *testing.T) {
+	stats := fakeListenStats{
+		1: {SynRecv: 10},
+		2: {SynRecv: 5, SynDropped: 2, Backlog: 128, MaxBacklog: 128},
+		3: {SynRecv: 20},
+		4: {SynRecv: 1, AckDropped: 3},
+	}
+	l := newListenerTracker(maxListeners, stats.lookup)
+	l.observe([]Event{
+		listenEvent(EventSynRecv, 1, "10.0.0.1", 80),
+		listenEvent(EventListenOverflow, 2, "0.0.0.0", 443),
+		listenEvent(EventConnect, 5, "10.0.0.1", 50000),
+		listenEvent(EventSynRecv, 3, "::", 8080),
+		listenEvent(EventSynRecv, 4, "2001:db8::1", 22),
+	})
+
+	want := []ListenerStats{
+		// the most drops first, then the most SYNs
+		{SockID: 4, NetNS: testNetNS, SAddr: net.ParseIP("2001:db8::1"), SPort: 22, SynRecv: 1, AckDropped: 3},
+		{SockID: 2, NetNS: testNetNS, SAddr: net.IPv4(0, 0, 0, 0), SPort: 443, SynRecv: 5, SynDropped: 2, Backlog: 128, MaxBacklog: 128},
+		{SockID: 3, NetNS: testNetNS, SAddr: net.ParseIP("::"), SPort: 8080, SynRecv: 20},
+		{SockID: 1, NetNS: testNetNS, SAddr: net.IPv4(10, 0, 0, 1), SPort: 80, SynRecv: 10},
+	}
+	if got := l.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	// IPv4 addresses are IPv4-mapped in the events
+	if got := l.snapshot()[3].SAddr.To4(); !got.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("got address %v, want 10.0.0.1", got)
+	}
+
+	// the sockets which stopped listening are forgotten
+	delete(stats, 2)
+	delete(stats, 4)
+	got := l.snapshot()
+	if len(got) != 2 || got[0].SockID != 3 || got[1].SockID != 1 {
+		t.Errorf("got %+v, want sockets 3 and 1", got)
+	}
+	stats[2] = ListenerStats{SynRecv: 1}
+	if got := l.snapshot(); len(got) != 2 {
+		t.Errorf("forgotten socket reported again: %+v", got)
+	}
+}
+
+func TestListenerTrackerLimit(t *testing.T) {
+	stats := fakeListenStats{
+		1: {SynRecv: 1},
+		2: {SynRecv: 1},
+	}
+	l := newListenerTracker(2, stats.lookup)
+	l.observe([]Event{
+		listenEvent(EventSynRecv, 1, "10.0.0.1", 80),
+		listenEvent(EventSynRecv, 2, "10.0.0.1", 81),
+	})
+
+	// no room for a third socket while the others are listening
+	stats[3] = ListenerStats{SynRecv: 1}
+	l.observe([]Event{listenEvent(EventSynRecv, 3, "10.0.0.1", 82)})
+	if len(l.listeners) != 2 {
+		t.Errorf("tracking %d sockets, want 2", len(l.listeners))
+	}
+	if _, ok := l.listeners[3]; ok {
+		t.Error("socket 3 tracked beyond the limit")
+	}
+
+	// known sockets are still updated
+	l.observe([]Event{listenEvent(EventListenOverflow, 1, "10.0.0.1", 80)})
+	if len(l.listeners) != 2 {
+		t.Errorf("tracking %d sockets, want 2", len(l.listeners))
+	}
+
+	// the sockets which stopped listening make room without a snapshot
+	delete(stats, 1)
+	l.observe([]Event{listenEvent(EventSynRecv, 3, "10.0.0.1", 82)})
+	if _, ok := l.listeners[1]; ok {
+		t.Error("closed socket 1 still tracked")
+	}
+	if _, ok := l.listeners[3]; !ok {
+		t.Error("socket 3 not tracked")
+	}
+}
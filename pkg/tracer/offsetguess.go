@@ -3,6 +3,9 @@
 package tracer
 
 import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"math/rand"
@@ -18,31 +21,120 @@ import (
 	"github.com/iovisor/gobpf/elf"
 )
 
-/*
-#include "../../tcptracer-bpf.h"
-*/
-import "C"
+// tcpTracerStatus mirrors the layout of struct tcptracer_status_t in
+// tcptracer-bpf.h.
+type tcpTracerStatus struct {
+	State uint64
 
-type tcpTracerStatus C.struct_tcptracer_status_t
+	// checking
+	PidTgid          uint64
+	What             uint64
+	OffsetSaddr      uint64
+	OffsetDaddr      uint64
+	OffsetSport      uint64
+	OffsetDport      uint64
+	OffsetNetns      uint64
+	OffsetIno        uint64
+	OffsetFamily     uint64
+	OffsetDaddrIPv6  uint64
+	OffsetSaddrIPv6  uint64
+	OffsetState      uint64
+	OffsetProtocol   uint64
+	OffsetUID        uint64
+	OffsetMark       uint64
+	OffsetBoundDevIf uint64
+	OffsetSocket     uint64
+	OffsetSocketIno  uint64
+	OffsetSportIPv6  uint64
+	// fields that can't be guessed without privileges, as a mask of
+	// 1 << guess*
+	Unavailable uint64
 
-const (
-	// When reading kernel structs at different offsets, don't go over that
-	// limit. This is an arbitrary choice to avoid infinite loops.
-	threshold = 400
+	// offsets of the TCP statistics, read from the kernel BTF
+	TCPStatsReady      uint64
+	OffsetSrtt         uint64
+	OffsetMdev         uint64
+	OffsetTotalRetrans uint64
+	OffsetSndCwnd      uint64
+	OffsetCaOps        uint64
+	OffsetCaName       uint64
 
-	// The source port is much further away in the inet sock.
-	thresholdInetSock = 2000
-)
+	// offsets of the AF_UNIX socket fields, read from the kernel BTF
+	UnixReady          uint64
+	OffsetSocketSk     uint64
+	OffsetPeerPid      uint64
+	OffsetPidNr        uint64
+	OffsetUnixAddr     uint64
+	OffsetUnixAddrLen  uint64
+	OffsetUnixAddrName uint64
+	OffsetPidTasks     uint64
+	OffsetTaskPidLinks uint64
+	OffsetTaskComm     uint64
+
+	// offsets of the accept queue of listening sockets, read from the
+	// kernel BTF
+	ListenReady         uint64
+	OffsetAckBacklog    uint64
+	OffsetMaxAckBacklog uint64
+
+	Err uint64
+
+	SockIDKey uint64
+	SocketIno uint64
+
+	DaddrIPv6  [4]uint32
+	SaddrIPv6  [4]uint32
+	Netns      uint32
+	Saddr      uint32
+	Daddr      uint32
+	UID        uint32
+	Mark       uint32
+	Protocol   uint32
+	BoundDevIf uint32
+	Sport      uint16
+	SportIPv6  uint16
+	Dport      uint16
+	Family     uint16
+	TCPState   uint8
+	_          uint8
+	// trailing padding so the size matches the 8 bytes aligned C struct
+	_ [2]byte
+}
+
+func (s *tcpTracerStatus) marshal() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, nativeEndian, s)
+	return buf.Bytes()
+}
+
+func (s *tcpTracerStatus) unmarshal(data []byte) error {
+	return binary.Read(bytes.NewReader(data), nativeEndian, s)
+}
+
+// lookupStatus reads the tcptracer_status map into status.
+func lookupStatus(module *elf.Module, mp *elf.Map, status *tcpTracerStatus) error {
+	buf := make([]byte, binary.Size(status))
+	if err := module.LookupElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(&buf[0])); err != nil {
+		return err
+	}
+	return status.unmarshal(buf)
+}
+
+// updateStatus writes status into the tcptracer_status map.
+func updateStatus(module *elf.Module, mp *elf.Map, status *tcpTracerStatus) error {
+	buf := status.marshal()
+	return module.UpdateElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(&buf[0]), 0)
+}
 
 // These constants should be in sync with the equivalent definitions in the ebpf program.
 const (
-	stateUninitialized C.__u64 = 0
-	stateChecking              = 1 // status set by userspace, waiting for eBPF
-	stateChecked               = 2 // status set by eBPF, waiting for userspace
-	stateReady                 = 3 // fully initialized, all offset known
+	stateUninitialized uint64 = 0
+	stateChecking             = 1 // status set by userspace, waiting for eBPF
+	stateChecked              = 2 // status set by eBPF, waiting for userspace
+	stateReady                = 3 // fully initialized, all offset known
 )
 
-var stateString = map[C.__u64]string{
+var stateString = map[uint64]string{
 	stateUninitialized: "uninitialized",
 	stateChecking:      "checking",
 	stateChecked:       "checked",
@@ -51,29 +143,165 @@ var stateString = map[C.__u64]string{
 
 // These constants should be in sync with the equivalent definitions in the ebpf program.
 const (
-	guessSaddr     C.__u64 = 0
+	guessSaddr      uint64 = 0
 	guessDaddr             = 1
 	guessFamily            = 2
 	guessSport             = 3
 	guessDport             = 4
 	guessNetns             = 5
 	guessDaddrIPv6         = 6
+	guessSaddrIPv6         = 7
+	guessState             = 8
+	guessProtocol          = 9
+	guessUID               = 10
+	guessMark              = 11
+	guessBoundDevIf        = 12
+	guessSocketIno         = 13
+	guessSportIPv6         = 14
 )
 
-var whatString = map[C.__u64]string{
-	guessSaddr:     "source address",
-	guessDaddr:     "destination address",
-	guessFamily:    "family",
-	guessSport:     "source port",
-	guessDport:     "destination port",
-	guessNetns:     "network namespace",
-	guessDaddrIPv6: "destination address IPv6",
+var whatString = map[uint64]string{
+	guessSaddr:      "source address",
+	guessDaddr:      "destination address",
+	guessFamily:     "family",
+	guessSport:      "source port",
+	guessDport:      "destination port",
+	guessNetns:      "network namespace",
+	guessDaddrIPv6:  "destination address IPv6",
+	guessSaddrIPv6:  "source address IPv6",
+	guessState:      "socket state",
+	guessProtocol:   "socket protocol",
+	guessUID:        "socket uid",
+	guessMark:       "socket mark",
+	guessBoundDevIf: "bound device",
+	guessSocketIno:  "socket inode",
+	guessSportIPv6:  "source port IPv6",
 }
 
-const listenIP = "127.0.0.2"
-
 var zero uint64
 
+// currentOffset returns the offset being tried for the field being guessed.
+func currentOffset(status *tcpTracerStatus) uint64 {
+	switch status.What {
+	case guessSaddr:
+		return status.OffsetSaddr
+	case guessDaddr:
+		return status.OffsetDaddr
+	case guessFamily:
+		return status.OffsetFamily
+	case guessSport:
+		return status.OffsetSport
+	case guessDport:
+		return status.OffsetDport
+	case guessNetns:
+		return status.OffsetNetns
+	case guessDaddrIPv6:
+		return status.OffsetDaddrIPv6
+	case guessSaddrIPv6:
+		return status.OffsetSaddrIPv6
+	case guessState:
+		return status.OffsetState
+	case guessProtocol:
+		return status.OffsetProtocol
+	case guessUID:
+		return status.OffsetUID
+	case guessMark:
+		return status.OffsetMark
+	case guessBoundDevIf:
+		return status.OffsetBoundDevIf
+	case guessSocketIno:
+		return status.OffsetSocketIno
+	case guessSportIPv6:
+		return status.OffsetSportIPv6
+	default:
+		return 0
+	}
+}
+
+// offsetSkips holds the offsets, by field, that matched while guessing but
+// failed the verification, so that they are not picked again.
+type offsetSkips map[uint64]map[uint64]bool
+
+// key identifies the offset being tried for the field being guessed. The
+// network namespace and the socket inode are found with two offsets.
+func offsetSkipKey(status *tcpTracerStatus) uint64 {
+	switch status.What {
+	case guessNetns:
+		return status.OffsetNetns<<32 | status.OffsetIno
+	case guessSocketIno:
+		return status.OffsetSocket<<32 | status.OffsetSocketIno
+	}
+	return currentOffset(status)
+}
+
+func (s offsetSkips) add(status *tcpTracerStatus) {
+	if s[status.What] == nil {
+		s[status.What] = make(map[uint64]bool)
+	}
+	s[status.What][offsetSkipKey(status)] = true
+}
+
+func (s offsetSkips) has(status *tcpTracerStatus) bool {
+	return s[status.What][offsetSkipKey(status)]
+}
+
+// skipCurrentOffset moves to the next possible offset of the field being
+// guessed.
+func skipCurrentOffset(status *tcpTracerStatus) {
+	switch status.What {
+	case guessSaddr:
+		status.OffsetSaddr++
+	case guessDaddr:
+		status.OffsetDaddr++
+	case guessFamily:
+		status.OffsetFamily++
+	case guessSport:
+		status.OffsetSport++
+	case guessDport:
+		status.OffsetDport++
+	case guessNetns:
+		status.OffsetIno++
+	case guessDaddrIPv6:
+		status.OffsetDaddrIPv6++
+	case guessSaddrIPv6:
+		status.OffsetSaddrIPv6++
+	case guessState:
+		status.OffsetState++
+	case guessProtocol:
+		status.OffsetProtocol++
+	case guessUID:
+		status.OffsetUID++
+	case guessMark:
+		status.OffsetMark++
+	case guessBoundDevIf:
+		status.OffsetBoundDevIf++
+	case guessSocketIno:
+		status.OffsetSocketIno++
+	case guessSportIPv6:
+		status.OffsetSportIPv6++
+	}
+}
+
+// guessRestart tells guess to resume from a field whose offset turned out to
+// be wrong instead of keeping the offsets already found.
+type guessRestart struct {
+	what  uint64
+	skips offsetSkips
+}
+
+func newGuessError(status *tcpTracerStatus, err error) *GuessError {
+	field, ok := whatString[status.What]
+	if !ok {
+		field = fmt.Sprintf("unknown field %d", status.What)
+	}
+	return &GuessError{
+		Field:  field,
+		Offset: currentOffset(status),
+		State:  stateString[status.State],
+		Err:    err,
+	}
+}
+
 type freePort struct {
 	port uint16
 	err  error
@@ -87,27 +315,223 @@ type fieldValues struct {
 	netns     uint32
 	family    uint16
 	daddrIPv6 [4]uint32
+	saddrIPv6 [4]uint32
+	sportIPv6 uint16
+	// dportIPv6 is the port of the IPv6 loopback server, 0 if it couldn't
+	// be started
+	dportIPv6 uint16
+	tcpState  uint8
+	uid       uint32
+	mark      uint32
+	// boundDevIf is the index of the loopback interface
+	boundDevIf uint32
+	socketIno  uint64
+}
+
+// Values of sk_uid and sk_mark for the guessing connections. They are
+// unlikely to be found elsewhere in struct sock, unlike the uid of the
+// process, which is usually 0.
+const (
+	guessUIDValue  uint32 = 0x7a3c1e5d
+	guessMarkValue uint32 = 0x5e1f0a7b
+)
+
+// setfsuid changes the filesystem uid of the current thread, which must be
+// locked, and returns the previous one. Sockets are owned by the filesystem
+// uid of their creator.
+//
+// The Go runtime doesn't clone new threads from a locked thread, so the
+// change doesn't leak to other goroutines.
+func setfsuid(uid uint32) uint32 {
+	prev, _, _ := syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+	return uint32(prev)
+}
+
+// setMark sets SO_MARK on the sockets of a net.Dialer. This requires
+// CAP_NET_ADMIN.
+func setMark(mark uint32) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+		})
+		if err != nil {
+			return err
+		}
+		if serr != nil {
+			return fmt.Errorf("error setting SO_MARK: %v", serr)
+		}
+		return nil
+	}
+}
+
+// bindToDevice sets SO_BINDTODEVICE on the sockets of a net.Dialer. This
+// requires CAP_NET_RAW.
+func bindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.BindToDevice(int(fd), name)
+		})
+		if err != nil {
+			return err
+		}
+		if serr != nil {
+			return fmt.Errorf("error setting SO_BINDTODEVICE: %v", serr)
+		}
+		return nil
+	}
+}
+
+// socketIno returns the inode of the socket of conn.
+func socketIno(conn net.Conn) (uint64, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, fmt.Errorf("not a tcp connection unexpectedly")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var s syscall.Stat_t
+	var serr error
+	if err := rawConn.Control(func(fd uintptr) {
+		serr = syscall.Fstat(int(fd), &s)
+	}); err != nil {
+		return 0, err
+	}
+	return s.Ino, serr
+}
+
+// matchProtocol looks for IPPROTO_TCP in the 4 bytes read at the offset
+// being guessed for sk_protocol and returns its position in them. sk_type,
+// SOCK_STREAM, is next to it: before it since Linux 5.6, where both are u16,
+// and after it in the bitfield used by older kernels.
+func matchProtocol(window uint32) (uint64, bool) {
+	var b [4]byte
+	nativeEndian.PutUint32(b[:], window)
+	switch {
+	case b[0] == syscall.SOCK_STREAM && b[1] == 0 && b[2] == syscall.IPPROTO_TCP && b[3] == 0:
+		return 2, true
+	case b[1] == syscall.IPPROTO_TCP && b[2] == syscall.SOCK_STREAM && b[3] == 0:
+		return 1, true
+	default:
+		return 0, false
+	}
+}
+
+// privilegedFields are the fields of struct sock whose guessing connections
+// need privileges: CAP_SETUID for setfsuid(), CAP_NET_ADMIN for SO_MARK and
+// CAP_NET_RAW for SO_BINDTODEVICE.
+var privilegedFields = []uint64{guessUID, guessMark, guessBoundDevIf}
+
+// unavailableFields returns the privileged fields that can't be guessed, as
+// a mask of 1 << guess*. The current thread must be locked.
+func unavailableFields() uint64 {
+	var mask uint64
+	// setfsuid() doesn't report errors, check whether the change happened
+	prev := setfsuid(guessUIDValue)
+	if setfsuid(prev) != guessUIDValue {
+		mask |= 1 << guessUID
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return mask | 1<<guessMark | 1<<guessBoundDevIf
+	}
+	defer syscall.Close(fd)
+	if syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(guessMarkValue)) != nil {
+		mask |= 1 << guessMark
+	}
+	if syscall.BindToDevice(fd, loopbackInterface) != nil {
+		mask |= 1 << guessBoundDevIf
+	}
+	return mask
+}
+
+// unavailableFieldNames returns the names of the fields in mask.
+func unavailableFieldNames(mask uint64) []string {
+	var names []string
+	for _, what := range privilegedFields {
+		if mask&(1<<what) != 0 {
+			names = append(names, whatString[what])
+		}
+	}
+	return names
+}
+
+// startSockField starts guessing what, or the next field if it is
+// unavailable.
+func startSockField(status *tcpTracerStatus, what uint64) {
+	// the privileged fields are guessed one after the other, and followed
+	// by the socket inode
+	for status.Unavailable&(1<<what) != 0 {
+		what++
+	}
+	status.What = what
+	switch what {
+	case guessBoundDevIf:
+		// skc_bound_dev_if follows skc_state in struct sock_common
+		status.OffsetBoundDevIf = status.OffsetState + 1
+	case guessSocketIno:
+		// sk_socket is in struct sock, after struct sock_common
+		status.OffsetSocket = status.OffsetSaddrIPv6 + 16
+		status.OffsetSocketIno = 0
+	}
+}
+
+// startIPv6Source starts guessing the IPv6 source address, if loopback is
+// true. Without a server on the IPv6 loopback address, e.g. because IPv6 is
+// disabled, the source address is assumed to follow the destination address,
+// as skc_v6_rcv_saddr follows skc_v6_daddr in struct sock_common, and the
+// source port to be the IPv4 one, inet_sport being in struct inet_sock.
+func startIPv6Source(status *tcpTracerStatus, loopback bool) {
+	if loopback {
+		status.What = guessSaddrIPv6
+		status.OffsetSaddrIPv6 = 0
+		return
+	}
+	status.OffsetSaddrIPv6 = status.OffsetDaddrIPv6 + 16
+	status.OffsetSportIPv6 = status.OffsetSport
+	guessSockFields(status)
+}
+
+// guessSockFields starts guessing the fields of struct sock that are not
+// part of the tuple.
+func guessSockFields(status *tcpTracerStatus) {
+	status.What = guessState
+	// skc_state follows skc_family, which holds AF_INET == TCP_SYN_SENT
+	status.OffsetState = status.OffsetFamily + 1
 }
 
-func startServer() (chan struct{}, uint16, error) {
+// loopbackInterface is the interface the guessing connection for
+// sk_bound_dev_if is bound to.
+const loopbackInterface = "lo"
+
+// ipv6Loopback is the source and destination address of the IPv6 guessing
+// connections for the source address.
+const ipv6Loopback = "::1"
+
+func startServer(network, listenIP string, listenPort uint16) (chan struct{}, uint16, error) {
 	// port 0 means we let the kernel choose a free port
-	addr := fmt.Sprintf("%s:0", listenIP)
-	l, err := net.Listen("tcp4", addr)
+	addr := net.JoinHostPort(listenIP, strconv.Itoa(int(listenPort)))
+	l, err := net.Listen(network, addr)
 	if err != nil {
 		return nil, 0, err
 	}
-	lport, err := strconv.Atoi(strings.Split(l.Addr().String(), ":")[1])
+	lport, err := strconv.Atoi(portOf(l.Addr()))
 	if err != nil {
+		l.Close()
 		return nil, 0, err
 	}
 
 	stop := make(chan struct{})
-	go acceptV4(l, stop)
+	go acceptConns(l, stop)
 
 	return stop, uint16(lport), nil
 }
 
-func acceptV4(l net.Listener, stop chan struct{}) {
+func acceptConns(l net.Listener, stop chan struct{}) {
 	for {
 		_, ok := <-stop
 		if ok {
@@ -126,23 +550,82 @@ func acceptV4(l net.Listener, stop chan struct{}) {
 	}
 }
 
-func compareIPv6(a [4]C.__u32, b [4]uint32) bool {
-	for i := 0; i < 4; i++ {
-		if a[i] != C.__u32(b[i]) {
-			return false
-		}
+func compareIPv6(a [4]uint32, b [4]uint32) bool {
+	return a == b
+}
+
+func ipv6ToUint32Arr(ip net.IP) (addr [4]uint32) {
+	ip = ip.To16()
+	for i := range addr {
+		addr[i] = nativeEndian.Uint32(ip[i*4 : i*4+4])
 	}
-	return true
+	return
 }
 
+// ownNetNS returns the network namespace of the current thread, which must
+// be locked.
 func ownNetNS() (uint64, error) {
 	var s syscall.Stat_t
-	if err := syscall.Stat("/proc/self/ns/net", &s); err != nil {
+	path := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), syscall.Gettid())
+	if err := syscall.Stat(path, &s); err != nil {
 		return 0, err
 	}
 	return s.Ino, nil
 }
 
+// ifreqFlags is struct ifreq as used by the SIOCGIFFLAGS and SIOCSIFFLAGS
+// ioctls.
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+func setLinkUp(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr ifreqFlags
+	copy(ifr.name[:], name)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// runInPrivateNetNS runs f on a dedicated OS thread moved to a new network
+// namespace where only the loopback interface is up.
+func runInPrivateNetNS(f func() error) error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		// The thread is never unlocked: the Go runtime terminates it when
+		// the goroutine exits instead of reusing it in the wrong network
+		// namespace. The namespace itself goes away with its last socket.
+		runtime.LockOSThread()
+
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			errChan <- fmt.Errorf("error creating network namespace: %v", err)
+			return
+		}
+		if err := setLinkUp("lo"); err != nil {
+			errChan <- fmt.Errorf("error setting up loopback interface: %v", err)
+			return
+		}
+
+		errChan <- f()
+	}()
+
+	return <-errChan
+}
+
 func ipv6FromUint32Arr(ipv6Addr [4]uint32) net.IP {
 	buf := make([]byte, 16)
 	for i := 0; i < 16; i++ {
@@ -172,23 +655,80 @@ func generateRandomIPv6Address() (addr [4]uint32) {
 	return
 }
 
+// dialLoopbackIPv6 connects to the IPv6 loopback server and returns the
+// source port of the connection.
+func dialLoopbackIPv6(ctx context.Context, cfg *GuessConfig, port uint16, stop chan struct{}) (uint16, error) {
+	select {
+	case stop <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP(ipv6Loopback)},
+		Timeout:   cfg.IPv6DialTimeout,
+	}
+	addr := net.JoinHostPort(ipv6Loopback, strconv.Itoa(int(port)))
+	conn, err := dialer.DialContext(ctx, "tcp6", addr)
+	if err != nil {
+		return 0, fmt.Errorf("error dialing %q: %v", addr, err)
+	}
+	defer conn.Close()
+
+	sport, err := strconv.Atoi(portOf(conn.LocalAddr()))
+	if err != nil {
+		return 0, fmt.Errorf("error converting source port: %v", err)
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	return uint16(sport), nil
+}
+
 // tryCurrentOffset creates a IPv4 or IPv6 connection so the corresponding
 // tcp_v{4,6}_connect kprobes get triggered and save the value at the current
 // offset in the eBPF map
-func tryCurrentOffset(module *elf.Module, mp *elf.Map, status *tcpTracerStatus, expected *fieldValues, stop chan struct{}) error {
-	// for ipv6, we don't need the source port because we already guessed
-	// it doing ipv4 connections so we use a random destination address and
-	// try to connect to it
+func tryCurrentOffset(ctx context.Context, cfg *GuessConfig, status *tcpTracerStatus, expected *fieldValues, stop, stopIPv6 chan struct{}) error {
+	if status.What == guessSaddrIPv6 || status.What == guessSportIPv6 {
+		// the source address and port are guessed with a real
+		// connection over the IPv6 loopback interface
+		sport, err := dialLoopbackIPv6(ctx, cfg, expected.dportIPv6, stopIPv6)
+		if err != nil {
+			return err
+		}
+		expected.sportIPv6 = sport
+		return nil
+	}
+
+	// for the ipv6 destination address, we don't need the source port
+	// because we already guessed it doing ipv4 connections so we use a
+	// random destination address and try to connect to it
 	expected.daddrIPv6 = generateRandomIPv6Address()
 
 	ip := ipv6FromUint32Arr(expected.daddrIPv6)
 
-	bindAddress := fmt.Sprintf("%s:%d", listenIP, expected.dport)
-	if status.what != guessDaddrIPv6 {
+	bindAddress := fmt.Sprintf("%s:%d", cfg.ListenIP, expected.dport)
+	if status.What != guessDaddrIPv6 {
 		// signal the server that we're about to connect, this will block until
 		// the channel is free so we don't overload the server
-		stop <- struct{}{}
-		conn, err := net.Dial("tcp4", bindAddress)
+		select {
+		case stop <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		dialer := net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: net.ParseIP(cfg.SourceIP)},
+		}
+		switch status.What {
+		case guessUID:
+			// unavailableFields() checked that the change happens
+			prev := setfsuid(guessUIDValue)
+			defer setfsuid(prev)
+		case guessMark:
+			dialer.Control = setMark(expected.mark)
+		case guessBoundDevIf:
+			dialer.Control = bindToDevice(loopbackInterface)
+		}
+		conn, err := dialer.DialContext(ctx, "tcp4", bindAddress)
 		if err != nil {
 			return fmt.Errorf("error dialing %q: %v", bindAddress, err)
 		}
@@ -201,6 +741,12 @@ func tryCurrentOffset(module *elf.Module, mp *elf.Map, status *tcpTracerStatus,
 
 		expected.sport = uint16(sport)
 
+		if status.What == guessSocketIno {
+			if expected.socketIno, err = socketIno(conn); err != nil {
+				return fmt.Errorf("error getting socket inode: %v", err)
+			}
+		}
+
 		// set SO_LINGER to 0 so the connection state after closing is
 		// CLOSE instead of TIME_WAIT. In this way, they will disappear
 		// from the conntrack table after around 10 seconds instead of 2
@@ -213,7 +759,10 @@ func tryCurrentOffset(module *elf.Module, mp *elf.Map, status *tcpTracerStatus,
 
 		conn.Close()
 	} else {
-		conn, err := net.DialTimeout("tcp6", fmt.Sprintf("[%s]:9092", ip), 10*time.Millisecond)
+		dialer := net.Dialer{
+			Timeout: cfg.IPv6DialTimeout,
+		}
+		conn, err := dialer.DialContext(ctx, "tcp6", net.JoinHostPort(ip.String(), strconv.Itoa(int(cfg.IPv6Port))))
 		// Since we connect to a random IP, this will most likely fail.
 		// In the unlikely case where it connects successfully, we close
 		// the connection to avoid a leak.
@@ -228,92 +777,168 @@ func tryCurrentOffset(module *elf.Module, mp *elf.Map, status *tcpTracerStatus,
 // checkAndUpdateCurrentOffset checks the value for the current offset stored
 // in the eBPF map against the expected value, incrementing the offset if it
 // doesn't match, or going to the next field to guess if it does
-func checkAndUpdateCurrentOffset(module *elf.Module, mp *elf.Map, status *tcpTracerStatus, expected *fieldValues, maxRetries *int) error {
+func checkAndUpdateCurrentOffset(ctx context.Context, cfg *GuessConfig, module *elf.Module, mp *elf.Map, status *tcpTracerStatus, expected *fieldValues, skips offsetSkips, maxRetries *int) error {
 	// get the updated map value so we can check if the current offset is
 	// the right one
-	if err := module.LookupElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(status)); err != nil {
+	if err := lookupStatus(module, mp, status); err != nil {
 		return fmt.Errorf("error reading tcptracer_status: %v", err)
 	}
 
-	if status.state != stateChecked {
+	if status.State != stateChecked {
 		if *maxRetries == 0 {
-			return fmt.Errorf("invalid guessing state while guessing %v, got %v expected %v",
-				whatString[status.what], stateString[status.state], stateString[stateChecked])
+			return newGuessError(status, ErrKretprobeMissed)
 		} else {
 			*maxRetries--
-			time.Sleep(10 * time.Millisecond)
+			select {
+			case <-time.After(cfg.RetryInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 			return nil
 		}
 	}
 
-	switch status.what {
+	switch status.What {
 	case guessSaddr:
-		if status.saddr == C.__u32(expected.saddr) {
-			status.what = guessDaddr
+		if status.Saddr == expected.saddr && !skips.has(status) {
+			status.What = guessDaddr
 		} else {
-			status.offset_saddr++
-			status.saddr = C.__u32(expected.saddr)
+			status.OffsetSaddr++
+			status.Saddr = expected.saddr
 		}
-		status.state = stateChecking
+		status.State = stateChecking
 	case guessDaddr:
-		if status.daddr == C.__u32(expected.daddr) {
-			status.what = guessFamily
+		if status.Daddr == expected.daddr && !skips.has(status) {
+			status.What = guessFamily
 		} else {
-			status.offset_daddr++
-			status.daddr = C.__u32(expected.daddr)
+			status.OffsetDaddr++
+			status.Daddr = expected.daddr
 		}
-		status.state = stateChecking
+		status.State = stateChecking
 	case guessFamily:
-		if status.family == C.__u16(expected.family) {
-			status.what = guessSport
+		if status.Family == expected.family && !skips.has(status) {
+			status.What = guessSport
 			// we know the sport ((struct inet_sock)->inet_sport) is
 			// after the family field, so we start from there
-			status.offset_sport = status.offset_family
+			status.OffsetSport = status.OffsetFamily
 		} else {
-			status.offset_family++
+			status.OffsetFamily++
 		}
-		status.state = stateChecking
+		status.State = stateChecking
 	case guessSport:
-		if status.sport == C.__u16(htons(expected.sport)) {
-			status.what = guessDport
+		if status.Sport == htons(expected.sport) && !skips.has(status) {
+			status.What = guessDport
 		} else {
-			status.offset_sport++
+			status.OffsetSport++
 		}
-		status.state = stateChecking
+		status.State = stateChecking
 	case guessDport:
-		if status.dport == C.__u16(htons(expected.dport)) {
-			status.what = guessNetns
+		if status.Dport == htons(expected.dport) && !skips.has(status) {
+			status.What = guessNetns
 		} else {
-			status.offset_dport++
+			status.OffsetDport++
 		}
-		status.state = stateChecking
+		status.State = stateChecking
 	case guessNetns:
-		if status.netns == C.__u32(expected.netns) {
-			status.what = guessDaddrIPv6
+		if status.Netns == expected.netns && !skips.has(status) {
+			status.What = guessDaddrIPv6
 		} else {
-			status.offset_ino++
+			status.OffsetIno++
 			// go to the next offset_netns if we get an error
-			if status.err != 0 || status.offset_ino >= threshold {
-				status.offset_ino = 0
-				status.offset_netns++
+			if status.Err != 0 || status.OffsetIno >= cfg.Threshold {
+				status.OffsetIno = 0
+				status.OffsetNetns++
 			}
 		}
-		status.state = stateChecking
+		status.State = stateChecking
 	case guessDaddrIPv6:
-		if compareIPv6(status.daddr_ipv6, expected.daddrIPv6) {
+		if compareIPv6(status.DaddrIPv6, expected.daddrIPv6) && !skips.has(status) {
+			startIPv6Source(status, expected.dportIPv6 != 0)
+		} else {
+			status.OffsetDaddrIPv6++
+		}
+		status.State = stateChecking
+	case guessSaddrIPv6:
+		// the destination address is ::1 too, so its offset is not a
+		// candidate
+		if compareIPv6(status.SaddrIPv6, expected.saddrIPv6) &&
+			status.OffsetSaddrIPv6 != status.OffsetDaddrIPv6 && !skips.has(status) {
+			status.What = guessSportIPv6
+			// inet_sport is in struct inet_sock, which IPv6
+			// sockets embed too, so start from the IPv4 offset
+			status.OffsetSportIPv6 = status.OffsetSport
+		} else {
+			status.OffsetSaddrIPv6++
+		}
+		status.State = stateChecking
+	case guessSportIPv6:
+		if status.SportIPv6 == htons(expected.sportIPv6) && !skips.has(status) {
+			guessSockFields(status)
+		} else {
+			status.OffsetSportIPv6++
+		}
+		status.State = stateChecking
+	case guessState:
+		if status.TCPState == expected.tcpState && !skips.has(status) {
+			status.What = guessProtocol
+			// sk_protocol is in struct sock, after struct
+			// sock_common which ends with the IPv6 addresses
+			status.OffsetProtocol = status.OffsetSaddrIPv6 + 16
+		} else {
+			status.OffsetState++
+		}
+		status.State = stateChecking
+	case guessProtocol:
+		if delta, ok := matchProtocol(status.Protocol); ok && !skips.has(status) {
+			status.OffsetProtocol += delta
+			startSockField(status, guessUID)
+		} else {
+			status.OffsetProtocol++
+		}
+		status.State = stateChecking
+	case guessUID:
+		if status.UID == expected.uid && !skips.has(status) {
+			startSockField(status, guessMark)
+		} else {
+			status.OffsetUID++
+		}
+		status.State = stateChecking
+	case guessMark:
+		if status.Mark == expected.mark && !skips.has(status) {
+			startSockField(status, guessBoundDevIf)
+		} else {
+			status.OffsetMark++
+		}
+		status.State = stateChecking
+	case guessBoundDevIf:
+		// the index of the loopback interface is small, so make sure
+		// at least that the offset is aligned for an int
+		if status.BoundDevIf == expected.boundDevIf && status.OffsetBoundDevIf%4 == 0 && !skips.has(status) {
+			startSockField(status, guessSocketIno)
+		} else {
+			status.OffsetBoundDevIf++
+		}
+		status.State = stateChecking
+	case guessSocketIno:
+		if status.SocketIno == expected.socketIno && !skips.has(status) {
 			// at this point, we've guessed all the offsets we need,
 			// set the status to "stateReady"
-			status.state = stateReady
+			status.State = stateReady
 		} else {
-			status.offset_daddr_ipv6++
-			status.state = stateChecking
+			status.OffsetSocketIno++
+			// go to the next offset_socket if we get an error
+			if status.Err != 0 || status.OffsetSocketIno >= cfg.Threshold {
+				status.OffsetSocketIno = 0
+				status.OffsetSocket++
+			}
+			status.State = stateChecking
 		}
 	default:
-		return fmt.Errorf("unexpected field to guess: %v", whatString[status.what])
+		return newGuessError(status, fmt.Errorf("unexpected field to guess"))
 	}
 
 	// update the map with the new offset/field to check
-	if err := module.UpdateElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(status), 0); err != nil {
+	if err := updateStatus(module, mp, status); err != nil {
 		return fmt.Errorf("error updating tcptracer_status: %v", err)
 	}
 
@@ -334,12 +959,41 @@ func checkAndUpdateCurrentOffset(module *elf.Module, mp *elf.Map, status *tcpTra
 // check that value against the expected value of the field, advancing the
 // offset and repeating the process until we find the value we expect. Then, we
 // guess the next field.
-func guess(b *elf.Module) error {
-	currentNetns, err := ownNetNS()
-	if err != nil {
-		return fmt.Errorf("error getting current netns: %v", err)
+//
+// The IPv6 source address and port are guessed with connections from ::1 to
+// a server listening on ::1. If IPv6 is disabled, the source address is
+// assumed to follow the destination address and the source port to be the
+// IPv4 one. The socket state, protocol, uid, mark, bound device and inode
+// are guessed last, the guessing connections being made with a distinctive
+// filesystem uid, SO_MARK and SO_BINDTODEVICE for the uid, mark and bound
+// device. Those that need privileges the process
+// doesn't have are not guessed, see Tracer.UnavailableFields.
+//
+// If cfg.PrivateNetNS is set, the connections are made from a throwaway
+// network namespace, so that they don't depend on the firewall rules of the
+// current one and don't show up in its connection events.
+//
+// Guessing stops when ctx is done or after cfg.Timeout, returning the context
+// error. Other failures are reported with a *GuessError.
+//
+// If restart is not nil, the offsets are guessed again from restart.what,
+// even if they are already known.
+func guess(ctx context.Context, b *elf.Module, cfg GuessConfig, restart *guessRestart) error {
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	if cfg.PrivateNetNS {
+		return runInPrivateNetNS(func() error {
+			return guessOffsets(ctx, b, &cfg, restart)
+		})
 	}
+	return guessOffsets(ctx, b, &cfg, restart)
+}
 
+func guessOffsets(ctx context.Context, b *elf.Module, cfg *GuessConfig, restart *guessRestart) error {
 	mp := b.Map("tcptracer_status")
 
 	// pid & tid must not change during the guessing work: the communication
@@ -347,65 +1001,132 @@ func guess(b *elf.Module) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
+	currentNetns, err := ownNetNS()
+	if err != nil {
+		return fmt.Errorf("error getting current netns: %v", err)
+	}
+
 	pidTgid := uint64(os.Getpid())<<32 | uint64(syscall.Gettid())
 
-	status := &tcpTracerStatus{
-		state:    stateChecking,
-		pid_tgid: C.__u64(pidTgid),
-	}
+	status := &tcpTracerStatus{}
+	skips := make(offsetSkips)
 
 	// if we already have the offsets, just return
-	err = b.LookupElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(status))
-	if err == nil && status.state == stateReady {
-		return nil
+	err = lookupStatus(b, mp, status)
+	if err == nil && status.State == stateReady {
+		if restart == nil {
+			return nil
+		}
+
+		// restart from the wrong offset, keeping the ones before
+		skips = restart.skips
+		status.What = restart.what
+		skips.add(status)
+		skipCurrentOffset(status)
+		status.State = stateChecking
+		status.PidTgid = pidTgid
+	} else {
+		var key [8]byte
+		if _, err := crand.Read(key[:]); err != nil {
+			return fmt.Errorf("error generating socket id key: %v", err)
+		}
+		status = &tcpTracerStatus{
+			State:       stateChecking,
+			PidTgid:     pidTgid,
+			SockIDKey:   nativeEndian.Uint64(key[:]),
+			Unavailable: unavailableFields(),
+		}
+		// the TCP statistics and the AF_UNIX sockets are optional,
+		// leave them disabled if the kernel has no BTF
+		if cfg.BTFPath != "" {
+			_ = setBTFOffsets(status, cfg.BTFPath)
+		}
 	}
 
-	stop, listenPort, err := startServer()
+	saddr := net.ParseIP(cfg.SourceIP).To4()
+	if saddr == nil {
+		return fmt.Errorf("invalid source IPv4 address %q", cfg.SourceIP)
+	}
+	daddr := net.ParseIP(cfg.ListenIP).To4()
+	if daddr == nil {
+		return fmt.Errorf("invalid listen IPv4 address %q", cfg.ListenIP)
+	}
+
+	lo, err := net.InterfaceByName(loopbackInterface)
+	if err != nil {
+		return fmt.Errorf("error getting loopback interface: %v", err)
+	}
+
+	stop, listenPort, err := startServer("tcp4", cfg.ListenIP, cfg.ListenPort)
 	if err != nil {
 		return err
 	}
 	defer close(stop)
 
+	// the IPv6 source address and port are guessed with connections over
+	// the IPv6 loopback interface, if it is available, see
+	// startIPv6Source
+	stopIPv6, listenPortIPv6, err := startServer("tcp6", ipv6Loopback, 0)
+	if err == nil {
+		defer close(stopIPv6)
+	}
+
 	// initialize map
-	if err := b.UpdateElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(status), 0); err != nil {
+	if err := updateStatus(b, mp, status); err != nil {
 		return fmt.Errorf("error initializing tcptracer_status map: %v", err)
 	}
 
 	expected := &fieldValues{
-		// 127.0.0.1
-		saddr: 0x0100007F,
-		// 127.0.0.2
-		daddr: 0x0200007F,
+		// addresses are stored in network byte order in the kernel
+		saddr: nativeEndian.Uint32(saddr),
+		daddr: nativeEndian.Uint32(daddr),
 		// will be set later
 		sport:  0,
 		dport:  listenPort,
 		netns:  uint32(currentNetns),
 		family: syscall.AF_INET,
+
+		saddrIPv6: ipv6ToUint32Arr(net.ParseIP(ipv6Loopback)),
+		dportIPv6: listenPortIPv6,
+
+		// the state after tcp_v4_connect(), the SYN-ACK is processed
+		// once connect() releases the socket
+		tcpState: uint8(TCPSynSent),
+		uid:      guessUIDValue,
+		mark:     guessMarkValue,
+
+		boundDevIf: uint32(lo.Index),
 	}
 
 	// if the kretprobe for tcp_v4_connect() is configured with a too-low
 	// maxactive, some kretprobe might be missing. In this case, we detect
 	// it and try again.
 	// See https://github.com/weaveworks/tcptracer-bpf/issues/24
-	var maxRetries int = 100
+	maxRetries := cfg.Retries
+
+	for status.State != stateReady {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-	for status.state != stateReady {
-		if err := tryCurrentOffset(b, mp, status, expected, stop); err != nil {
+		if err := tryCurrentOffset(ctx, cfg, status, expected, stop, stopIPv6); err != nil {
 			return err
 		}
 
-		if err := checkAndUpdateCurrentOffset(b, mp, status, expected, &maxRetries); err != nil {
+		if err := checkAndUpdateCurrentOffset(ctx, cfg, b, mp, status, expected, skips, &maxRetries); err != nil {
 			return err
 		}
 
 		// Stop at a reasonable offset so we don't run forever.
-		// Reading too far away in kernel memory is not a big deal:
-		// probe_kernel_read() handles faults gracefully.
-		if status.offset_saddr >= threshold || status.offset_daddr >= threshold ||
-			status.offset_sport >= thresholdInetSock || status.offset_dport >= threshold ||
-			status.offset_netns >= threshold || status.offset_family >= threshold ||
-			status.offset_daddr_ipv6 >= threshold {
-			return fmt.Errorf("overflow while guessing %v, bailing out", whatString[status.what])
+		if status.OffsetSaddr >= cfg.Threshold || status.OffsetDaddr >= cfg.Threshold ||
+			status.OffsetSport >= cfg.ThresholdInetSock || status.OffsetDport >= cfg.Threshold ||
+			status.OffsetNetns >= cfg.Threshold || status.OffsetFamily >= cfg.Threshold ||
+			status.OffsetDaddrIPv6 >= cfg.Threshold || status.OffsetSaddrIPv6 >= cfg.Threshold ||
+			status.OffsetState >= cfg.Threshold || status.OffsetProtocol >= cfg.ThresholdInetSock ||
+			status.OffsetUID >= cfg.ThresholdInetSock || status.OffsetMark >= cfg.ThresholdInetSock ||
+			status.OffsetBoundDevIf >= cfg.Threshold || status.OffsetSocket >= cfg.ThresholdInetSock ||
+			status.OffsetSportIPv6 >= cfg.ThresholdInetSock {
+			return newGuessError(status, nil)
 		}
 	}
 
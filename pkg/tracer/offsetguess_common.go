@@ -0,0 +1,129 @@
+package tracer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// GuessConfig configures how the struct sock offsets are guessed.
+type GuessConfig struct {
+	// Timeout bounds the whole guessing. Zero means no timeout.
+	Timeout time.Duration
+	// Retries is the number of times the guessing status is polled again
+	// when the eBPF program didn't update it, for example because a
+	// kretprobe was missed.
+	Retries int
+	// RetryInterval is the time to wait between those polls.
+	RetryInterval time.Duration
+
+	// SourceIP is the local IPv4 address of the guessing connections.
+	SourceIP string
+	// ListenIP is the IPv4 address of the server the guessing connections
+	// are made to.
+	ListenIP string
+	// ListenPort is the port of that server. Zero lets the kernel choose a
+	// free port.
+	ListenPort uint16
+	// IPv6Port is the destination port of the IPv6 guessing connections,
+	// made to random unreachable addresses.
+	IPv6Port uint16
+	// IPv6DialTimeout bounds each of those IPv6 connection attempts.
+	IPv6DialTimeout time.Duration
+
+	// Threshold is the offset after which the guessing of a field gives up.
+	// Reading too far away in kernel memory is not a big deal:
+	// probe_kernel_read() handles faults gracefully.
+	Threshold uint64
+	// ThresholdInetSock is the threshold for the fields of struct
+	// inet_sock, such as the source port, and for the fields of struct
+	// sock after struct sock_common, such as the uid, which are much
+	// further away.
+	ThresholdInetSock uint64
+
+	// BTFPath is the kernel BTF type information used to find the offsets
+	// of the TCP statistics reported on close, which are not guessed.
+	// The statistics are not reported if it is empty or cannot be read.
+	BTFPath string
+
+	// PrivateNetNS makes the guessing connections from a throwaway network
+	// namespace instead of the current one. This requires CAP_SYS_ADMIN.
+	PrivateNetNS bool
+
+	// Verify checks the guessed offsets once the tracer is started, by
+	// making a few IPv4 and IPv6 connections and comparing their events
+	// with the expected values. When a field is wrong, its offset is
+	// guessed again, skipping the offsets that failed.
+	Verify bool
+	// VerifyConnections is the number of connections made per address
+	// family for each verification.
+	VerifyConnections int
+	// VerifyTimeout is how long to wait for the event of a verification
+	// connection.
+	VerifyTimeout time.Duration
+	// VerifyAttempts is the maximum number of times the offsets are guessed
+	// again after a failed verification.
+	VerifyAttempts int
+}
+
+// DefaultGuessConfig returns the configuration used by NewTracer.
+func DefaultGuessConfig() GuessConfig {
+	return GuessConfig{
+		Retries:           100,
+		RetryInterval:     10 * time.Millisecond,
+		SourceIP:          "127.0.0.1",
+		ListenIP:          "127.0.0.2",
+		IPv6Port:          9092,
+		IPv6DialTimeout:   10 * time.Millisecond,
+		Threshold:         400,
+		ThresholdInetSock: 2000,
+		BTFPath:           "/sys/kernel/btf/vmlinux",
+		VerifyConnections: 2,
+		VerifyTimeout:     time.Second,
+		VerifyAttempts:    3,
+	}
+}
+
+// VerificationResult is the outcome of the verification of the guessed
+// offsets. See GuessConfig.Verify.
+type VerificationResult struct {
+	// Done is false while the verification is running, or if it is
+	// disabled.
+	Done bool
+	// Verified is true if the events of all the verification connections
+	// matched the expected values.
+	Verified bool
+	// Mismatches lists the fields found wrong, in order, e.g.
+	// "source port".
+	Mismatches []string
+	// Reguessed is the number of times the offsets were guessed again.
+	Reguessed int
+	// Err is set if the verification could not complete.
+	Err error
+}
+
+// ErrKretprobeMissed is returned when the eBPF program didn't report the
+// value of the current offset after all the retries. This usually means
+// that kretprobes are missed because too many instances of the probed
+// functions are running.
+// See https://github.com/weaveworks/tcptracer-bpf/issues/24
+var ErrKretprobeMissed = errors.New("kretprobe missed")
+
+// GuessError is returned when the offset of a field could not be guessed.
+type GuessError struct {
+	Field  string // the field being guessed, e.g. "source port"
+	Offset uint64 // the last offset tried for the field
+	State  string // the state of the guessing state machine
+	Err    error  // the underlying error, if any
+}
+
+func (e *GuessError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("error guessing %s at offset %d (state %s): %v", e.Field, e.Offset, e.State, e.Err)
+	}
+	return fmt.Sprintf("overflow while guessing %s at offset %d (state %s), bailing out", e.Field, e.Offset, e.State)
+}
+
+func (e *GuessError) Unwrap() error {
+	return e.Err
+}
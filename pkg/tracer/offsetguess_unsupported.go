@@ -3,11 +3,14 @@
 package tracer
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/iovisor/gobpf/elf"
 )
 
-func guess(b *elf.Module) error {
+type guessRestart struct{}
+
+func guess(ctx context.Context, b *elf.Module, cfg GuessConfig, restart *guessRestart) error {
 	return fmt.Errorf("not supported on non-Linux systems")
 }
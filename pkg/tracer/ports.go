@@ -0,0 +1,203 @@
+package tracer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+)
+
+// localPortRangePath is where the kernel exposes the range of ephemeral
+// ports picked by connect().
+const localPortRangePath = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// PortRange is a range of local ports, bounds included.
+type PortRange struct {
+	Low  uint16
+	High uint16
+}
+
+// Size returns the number of ports in the range.
+func (r PortRange) Size() int {
+	if r.High < r.Low {
+		return 0
+	}
+	return int(r.High) - int(r.Low) + 1
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return port >= r.Low && port <= r.High
+}
+
+// readPortRange reads ip_local_port_range. The setting is per network
+// namespace, the one of the tracer is used for all of them.
+func readPortRange() (PortRange, error) {
+	data, err := ioutil.ReadFile(localPortRangePath)
+	if err != nil {
+		return PortRange{}, err
+	}
+	return parsePortRange(string(data))
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	var r PortRange
+	if _, err := fmt.Sscan(s, &r.Low, &r.High); err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	if r.Size() == 0 {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return r, nil
+}
+
+// PortUsage is the number of ephemeral ports in use by the connections
+// towards a destination. As the source address of these connections is
+// usually the same, their source ports have to be different and connect()
+// fails once all the ports of the range are in use.
+type PortUsage struct {
+	NetNS uint32    // Network namespace ID of the connections
+	DAddr net.IP    // Remote IP address
+	DPort uint16    // Remote TCP port
+	InUse int       // Number of connections with a source port in Range
+	Range PortRange // Range of ephemeral ports, from ip_local_port_range
+}
+
+// Utilization returns the fraction of the ephemeral ports in use, between
+// 0 and 1.
+func (u PortUsage) Utilization() float64 {
+	size := u.Range.Size()
+	if size == 0 {
+		return 0
+	}
+	return float64(u.InUse) / float64(size)
+}
+
+// portDest identifies the destination of connections. IPv4 addresses are
+// IPv4-mapped, as in Event, so that IPv4 connections of IPv6 sockets are
+// counted with the others.
+type portDest struct {
+	daddr [16]byte
+	dport uint16
+	netns uint32
+}
+
+// portTracker counts the connections using an ephemeral port per
+// destination, from their connect and close events. Connections closed
+// while their events were lost stay counted, and connections in TIME_WAIT,
+// which still hold their port, are not counted.
+type portTracker struct {
+	ports     PortRange
+	threshold float64
+	cb        PortUsageCallback
+
+	mu    sync.Mutex
+	inUse map[portDest]int
+	socks map[uint64]portDest
+	// above has the destinations whose usage crossed the threshold, until
+	// it drops below it again
+	above map[portDest]bool
+}
+
+// newPortTracker creates a tracker of the ports in ports. cb is notified
+// when the usage of a destination crosses threshold, unless cb is nil or
+// threshold is 0.
+func newPortTracker(ports PortRange, threshold float64, cb PortUsageCallback) *portTracker {
+	return &portTracker{
+		ports:     ports,
+		threshold: threshold,
+		cb:        cb,
+		inUse:     make(map[portDest]int),
+		socks:     make(map[uint64]portDest),
+		above:     make(map[portDest]bool),
+	}
+}
+
+// observe updates the counts from events, notifying the callback of the
+// destinations crossing the threshold.
+func (p *portTracker) observe(events []Event) {
+	var crossed []PortUsage
+
+	p.mu.Lock()
+	for i := range events {
+		e := &events[i]
+		switch e.Type {
+		case EventConnect:
+			if !p.ports.contains(e.SPort) {
+				continue
+			}
+			if _, ok := p.socks[e.SockID]; ok {
+				continue
+			}
+			d := portDest{
+				daddr: e.DAddr,
+				dport: e.DPort,
+				netns: e.NetNS,
+			}
+			p.socks[e.SockID] = d
+			p.inUse[d]++
+			if p.checkThreshold(d) {
+				crossed = append(crossed, p.usage(d))
+			}
+		case EventClose:
+			d, ok := p.socks[e.SockID]
+			if !ok {
+				continue
+			}
+			delete(p.socks, e.SockID)
+			if p.inUse[d]--; p.inUse[d] <= 0 {
+				delete(p.inUse, d)
+			}
+			p.checkThreshold(d)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, u := range crossed {
+		p.cb.EphemeralPortThreshold(u)
+	}
+}
+
+// checkThreshold returns whether the usage of d just crossed the threshold,
+// and rearms the notification once it is below again.
+func (p *portTracker) checkThreshold(d portDest) bool {
+	if p.cb == nil || p.threshold <= 0 {
+		return false
+	}
+	if p.usage(d).Utilization() < p.threshold {
+		delete(p.above, d)
+		return false
+	}
+	if p.above[d] {
+		return false
+	}
+	p.above[d] = true
+	return true
+}
+
+func (p *portTracker) usage(d portDest) PortUsage {
+	daddr := make(net.IP, len(d.daddr))
+	copy(daddr, d.daddr[:])
+	return PortUsage{
+		NetNS: d.netns,
+		DAddr: daddr,
+		DPort: d.dport,
+		InUse: p.inUse[d],
+		Range: p.ports,
+	}
+}
+
+// snapshot returns the usage of all the destinations, the most used first.
+func (p *portTracker) snapshot() []PortUsage {
+	p.mu.Lock()
+	ret := make([]PortUsage, 0, len(p.inUse))
+	for d := range p.inUse {
+		ret = append(ret, p.usage(d))
+	}
+	p.mu.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].InUse > ret[j].InUse
+	})
+	return ret
+}
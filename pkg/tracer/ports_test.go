@@ -0,0 +1,170 @@
+package tracer
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    PortRange
+		wantErr bool
+	}{
+		{"32768\t60999\n", PortRange{32768, 60999}, false},
+		{"1024 1024", PortRange{1024, 1024}, false},
+		{"", PortRange{}, true},
+		{"32768", PortRange{}, true},
+		{"low high", PortRange{}, true},
+		{"60999 32768", PortRange{}, true},
+		{"32768 70000", PortRange{}, true},
+	} {
+		got, err := parsePortRange(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePortRange(%q): got error %v, want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parsePortRange(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func portEvent(typ EventType, sockID uint64, sport uint16, daddr string) Event {
+	e := Event{
+		Type:   typ,
+		SockID: sockID,
+		SPort:  sport,
+		DPort:  443,
+		NetNS:  testNetNS,
+	}
+	copy(e.DAddr[:], net.ParseIP(daddr).To16())
+	return e
+}
+
+func TestPortTracker(t *testing.T) {
+	// 4 ephemeral ports
+	ports := PortRange{Low: 50000, High: 50003}
+
+	for _, tt := range []struct {
+		name string
+		// events are observed one batch at a time
+		batches [][]Event
+		// inUse is the expected usage of the destinations, the most used
+		// first
+		inUse []int
+		// crossed is the number of threshold notifications
+		crossed int
+	}{
+		{
+			name:    "connect",
+			batches: [][]Event{{portEvent(EventConnect, 1, 50000, "10.0.0.1")}},
+			inUse:   []int{1},
+		},
+		{
+			name: "port outside of the range",
+			batches: [][]Event{{
+				portEvent(EventConnect, 1, 80, "10.0.0.1"),
+				portEvent(EventConnect, 2, 50004, "10.0.0.1"),
+			}},
+			inUse: []int{},
+		},
+		{
+			name: "connect and close",
+			batches: [][]Event{{
+				portEvent(EventConnect, 1, 50000, "10.0.0.1"),
+				portEvent(EventConnect, 2, 50001, "10.0.0.1"),
+				portEvent(EventClose, 1, 50000, "10.0.0.1"),
+			}},
+			inUse: []int{1},
+		},
+		{
+			name: "close of an untracked socket",
+			batches: [][]Event{{
+				portEvent(EventClose, 1, 50000, "10.0.0.1"),
+			}},
+			inUse: []int{},
+		},
+		{
+			name: "duplicate connect",
+			batches: [][]Event{{
+				portEvent(EventConnect, 1, 50000, "10.0.0.1"),
+				portEvent(EventConnect, 1, 50000, "10.0.0.1"),
+			}},
+			inUse: []int{1},
+		},
+		{
+			name: "destinations",
+			batches: [][]Event{{
+				portEvent(EventConnect, 1, 50000, "10.0.0.1"),
+				portEvent(EventConnect, 2, 50000, "10.0.0.2"),
+				portEvent(EventConnect, 3, 50001, "10.0.0.2"),
+			}},
+			inUse: []int{2, 1},
+		},
+		{
+			name: "threshold crossed once",
+			batches: [][]Event{
+				{
+					portEvent(EventConnect, 1, 50000, "10.0.0.1"),
+					portEvent(EventConnect, 2, 50001, "10.0.0.1"),
+				},
+				{portEvent(EventConnect, 3, 50002, "10.0.0.1")},
+				{portEvent(EventConnect, 4, 50003, "10.0.0.1")},
+			},
+			inUse:   []int{4},
+			crossed: 1,
+		},
+		{
+			name: "threshold crossed again",
+			batches: [][]Event{
+				{
+					portEvent(EventConnect, 1, 50000, "10.0.0.1"),
+					portEvent(EventConnect, 2, 50001, "10.0.0.1"),
+					portEvent(EventConnect, 3, 50002, "10.0.0.1"),
+				},
+				{
+					portEvent(EventClose, 1, 50000, "10.0.0.1"),
+					portEvent(EventClose, 2, 50001, "10.0.0.1"),
+				},
+				{portEvent(EventConnect, 4, 50003, "10.0.0.1")},
+				{portEvent(EventConnect, 5, 50000, "10.0.0.1")},
+			},
+			inUse:   []int{3},
+			crossed: 2,
+		},
+	} {
+		var r recorder
+		p := newPortTracker(ports, 0.75, &r)
+		for _, batch := range tt.batches {
+			p.observe(batch)
+		}
+
+		usage := p.snapshot()
+		if len(usage) != len(tt.inUse) {
+			t.Errorf("%s: got %d destinations, want %d: %+v", tt.name, len(usage), len(tt.inUse), usage)
+			continue
+		}
+		for i, u := range usage {
+			if u.InUse != tt.inUse[i] || u.Range != ports {
+				t.Errorf("%s: destination %d: got %+v, want %d ports in use", tt.name, i, u, tt.inUse[i])
+			}
+		}
+		if len(r.usages) != tt.crossed {
+			t.Errorf("%s: got %d notifications, want %d: %+v", tt.name, len(r.usages), tt.crossed, r.usages)
+		}
+		for _, u := range r.usages {
+			if u.Utilization() < 0.75 || u.DPort != 443 {
+				t.Errorf("%s: unexpected notification %+v", tt.name, u)
+			}
+		}
+	}
+}
+
+func TestPortTrackerWithoutCallback(t *testing.T) {
+	p := newPortTracker(PortRange{Low: 50000, High: 50000}, 0.5, nil)
+	p.observe([]Event{portEvent(EventConnect, 1, 50000, "10.0.0.1")})
+	if usage := p.snapshot(); len(usage) != 1 || usage[0].Utilization() != 1 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
@@ -0,0 +1,171 @@
+package tracer
+
+import (
+	"fmt"
+	"sync"
+)
+
+// QueuePolicy decides what happens to new events when the queue between the
+// perf ring buffer readers and the callback is full.
+type QueuePolicy int
+
+const (
+	// QueueBlock stops reading the perf ring buffers until the callback
+	// catches up. Events are then lost in the kernel and reported with
+	// LostV4/LostV6, or LostUnix.
+	QueueBlock QueuePolicy = iota
+	// QueueDropNewest drops the events that don't fit in the queue.
+	QueueDropNewest
+	// QueueDropOldest drops the oldest queued events to make room for new
+	// ones.
+	QueueDropOldest
+)
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case QueueBlock:
+		return "block"
+	case QueueDropNewest:
+		return "drop-newest"
+	case QueueDropOldest:
+		return "drop-oldest"
+	default:
+		return fmt.Sprintf("QueuePolicy(%d)", int(p))
+	}
+}
+
+// eventQueue is a bounded FIFO of raw perf events.
+type eventQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+
+	policy QueuePolicy
+	buf    [][]byte
+	head   int
+	count  int
+	closed bool
+
+	// lost events reported by the kernel and not yet passed to the
+	// callback
+	pendingLost uint64
+
+	// counters
+	kernelLost uint64
+	dropped    uint64
+	invalid    uint64
+}
+
+func newEventQueue(size int, policy QueuePolicy) *eventQueue {
+	if size < 1 {
+		size = 1
+	}
+	q := &eventQueue{
+		policy: policy,
+		buf:    make([][]byte, size),
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds data to the queue, applying the queue policy if it is full.
+func (q *eventQueue) push(data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.count == len(q.buf) && !q.closed {
+		switch q.policy {
+		case QueueDropNewest:
+			q.dropped++
+			return
+		case QueueDropOldest:
+			q.buf[q.head] = nil
+			q.head = (q.head + 1) % len(q.buf)
+			q.count--
+			q.dropped++
+		default:
+			q.notFull.Wait()
+		}
+	}
+	if q.closed {
+		return
+	}
+
+	q.buf[(q.head+q.count)%len(q.buf)] = data
+	q.count++
+	q.notEmpty.Signal()
+}
+
+// addLost records events lost in the kernel so they are reported to the
+// callback in order with the queued events.
+func (q *eventQueue) addLost(count uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.kernelLost += count
+	q.pendingLost += count
+	q.notEmpty.Signal()
+}
+
+// popBatch waits for events and passes up to maxBatchSize of them to
+// decode. Events that fail to decode are counted as invalid. It returns the
+// number of events lost in the kernel since the last call, and false once the
+// queue is closed.
+func (q *eventQueue) popBatch(decode func([]byte) error) (uint64, bool) {
+	q.mu.Lock()
+	for q.count == 0 && q.pendingLost == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	if q.closed {
+		q.mu.Unlock()
+		return 0, false
+	}
+
+	var batch [maxBatchSize][]byte
+	n := 0
+	for ; n < maxBatchSize && q.count > 0; n++ {
+		batch[n] = q.buf[q.head]
+		q.buf[q.head] = nil
+		q.head = (q.head + 1) % len(q.buf)
+		q.count--
+	}
+	lost := q.pendingLost
+	q.pendingLost = 0
+	q.notFull.Broadcast()
+	q.mu.Unlock()
+
+	// decode outside of the lock so the readers are not held back
+	var invalid uint64
+	for i := 0; i < n; i++ {
+		if err := decode(batch[i]); err != nil {
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		q.mu.Lock()
+		q.invalid += invalid
+		q.mu.Unlock()
+	}
+
+	return lost, true
+}
+
+// counters returns the number of events lost in the kernel, the number of
+// events dropped by the queue policy and the number of events that failed
+// to decode.
+func (q *eventQueue) counters() (kernelLost, dropped, invalid uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.kernelLost, q.dropped, q.invalid
+}
+
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
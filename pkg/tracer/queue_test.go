@@ -0,0 +1,192 @@
+// +build linux
+
+package tracer
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// popAll pops a batch from q and returns its events as strings.
+func popAll(t *testing.T, q *eventQueue) ([]string, uint64) {
+	var got []string
+	lost, ok := q.popBatch(func(data []byte) error {
+		got = append(got, string(data))
+		return nil
+	})
+	if !ok {
+		t.Fatal("queue closed unexpectedly")
+	}
+	return got, lost
+}
+
+func TestEventQueuePolicies(t *testing.T) {
+	for _, tt := range []struct {
+		policy      QueuePolicy
+		want        []string
+		wantDropped uint64
+	}{
+		{QueueDropNewest, []string{"a", "b"}, 2},
+		{QueueDropOldest, []string{"c", "d"}, 2},
+	} {
+		q := newEventQueue(2, tt.policy)
+		for _, e := range []string{"a", "b", "c", "d"} {
+			q.push([]byte(e))
+		}
+		got, _ := popAll(t, q)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got events %q, want %q", tt.policy, got, tt.want)
+		}
+		if kernelLost, dropped, invalid := q.counters(); kernelLost != 0 || dropped != tt.wantDropped || invalid != 0 {
+			t.Errorf("%v: got counters %d, %d, %d, want 0, %d, 0", tt.policy, kernelLost, dropped, invalid, tt.wantDropped)
+		}
+
+		// there is room again
+		q.push([]byte("e"))
+		if got, _ := popAll(t, q); !reflect.DeepEqual(got, []string{"e"}) {
+			t.Errorf("%v: got events %q after the batch, want [e]", tt.policy, got)
+		}
+	}
+}
+
+func TestEventQueueBlock(t *testing.T) {
+	q := newEventQueue(1, QueueBlock)
+	q.push([]byte("a"))
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push([]byte("b"))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push didn't block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if got, _ := popAll(t, q); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("got events %q, want [a]", got)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push still blocked after a batch was popped")
+	}
+	if got, _ := popAll(t, q); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("got events %q, want [b]", got)
+	}
+	if _, dropped, _ := q.counters(); dropped != 0 {
+		t.Errorf("%d events dropped with QueueBlock", dropped)
+	}
+}
+
+func TestEventQueueCloseWhileBlocked(t *testing.T) {
+	q := newEventQueue(1, QueueBlock)
+	q.push([]byte("a"))
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push([]byte("b"))
+		close(pushed)
+	}()
+
+	empty := newEventQueue(1, QueueBlock)
+	popped := make(chan bool)
+	go func() {
+		_, ok := empty.popBatch(func([]byte) error { return nil })
+		popped <- ok
+	}()
+
+	// give the goroutines the time to block
+	time.Sleep(50 * time.Millisecond)
+	q.close()
+	empty.close()
+
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push still blocked after close")
+	}
+	select {
+	case ok := <-popped:
+		if ok {
+			t.Error("popBatch returned true on a closed queue")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("popBatch still blocked after close")
+	}
+
+	// events pushed after close are ignored
+	q.push([]byte("c"))
+	if _, ok := q.popBatch(func([]byte) error { return nil }); ok {
+		t.Error("popBatch returned true on a closed queue")
+	}
+}
+
+func TestEventQueueLostAndInvalid(t *testing.T) {
+	q := newEventQueue(maxBatchSize*2, QueueBlock)
+	for i := 0; i < maxBatchSize+1; i++ {
+		q.push([]byte{byte(i)})
+	}
+	q.addLost(3)
+
+	n := 0
+	lost, _ := q.popBatch(func(data []byte) error {
+		n++
+		if data[0]%2 == 1 {
+			return errors.New("invalid event")
+		}
+		return nil
+	})
+	if n != maxBatchSize || lost != 3 {
+		t.Errorf("got %d events and %d lost, want %d and 3", n, lost, maxBatchSize)
+	}
+
+	// lost events alone wake up the reader, and are reported once
+	got, lost := popAll(t, q)
+	if len(got) != 1 || lost != 0 {
+		t.Errorf("got %d events and %d lost, want 1 and 0", len(got), lost)
+	}
+	q.addLost(2)
+	if got, lost := popAll(t, q); len(got) != 0 || lost != 2 {
+		t.Errorf("got %d events and %d lost, want 0 and 2", len(got), lost)
+	}
+
+	if kernelLost, dropped, invalid := q.counters(); kernelLost != 5 || dropped != 0 || invalid != maxBatchSize/2 {
+		t.Errorf("got counters %d, %d, %d, want 5, 0, %d", kernelLost, dropped, invalid, maxBatchSize/2)
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	tr := &Tracer{
+		queueV4: newEventQueue(1, QueueDropNewest),
+		queueV6: newEventQueue(1, QueueDropOldest),
+	}
+	for i := 0; i < 3; i++ {
+		tr.queueV4.push([]byte{1})
+	}
+	for i := 0; i < 2; i++ {
+		tr.queueV6.push([]byte{1})
+	}
+	tr.queueV6.addLost(4)
+
+	want := QueueStats{
+		KernelLostV6: 4,
+		DroppedV4:    2,
+		DroppedV6:    1,
+	}
+	if got := tr.QueueStats(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// the AF_UNIX events have their own queue when traced
+	tr.queueUnix = newEventQueue(1, QueueDropNewest)
+	tr.queueUnix.push([]byte{1})
+	tr.queueUnix.push([]byte{1})
+	want.DroppedUnix = 1
+	if got := tr.QueueStats(); got != want {
+		t.Errorf("with AF_UNIX: got %+v, want %+v", got, want)
+	}
+}
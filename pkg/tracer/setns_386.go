@@ -0,0 +1,6 @@
+// +build linux,386
+
+package tracer
+
+// The syscall package doesn't define SYS_SETNS on 386.
+const sysSetns = 346
@@ -0,0 +1,6 @@
+// +build linux,amd64
+
+package tracer
+
+// The syscall package doesn't define SYS_SETNS on amd64.
+const sysSetns = 308
@@ -0,0 +1,7 @@
+// +build linux,!amd64,!386
+
+package tracer
+
+import "syscall"
+
+const sysSetns = syscall.SYS_SETNS
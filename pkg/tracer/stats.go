@@ -0,0 +1,147 @@
+package tracer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// kprobeProfilePaths are the locations of the kprobe_profile tracing file:
+// under debugfs, where gobpf creates the kprobes, or where tracefs is mounted
+// on its own since Linux 4.1.
+var kprobeProfilePaths = []string{
+	"/sys/kernel/debug/tracing/kprobe_profile",
+	"/sys/kernel/tracing/kprobe_profile",
+}
+
+// Stats describes the health of a running Tracer.
+type Stats struct {
+	// Delivered is the number of events passed to the callback, by type.
+	Delivered map[EventType]uint64
+	// DeliveredUnix is the number of AF_UNIX socket events passed to the
+	// UnixCallback, by type.
+	DeliveredUnix map[EventType]uint64
+	// QueueStats holds the events lost in the kernel and in userspace.
+	QueueStats
+	// LostPerCPU is the number of events the eBPF programs failed to write
+	// to the perf ring buffers, by cpu.
+	LostPerCPU map[uint]CPULostStats
+	// ProbeMisses is the number of times a probe was missed, by section
+	// name (e.g. "kretprobe/tcp_v4_connect"). Kretprobes are missed when
+	// more than maxActive instances of the function run simultaneously.
+	// It is nil if the tracing file system is not mounted.
+	ProbeMisses map[string]uint64
+}
+
+// CPULostStats is the number of events lost on a cpu, by address family.
+type CPULostStats struct {
+	LostV4 uint64
+	LostV6 uint64
+	// NotReady is the number of probe hits of other processes ignored
+	// while the offsets were guessed, initially or again after a failed
+	// verification. The events they would have produced are lost.
+	NotReady uint64
+}
+
+// eventCounters counts the events delivered to the callback.
+type eventCounters struct {
+	mu     sync.Mutex
+	counts map[EventType]uint64
+}
+
+func newEventCounters() *eventCounters {
+	return &eventCounters{
+		counts: make(map[EventType]uint64),
+	}
+}
+
+func (c *eventCounters) add(events []Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range events {
+		c.counts[events[i].Type]++
+	}
+}
+
+func (c *eventCounters) addUnix(events []UnixEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range events {
+		c.counts[events[i].Type]++
+	}
+}
+
+func (c *eventCounters) snapshot() map[EventType]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := make(map[EventType]uint64, len(c.counts))
+	for t, n := range c.counts {
+		ret[t] = n
+	}
+	return ret
+}
+
+// openKprobeProfile opens the first kprobe_profile found. It returns a nil
+// file if the tracing file system is not mounted.
+func openKprobeProfile() (*os.File, error) {
+	for _, path := range kprobeProfilePaths {
+		f, err := os.Open(path)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// parseKprobeProfile reads the misses of the kprobes listed in events from
+// the kprobe_profile tracing file. events maps kprobe event names, as
+// created by gobpf, to the section names the misses are reported for.
+//
+// Each line of kprobe_profile holds the event name, the number of hits and
+// the number of misses:
+//
+//	ptcp_v4_connect                                   1234               0
+func parseKprobeProfile(r io.Reader, events map[string]string) (map[string]uint64, error) {
+	misses := make(map[string]uint64)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		secName, ok := events[fields[0]]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid misses count for %q: %v", fields[0], err)
+		}
+		misses[secName] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return misses, nil
+}
+
+// kprobeEventName returns the kprobe event name gobpf uses for a
+// kprobe/kretprobe section.
+func kprobeEventName(secName string) string {
+	if strings.HasPrefix(secName, "kretprobe/") {
+		return "r" + strings.TrimPrefix(secName, "kretprobe/")
+	}
+	return "p" + strings.TrimPrefix(secName, "kprobe/")
+}
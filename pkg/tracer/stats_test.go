@@ -0,0 +1,154 @@
+package tracer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKprobeEventName(t *testing.T) {
+	for _, tt := range []struct {
+		secName string
+		want    string
+	}{
+		{"kprobe/tcp_v4_connect", "ptcp_v4_connect"},
+		{"kretprobe/tcp_v4_connect", "rtcp_v4_connect"},
+		{"kretprobe/inet_csk_accept", "rinet_csk_accept"},
+		{"kprobe/tcp_close", "ptcp_close"},
+	} {
+		if got := kprobeEventName(tt.secName); got != tt.want {
+			t.Errorf("kprobeEventName(%q) = %q, want %q", tt.secName, got, tt.want)
+		}
+	}
+}
+
+func TestParseKprobeProfile(t *testing.T) {
+	events := map[string]string{
+		"ptcp_v4_connect":  "kprobe/tcp_v4_connect",
+		"rtcp_v4_connect":  "kretprobe/tcp_v4_connect",
+		"rinet_csk_accept": "kretprobe/inet_csk_accept",
+	}
+
+	for _, tt := range []struct {
+		name    string
+		in      string
+		want    map[string]uint64
+		wantErr bool
+	}{
+		{
+			name: "misses",
+			in: "  ptcp_v4_connect                                   1234               0\n" +
+				"  rtcp_v4_connect                                   1234               7\n" +
+				"  rinet_csk_accept                                    42               3\n",
+			want: map[string]uint64{
+				"kprobe/tcp_v4_connect":     0,
+				"kretprobe/tcp_v4_connect":  7,
+				"kretprobe/inet_csk_accept": 3,
+			},
+		},
+		{
+			// kprobes created by other programs are ignored
+			name: "unknown events",
+			in: "  p_other_tool_0                                      10              99\n" +
+				"  rtcp_v4_connect                                      5               1\n",
+			want: map[string]uint64{"kretprobe/tcp_v4_connect": 1},
+		},
+		{
+			name: "malformed lines",
+			in: "\n" +
+				"  rtcp_v4_connect\n" +
+				"  rtcp_v4_connect 1 2 3\n" +
+				"  rinet_csk_accept                                    42               3\n",
+			want: map[string]uint64{"kretprobe/inet_csk_accept": 3},
+		},
+		{
+			name: "empty",
+			in:   "",
+			want: map[string]uint64{},
+		},
+		{
+			name:    "invalid misses",
+			in:      "  rtcp_v4_connect                                   1234               x\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative misses",
+			in:      "  rtcp_v4_connect                                   1234              -1\n",
+			wantErr: true,
+		},
+	} {
+		got, err := parseKprobeProfile(strings.NewReader(tt.in), events)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOpenKprobeProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcptracer-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := kprobeProfilePaths
+	defer func() { kprobeProfilePaths = saved }()
+
+	debugfs := filepath.Join(dir, "debug", "kprobe_profile")
+	tracefs := filepath.Join(dir, "tracing", "kprobe_profile")
+	kprobeProfilePaths = []string{debugfs, tracefs}
+
+	// neither file system is mounted
+	f, err := openKprobeProfile()
+	if f != nil || err != nil {
+		t.Errorf("got %v, %v without kprobe_profile, want nil, nil", f, err)
+	}
+
+	// tracefs mounted on its own
+	if err := os.MkdirAll(filepath.Dir(tracefs), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tracefs, []byte("tracefs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assertProfile(t, "tracefs")
+
+	// debugfs comes first
+	if err := os.MkdirAll(filepath.Dir(debugfs), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(debugfs, []byte("debugfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assertProfile(t, "debugfs")
+
+	// errors other than a missing file are reported
+	kprobeProfilePaths = []string{filepath.Join(debugfs, "kprobe_profile"), tracefs}
+	if f, err := openKprobeProfile(); err == nil {
+		f.Close()
+		t.Error("no error opening a path below a regular file")
+	}
+}
+
+func assertProfile(t *testing.T, want string) {
+	t.Helper()
+	f, err := openKprobeProfile()
+	if err != nil || f == nil {
+		t.Fatalf("got %v, %v, want the %s kprobe_profile", f, err, want)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("opened the %s kprobe_profile, want the %s one", data, want)
+	}
+}
@@ -4,17 +4,35 @@ package tracer
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"log"
+	"os"
+	"strconv"
 	"unsafe"
 
 	bpflib "github.com/iovisor/gobpf/elf"
+	"github.com/iovisor/gobpf/pkg/cpuonline"
 )
 
 type Tracer struct {
 	m           *bpflib.Module
 	perfMapIPV4 *bpflib.PerfMap
 	perfMapIPV6 *bpflib.PerfMap
-	stopChan    chan struct{}
+	perfMapUnix *bpflib.PerfMap
+	queueV4     *eventQueue
+	queueV6     *eventQueue
+	// queueUnix is nil when the AF_UNIX sockets are not traced
+	queueUnix     *eventQueue
+	delivered     *eventCounters
+	deliveredUnix *eventCounters
+	verifier      *verifier
+	ports         *portTracker
+	listeners     *listenerTracker
+	aggregates    *aggregateReader
+	guessCfg      GuessConfig
+	stopChan      chan struct{}
+	cancel        context.CancelFunc
 }
 
 // maxActive configures the maximum number of instances of the probed functions
@@ -32,6 +50,27 @@ func TracerAsset() ([]byte, error) {
 }
 
 func NewTracer(cb Callback) (*Tracer, error) {
+	return NewTracerBatch(callbackAdapter{cb})
+}
+
+// NewTracerBatch creates a tracer delivering events in batches to cb.
+func NewTracerBatch(cb BatchCallback) (*Tracer, error) {
+	return NewTracerWithConfig(cb, DefaultConfig())
+}
+
+// NewTracerWithConfig creates a tracer delivering events in batches to cb,
+// configured with cfg.
+func NewTracerWithConfig(cb BatchCallback, cfg Config) (*Tracer, error) {
+	return NewTracerContext(context.Background(), cb, cfg)
+}
+
+// NewTracerContext is like NewTracerWithConfig but the guessing of the
+// kernel struct offsets is canceled when ctx is done.
+func NewTracerContext(ctx context.Context, cb BatchCallback, cfg Config) (*Tracer, error) {
+	if err := cfg.validate(cb); err != nil {
+		return nil, err
+	}
+
 	buf, err := Asset("tcptracer-ebpf.o")
 	if err != nil {
 		return nil, fmt.Errorf("couldn't find asset: %s", err)
@@ -50,24 +89,65 @@ func NewTracer(cb Callback) (*Tracer, error) {
 		return nil, err
 	}
 
-	err = m.EnableKprobes(maxActive)
+	var udp *udpTracker
+	if cfg.UDP {
+		udpCb := underlyingCallback(cb).(UDPCallback)
+		idle := cfg.UDPIdleTimeout
+		if idle <= 0 {
+			idle = DefaultConfig().UDPIdleTimeout
+		}
+		udp = newUDPTracker(udpCb, idle, func(k udpFlowKey) {
+			forgetUDPFlow(m, k)
+		})
+	}
+
+	unixCb, _ := underlyingCallback(cb).(UnixCallback)
+
+	var aggregates *aggregateReader
+	if cfg.Aggregate {
+		mp := m.Map("aggregates")
+		if mp == nil {
+			return nil, fmt.Errorf("no map with name aggregates")
+		}
+		aggregates = newAggregateReader(mp)
+	}
+
+	// the ephemeral port usage is not essential, it is not tracked if the
+	// range can't be read
+	var ports *portTracker
+	if portRange, err := readPortRange(); err != nil {
+		log.Printf("tcptracer: error reading the ephemeral port range, not tracking the port usage: %v", err)
+	} else {
+		portCb, _ := underlyingCallback(cb).(PortUsageCallback)
+		ports = newPortTracker(portRange, cfg.EphemeralPortThreshold, portCb)
+	}
+	listeners := newListenerTracker(maxListeners, func(sockID uint64, s *ListenerStats) bool {
+		return lookupListener(m, sockID, s)
+	})
+
+	err = writeConfig(m, cfg, udp, unixCb != nil)
 	if err != nil {
 		return nil, err
 	}
 
-	channelV4 := make(chan []byte)
-	channelV6 := make(chan []byte)
+	err = enableKprobes(m, udp != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	channelV4 := make(chan []byte, maxBatchSize)
+	channelV6 := make(chan []byte, maxBatchSize)
 	lostChanV4 := make(chan uint64)
 	lostChanV6 := make(chan uint64)
 
-	perfMapIPV4, err := initializeIPv4(m, channelV4, lostChanV4)
+	perfMapIPV4, err := initializeIPv4(ctx, m, cfg, channelV4, lostChanV4)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init perf map for IPv4 events: %s", err)
+		return nil, fmt.Errorf("failed to init perf map for IPv4 events: %w", err)
 	}
 
-	perfMapIPV6, err := initializeIPv6(m, channelV6, lostChanV6)
+	perfMapIPV6, err := initializeIPv6(ctx, m, cfg, channelV6, lostChanV6)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init perf map for IPv6 events: %s", err)
+		return nil, fmt.Errorf("failed to init perf map for IPv6 events: %w", err)
 	}
 
 	perfMapIPV4.SetTimestampFunc(tcpV4Timestamp)
@@ -75,58 +155,414 @@ func NewTracer(cb Callback) (*Tracer, error) {
 
 	stopChan := make(chan struct{})
 
-	go func() {
-		for {
-			select {
-			case <-stopChan:
-				// On stop, stopChan will be closed but the other channels will
-				// also be closed shortly after. The select{} has no priorities,
-				// therefore, the "ok" value must be checked below.
-				return
-			case data, ok := <-channelV4:
-				if !ok {
-					return // see explanation above
-				}
-				cb.TCPEventV4(tcpV4ToGo(&data))
-			case lost, ok := <-lostChanV4:
-				if !ok {
-					return // see explanation above
-				}
-				cb.LostV4(lost)
-			}
+	var perfMapUnix *bpflib.PerfMap
+	var queueUnix *eventQueue
+	deliveredUnix := newEventCounters()
+	if unixCb != nil {
+		channelUnix := make(chan []byte, maxBatchSize)
+		lostChanUnix := make(chan uint64)
+		perfMapUnix, err = bpflib.InitPerfMap(m, "unix_event", channelUnix, lostChanUnix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init perf map for unix socket events: %w", err)
 		}
-	}()
-
-	go func() {
-		for {
-			select {
-			case <-stopChan:
-				return
-			case data, ok := <-channelV6:
-				if !ok {
-					return // see explanation above
-				}
-				cb.TCPEventV6(tcpV6ToGo(&data))
-			case lost, ok := <-lostChanV6:
-				if !ok {
-					return // see explanation above
-				}
-				cb.LostV6(lost)
-			}
+		// the timestamp is the first field, as in the TCP events
+		perfMapUnix.SetTimestampFunc(tcpV4Timestamp)
+		queueUnix = newEventQueue(cfg.QueueSize, cfg.QueuePolicy)
+		go readPerfMap(channelUnix, lostChanUnix, queueUnix, stopChan)
+		go deliverUnixEvents(queueUnix, unixCb, deliveredUnix)
+	}
+
+	queueV4 := newEventQueue(cfg.QueueSize, cfg.QueuePolicy)
+	queueV6 := newEventQueue(cfg.QueueSize, cfg.QueuePolicy)
+
+	go readPerfMap(channelV4, lostChanV4, queueV4, stopChan)
+	go readPerfMap(channelV6, lostChanV6, queueV6, stopChan)
+
+	delivered := newEventCounters()
+	verifier := newVerifier()
+	batchCb := func(events []Event) {
+		if udp != nil {
+			events = udp.filter(events)
+		}
+		events = verifier.filter(events)
+		if len(events) == 0 {
+			return
 		}
-	}()
+		if ports != nil {
+			ports.observe(events)
+		}
+		listeners.observe(events)
+		delivered.add(events)
+		cb.TCPEventsBatch(events)
+	}
+
+	go deliverEvents(queueV4, (*eventDecoder).appendV4, batchCb, cb.LostV4)
+	go deliverEvents(queueV6, (*eventDecoder).appendV6, batchCb, cb.LostV6)
+	if udp != nil {
+		go udp.run(stopChan)
+	}
 
 	return &Tracer{
-		m:           m,
-		perfMapIPV4: perfMapIPV4,
-		perfMapIPV6: perfMapIPV6,
-		stopChan:    stopChan,
+		m:             m,
+		perfMapIPV4:   perfMapIPV4,
+		perfMapIPV6:   perfMapIPV6,
+		perfMapUnix:   perfMapUnix,
+		queueV4:       queueV4,
+		queueV6:       queueV6,
+		queueUnix:     queueUnix,
+		delivered:     delivered,
+		deliveredUnix: deliveredUnix,
+		verifier:      verifier,
+		ports:         ports,
+		listeners:     listeners,
+		aggregates:    aggregates,
+		guessCfg:      cfg.Guess,
+		stopChan:      stopChan,
 	}, nil
 }
 
+// udpKprobes are the probes tracing the UDP flows.
+var udpKprobes = map[string]bool{
+	"kprobe/udp_sendmsg":      true,
+	"kprobe/udpv6_sendmsg":    true,
+	"kprobe/udp_recvmsg":      true,
+	"kretprobe/udp_recvmsg":   true,
+	"kprobe/udpv6_recvmsg":    true,
+	"kretprobe/udpv6_recvmsg": true,
+}
+
+// enableKprobes enables the probes of m, the UDP ones only if udp is true.
+func enableKprobes(m *bpflib.Module, udp bool) error {
+	var names []string
+	for kprobe := range m.IterKprobes() {
+		if udpKprobes[kprobe.Name] && !udp {
+			continue
+		}
+		names = append(names, kprobe.Name)
+	}
+	for _, name := range names {
+		if err := m.EnableKprobe(name, maxActive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tcpTracerConfig mirrors the layout of struct tcptracer_config_t in
+// tcptracer-bpf.h.
+type tcpTracerConfig struct {
+	StateChanges uint32
+	UDP          uint32
+	UDPRefreshNs uint64
+	UnixSockets  uint32
+	Aggregate    uint32
+	SampleRate   uint32
+	RateLimit    uint32
+	RateBurst    uint32
+	_            uint32
+}
+
+// newTCPTracerConfig returns the settings of cfg used by the eBPF program.
+// UDP flows are traced if udp is not nil, AF_UNIX sockets if unix is true.
+func newTCPTracerConfig(cfg Config, udp *udpTracker, unix bool) tcpTracerConfig {
+	var c tcpTracerConfig
+	if cfg.StateChanges {
+		c.StateChanges = 1
+	}
+	if udp != nil {
+		c.UDP = 1
+		c.UDPRefreshNs = uint64(udp.refreshInterval())
+	}
+	if unix {
+		c.UnixSockets = 1
+	}
+	if cfg.Aggregate {
+		c.Aggregate = 1
+	}
+	c.SampleRate = uint32(cfg.SampleRate)
+	if cfg.RateLimit > 0 {
+		c.RateLimit = cfg.RateLimit
+		c.RateBurst = cfg.RateBurst
+		if c.RateBurst == 0 {
+			c.RateBurst = cfg.RateLimit
+		}
+	}
+	return c
+}
+
+// writeConfig passes the settings of cfg used by the eBPF program, before
+// the probes are enabled, see newTCPTracerConfig.
+func writeConfig(m *bpflib.Module, cfg Config, udp *udpTracker, unix bool) error {
+	mp := m.Map("tcptracer_config")
+	if mp == nil {
+		return fmt.Errorf("no map with name tcptracer_config")
+	}
+
+	c := newTCPTracerConfig(cfg, udp, unix)
+
+	var zero uint32
+	if err := m.UpdateElement(mp, unsafe.Pointer(&zero), unsafe.Pointer(&c), 0); err != nil {
+		return fmt.Errorf("error writing tcptracer_config: %v", err)
+	}
+	return nil
+}
+
+// ipv4Tuple and ipv6Tuple mirror the layout of struct ipv4_tuple_t and
+// struct ipv6_tuple_t in tcptracer-bpf.h.
+type ipv4Tuple struct {
+	SAddr [4]byte
+	DAddr [4]byte
+	SPort uint16
+	DPort uint16
+	NetNS uint32
+}
+
+type ipv6Tuple struct {
+	SAddr [16]byte
+	DAddr [16]byte
+	SPort uint16
+	DPort uint16
+	NetNS uint32
+}
+
+// rateLimit mirrors the layout of struct ratelimit_t in tcptracer-bpf.h.
+type rateLimit struct {
+	Tokens     uint64
+	LastNs     uint64
+	Suppressed uint64
+}
+
+// listenStats mirrors the layout of struct listen_stats_t in
+// tcptracer-bpf.h.
+type listenStats struct {
+	SynRecv        uint64
+	SynDropped     uint64
+	AckDropped     uint64
+	LastSynNs      uint64
+	LastOverflowNs uint64
+	Backlog        uint32
+	MaxBacklog     uint32
+}
+
+// forgetUDPFlow removes an expired UDP flow from the eBPF maps. The flow
+// may already be gone if it was evicted.
+func forgetUDPFlow(m *bpflib.Module, k udpFlowKey) {
+	if k.ipv6 {
+		key := ipv6Tuple{
+			SAddr: k.saddr,
+			DAddr: k.daddr,
+			SPort: k.sport,
+			DPort: k.dport,
+			NetNS: k.netns,
+		}
+		m.DeleteElement(m.Map("udpflows_ipv6"), unsafe.Pointer(&key))
+		return
+	}
+
+	key := ipv4Tuple{
+		SPort: k.sport,
+		DPort: k.dport,
+		NetNS: k.netns,
+	}
+	copy(key.SAddr[:], k.saddr[12:])
+	copy(key.DAddr[:], k.daddr[12:])
+	m.DeleteElement(m.Map("udpflows_ipv4"), unsafe.Pointer(&key))
+}
+
+// readPerfMap moves the events read by gobpf to the queue, so that a slow
+// callback doesn't hold back the perf ring buffer readers unless the queue
+// policy says so.
+func readPerfMap(eventChan chan []byte, lostChan chan uint64, q *eventQueue, stopChan chan struct{}) {
+	for {
+		select {
+		case <-stopChan:
+			// On stop, stopChan will be closed but the other channels will
+			// also be closed shortly after. The select{} has no priorities,
+			// therefore, the "ok" value must be checked below.
+			return
+		case data, ok := <-eventChan:
+			if !ok {
+				return // see explanation above
+			}
+			q.push(data)
+		case lost, ok := <-lostChan:
+			if !ok {
+				return // see explanation above
+			}
+			q.addLost(lost)
+		}
+	}
+}
+
+// deliverEvents passes the queued events to the callback in batches until
+// the queue is closed.
+func deliverEvents(q *eventQueue, appendEvent func(*eventDecoder, []byte) error, batchCb func([]Event), lostCb func(uint64)) {
+	d := newEventDecoder(maxBatchSize)
+	decode := func(data []byte) error {
+		return appendEvent(d, data)
+	}
+	for {
+		d.reset()
+		lost, ok := q.popBatch(decode)
+		if !ok {
+			return
+		}
+		if len(d.events) > 0 {
+			batchCb(d.events)
+		}
+		if lost > 0 {
+			lostCb(lost)
+		}
+	}
+}
+
 func (t *Tracer) Start() {
 	t.perfMapIPV4.PollStart()
 	t.perfMapIPV6.PollStart()
+	if t.perfMapUnix != nil {
+		t.perfMapUnix.PollStart()
+	}
+
+	if t.guessCfg.Verify {
+		var ctx context.Context
+		ctx, t.cancel = context.WithCancel(context.Background())
+		go t.verify(ctx, t.guessCfg)
+	}
+}
+
+// Verification returns the result of the verification of the guessed
+// offsets, which runs in the background after Start when enabled with
+// GuessConfig.Verify. Events may be missed while offsets are guessed again.
+func (t *Tracer) Verification() VerificationResult {
+	return t.verifier.getResult()
+}
+
+// UnavailableFields returns the socket fields that could not be guessed,
+// because setting them on the guessing connections needs privileges the
+// process doesn't have: CAP_SETUID for the uid, CAP_NET_ADMIN for the mark
+// and CAP_NET_RAW for the bound device. They are 0 in the events.
+func (t *Tracer) UnavailableFields() ([]string, error) {
+	mask, err := t.unavailableMask()
+	if err != nil {
+		return nil, err
+	}
+	return unavailableFieldNames(mask), nil
+}
+
+func (t *Tracer) unavailableMask() (uint64, error) {
+	mp := t.m.Map("tcptracer_status")
+	if mp == nil {
+		return 0, fmt.Errorf("no map with name tcptracer_status")
+	}
+	var status tcpTracerStatus
+	if err := lookupStatus(t.m, mp, &status); err != nil {
+		return 0, fmt.Errorf("error reading tcptracer_status: %v", err)
+	}
+	return status.Unavailable, nil
+}
+
+// EphemeralPortUsage returns the number of ephemeral ports in use per
+// destination, the most used first, as counted from the connect and close
+// events seen since the tracer was created. It returns nil if
+// ip_local_port_range could not be read.
+func (t *Tracer) EphemeralPortUsage() []PortUsage {
+	if t.ports == nil {
+		return nil
+	}
+	return t.ports.snapshot()
+}
+
+// ListenerStats returns the counters of the listening sockets that received
+// SYNs since the tracer was started, the ones with the most drops first.
+func (t *Tracer) ListenerStats() ([]ListenerStats, error) {
+	if t.m.Map("listenstats") == nil {
+		return nil, fmt.Errorf("no map with name listenstats")
+	}
+	return t.listeners.snapshot(), nil
+}
+
+// lookupListener reads the counters of a listening socket from the
+// listenstats map of m.
+func lookupListener(m *bpflib.Module, sockID uint64, s *ListenerStats) bool {
+	mp := m.Map("listenstats")
+	if mp == nil {
+		return false
+	}
+	var value listenStats
+	if err := m.LookupElement(mp, unsafe.Pointer(&sockID), unsafe.Pointer(&value)); err != nil {
+		// the socket isn't listening anymore
+		return false
+	}
+	s.SynRecv = value.SynRecv
+	s.SynDropped = value.SynDropped
+	s.AckDropped = value.AckDropped
+	s.Backlog = value.Backlog
+	s.MaxBacklog = value.MaxBacklog
+	return true
+}
+
+// Poll returns the events counted since the previous call, in aggregation
+// mode. It returns nil otherwise.
+func (t *Tracer) Poll() ([]Aggregate, error) {
+	if t.aggregates == nil {
+		return nil, nil
+	}
+	return t.aggregates.read()
+}
+
+// SuppressedEvents returns the number of events not sent per pid because of
+// Config.RateLimit. The counters of the processes that exited are returned
+// one last time, and then removed.
+func (t *Tracer) SuppressedEvents() (map[uint32]uint64, error) {
+	mp := t.m.Map("ratelimit")
+	if mp == nil {
+		return nil, fmt.Errorf("no map with name ratelimit")
+	}
+
+	// the pids are listed before any is deleted: the iteration restarts
+	// from the first key when the current one is deleted
+	var pids []uint32
+	var pid, next uint32
+	pidp := unsafe.Pointer(nil)
+	for {
+		ok, err := mapNextKey(mp, pidp, unsafe.Pointer(&next))
+		if err != nil {
+			return nil, fmt.Errorf("error reading ratelimit: %v", err)
+		}
+		if !ok {
+			break
+		}
+		pids = append(pids, next)
+		pid = next
+		pidp = unsafe.Pointer(&pid)
+	}
+
+	lookup := func(pid uint32, rl *rateLimit) bool {
+		return t.m.LookupElement(mp, unsafe.Pointer(&pid), unsafe.Pointer(rl)) == nil
+	}
+	forget := func(pid uint32) {
+		t.m.DeleteElement(mp, unsafe.Pointer(&pid))
+	}
+	return suppressedEvents(pids, lookup, forget), nil
+}
+
+// suppressedEvents returns the non-zero suppressed counters of pids, read
+// with lookup, and forgets the pids of the processes that exited.
+func suppressedEvents(pids []uint32, lookup func(pid uint32, rl *rateLimit) bool, forget func(pid uint32)) map[uint32]uint64 {
+	ret := make(map[uint32]uint64)
+	for _, pid := range pids {
+		var rl rateLimit
+		if !lookup(pid, &rl) {
+			continue
+		}
+		if rl.Suppressed > 0 {
+			ret[pid] = rl.Suppressed
+		}
+		if _, err := os.Stat("/proc/" + strconv.FormatUint(uint64(pid), 10)); os.IsNotExist(err) {
+			forget(pid)
+		}
+	}
+	return ret
 }
 
 func (t *Tracer) AddFdInstallWatcher(pid uint32) (err error) {
@@ -142,16 +578,107 @@ func (t *Tracer) RemoveFdInstallWatcher(pid uint32) (err error) {
 	return err
 }
 
+// QueueStats returns the number of events lost so far, in the kernel or in
+// the userspace queue, and the number of events that could not be decoded.
+func (t *Tracer) QueueStats() QueueStats {
+	var stats QueueStats
+	stats.KernelLostV4, stats.DroppedV4, stats.InvalidV4 = t.queueV4.counters()
+	stats.KernelLostV6, stats.DroppedV6, stats.InvalidV6 = t.queueV6.counters()
+	if t.queueUnix != nil {
+		stats.KernelLostUnix, stats.DroppedUnix, stats.InvalidUnix = t.queueUnix.counters()
+	}
+	return stats
+}
+
+// Stats returns the counters of the tracer, combining the events counted
+// in userspace, the per-cpu counters of the eBPF programs and the kprobe
+// misses reported by the kernel.
+func (t *Tracer) Stats() (Stats, error) {
+	stats := Stats{
+		Delivered:     t.delivered.snapshot(),
+		DeliveredUnix: t.deliveredUnix.snapshot(),
+		QueueStats:    t.QueueStats(),
+	}
+
+	lostPerCPU, err := t.lostPerCPU()
+	if err != nil {
+		return stats, err
+	}
+	stats.LostPerCPU = lostPerCPU
+
+	probeMisses, err := t.probeMisses()
+	if err != nil {
+		return stats, err
+	}
+	stats.ProbeMisses = probeMisses
+
+	return stats, nil
+}
+
+func (t *Tracer) lostPerCPU() (map[uint]CPULostStats, error) {
+	mp := t.m.Map("tcptracer_stats")
+	if mp == nil {
+		return nil, fmt.Errorf("no map with name tcptracer_stats")
+	}
+
+	cpus, err := cpuonline.Get()
+	if err != nil {
+		return nil, fmt.Errorf("error getting online cpus: %v", err)
+	}
+
+	ret := make(map[uint]CPULostStats, len(cpus))
+	for _, cpu := range cpus {
+		key := uint32(cpu)
+		var value [3]uint64
+		if err := t.m.LookupElement(mp, unsafe.Pointer(&key), unsafe.Pointer(&value[0])); err != nil {
+			return nil, fmt.Errorf("error reading tcptracer_stats for cpu %d: %v", cpu, err)
+		}
+		ret[cpu] = CPULostStats{
+			LostV4:   value[0],
+			LostV6:   value[1],
+			NotReady: value[2],
+		}
+	}
+
+	return ret, nil
+}
+
+func (t *Tracer) probeMisses() (map[string]uint64, error) {
+	events := make(map[string]string)
+	for probe := range t.m.IterKprobes() {
+		events[kprobeEventName(probe.Name)] = probe.Name
+	}
+
+	f, err := openKprobeProfile()
+	if err != nil || f == nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseKprobeProfile(f, events)
+}
+
 func (t *Tracer) Stop() {
+	if t.cancel != nil {
+		t.cancel()
+	}
 	close(t.stopChan)
+	t.queueV4.close()
+	t.queueV6.close()
+	if t.queueUnix != nil {
+		t.queueUnix.close()
+	}
 	t.perfMapIPV4.PollStop()
 	t.perfMapIPV6.PollStop()
+	if t.perfMapUnix != nil {
+		t.perfMapUnix.PollStop()
+	}
 	t.m.Close()
 }
 
-func initialize(module *bpflib.Module, eventMapName string, eventChan chan []byte, lostChan chan uint64) (*bpflib.PerfMap, error) {
-	if err := guess(module); err != nil {
-		return nil, fmt.Errorf("error guessing offsets: %v", err)
+func initialize(ctx context.Context, module *bpflib.Module, cfg Config, eventMapName string, eventChan chan []byte, lostChan chan uint64) (*bpflib.PerfMap, error) {
+	if err := guess(ctx, module, cfg.Guess, nil); err != nil {
+		return nil, fmt.Errorf("error guessing offsets: %w", err)
 	}
 
 	pm, err := bpflib.InitPerfMap(module, eventMapName, eventChan, lostChan)
@@ -163,10 +690,10 @@ func initialize(module *bpflib.Module, eventMapName string, eventChan chan []byt
 
 }
 
-func initializeIPv4(module *bpflib.Module, eventChan chan []byte, lostChan chan uint64) (*bpflib.PerfMap, error) {
-	return initialize(module, "tcp_event_ipv4", eventChan, lostChan)
+func initializeIPv4(ctx context.Context, module *bpflib.Module, cfg Config, eventChan chan []byte, lostChan chan uint64) (*bpflib.PerfMap, error) {
+	return initialize(ctx, module, cfg, "tcp_event_ipv4", eventChan, lostChan)
 }
 
-func initializeIPv6(module *bpflib.Module, eventChan chan []byte, lostChan chan uint64) (*bpflib.PerfMap, error) {
-	return initialize(module, "tcp_event_ipv6", eventChan, lostChan)
+func initializeIPv6(ctx context.Context, module *bpflib.Module, cfg Config, eventChan chan []byte, lostChan chan uint64) (*bpflib.PerfMap, error) {
+	return initialize(ctx, module, cfg, "tcp_event_ipv6", eventChan, lostChan)
 }
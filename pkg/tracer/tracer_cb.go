@@ -6,3 +6,67 @@ type Callback interface {
 	LostV4(uint64)
 	LostV6(uint64)
 }
+
+// BatchCallback receives events in batches. The slice passed to
+// TCPEventsBatch and the events in it are reused once it returns, so they
+// must be copied if they need to be retained. IPv4 and IPv6 batches may be
+// delivered concurrently.
+type BatchCallback interface {
+	TCPEventsBatch([]Event)
+	LostV4(uint64)
+	LostV6(uint64)
+}
+
+// UDPCallback receives the UDP flow events, when enabled with Config.UDP.
+// A flow starts with the first packet seen with its tuple, in either
+// direction, and ends once no packet has been seen for
+// Config.UDPIdleTimeout. The flows still active when the tracer is stopped
+// don't get an end event. The methods may be called concurrently, with each
+// other and with the TCP callbacks.
+type UDPCallback interface {
+	UDPEventV4(UdpV4)
+	UDPEventV6(UdpV6)
+}
+
+// UnixCallback receives the connect, accept and close events of AF_UNIX
+// stream sockets. They are only traced when the callback passed to the
+// tracer also implements UnixCallback, and the kernel exposes its BTF type
+// information (see GuessConfig.BTFPath). The methods may be called
+// concurrently with the other callbacks.
+type UnixCallback interface {
+	UnixEvent(UnixEvent)
+	LostUnix(uint64)
+}
+
+// PortUsageCallback is notified when the ephemeral ports in use by the
+// connections towards a destination cross Config.EphemeralPortThreshold. It
+// is notified again once the usage has dropped below the threshold and
+// crossed it again. The method is called from the delivery of the TCP
+// events.
+type PortUsageCallback interface {
+	EphemeralPortThreshold(PortUsage)
+}
+
+// underlyingCallback returns the Callback adapted by cb, or cb itself, to
+// find the optional callbacks it implements.
+func underlyingCallback(cb BatchCallback) interface{} {
+	if a, ok := cb.(callbackAdapter); ok {
+		return a.Callback
+	}
+	return cb
+}
+
+// callbackAdapter delivers batches to a Callback one event at a time.
+type callbackAdapter struct {
+	Callback
+}
+
+func (a callbackAdapter) TCPEventsBatch(events []Event) {
+	for i := range events {
+		if events[i].IPv6 {
+			a.TCPEventV6(events[i].tcpV6())
+		} else {
+			a.TCPEventV4(events[i].tcpV4())
+		}
+	}
+}
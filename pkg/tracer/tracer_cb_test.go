@@ -0,0 +1,24 @@
+package tracer
+
+// testNetNS is the inode number of the initial network namespace.
+const testNetNS = 4026531992
+
+// recorder keeps the events passed to the optional callbacks. It is also a
+// BatchCallback, ignoring the TCP events.
+type recorder struct {
+	udpV4    []UdpV4
+	udpV6    []UdpV6
+	unix     []UnixEvent
+	lostUnix uint64
+	usages   []PortUsage
+}
+
+func (r *recorder) TCPEventsBatch([]Event) {}
+func (r *recorder) LostV4(uint64)          {}
+func (r *recorder) LostV6(uint64)          {}
+
+func (r *recorder) UDPEventV4(e UdpV4)                 { r.udpV4 = append(r.udpV4, e) }
+func (r *recorder) UDPEventV6(e UdpV6)                 { r.udpV6 = append(r.udpV6, e) }
+func (r *recorder) UnixEvent(e UnixEvent)              { r.unix = append(r.unix, e) }
+func (r *recorder) LostUnix(n uint64)                  { r.lostUnix += n }
+func (r *recorder) EphemeralPortThreshold(u PortUsage) { r.usages = append(r.usages, u) }
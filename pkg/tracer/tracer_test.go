@@ -0,0 +1,100 @@
+// +build linux
+
+package tracer
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	bpflib "github.com/iovisor/gobpf/elf"
+)
+
+func TestWriteConfigWithoutMap(t *testing.T) {
+	// an eBPF object predating tcptracer_config must be rebuilt, even
+	// with the default settings
+	if err := writeConfig(&bpflib.Module{}, Config{}, nil, false); err == nil {
+		t.Error("no error without the tcptracer_config map")
+	}
+}
+
+func TestNewTCPTracerConfig(t *testing.T) {
+	udp := newUDPTracker(nil, time.Minute, nil)
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+		udp  *udpTracker
+		unix bool
+		want tcpTracerConfig
+	}{
+		{
+			name: "defaults",
+			cfg:  DefaultConfig(),
+			want: tcpTracerConfig{},
+		},
+		{
+			name: "UDP and AF_UNIX",
+			cfg:  Config{UDP: true},
+			udp:  udp,
+			unix: true,
+			want: tcpTracerConfig{UDP: 1, UDPRefreshNs: uint64(15 * time.Second), UnixSockets: 1},
+		},
+		{
+			name: "state changes and aggregation",
+			cfg:  Config{StateChanges: true, Aggregate: true},
+			want: tcpTracerConfig{StateChanges: 1, Aggregate: 1},
+		},
+		{
+			name: "sampling",
+			cfg:  Config{SampleRate: 100},
+			want: tcpTracerConfig{SampleRate: 100},
+		},
+		{
+			name: "burst defaults to the limit",
+			cfg:  Config{RateLimit: 50},
+			want: tcpTracerConfig{RateLimit: 50, RateBurst: 50},
+		},
+		{
+			name: "burst",
+			cfg:  Config{RateLimit: 50, RateBurst: 200},
+			want: tcpTracerConfig{RateLimit: 50, RateBurst: 200},
+		},
+	} {
+		if got := newTCPTracerConfig(tt.cfg, tt.udp, tt.unix); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSuppressedEvents(t *testing.T) {
+	self := uint32(os.Getpid())
+	// above the largest pid_max
+	const exited = 1 << 23
+	const missing = 1<<23 + 1
+	counters := map[uint32]rateLimit{
+		self:       {Tokens: 1, LastNs: 2, Suppressed: 7},
+		exited:     {Suppressed: 3},
+		exited + 2: {},
+	}
+	lookup := func(pid uint32, rl *rateLimit) bool {
+		c, ok := counters[pid]
+		*rl = c
+		return ok
+	}
+	var forgotten []uint32
+	forget := func(pid uint32) {
+		forgotten = append(forgotten, pid)
+	}
+
+	// missing was removed from the map since the pids were listed
+	got := suppressedEvents([]uint32{self, exited, missing, exited + 2}, lookup, forget)
+	// the counters of the exited processes are returned one last time
+	want := map[uint32]uint64{self: 7, exited: 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if want := []uint32{exited, exited + 2}; !reflect.DeepEqual(forgotten, want) {
+		t.Errorf("forgot %v, want %v", forgotten, want)
+	}
+}
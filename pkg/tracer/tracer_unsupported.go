@@ -3,6 +3,7 @@
 package tracer
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -15,6 +16,18 @@ func TracerAsset() ([]byte, error) {
 func NewTracer(cb Callback) (*Tracer, error) {
 	return nil, fmt.Errorf("not supported on non-Linux systems")
 }
+
+func NewTracerBatch(cb BatchCallback) (*Tracer, error) {
+	return nil, fmt.Errorf("not supported on non-Linux systems")
+}
+
+func NewTracerWithConfig(cb BatchCallback, cfg Config) (*Tracer, error) {
+	return nil, fmt.Errorf("not supported on non-Linux systems")
+}
+
+func NewTracerContext(ctx context.Context, cb BatchCallback, cfg Config) (*Tracer, error) {
+	return nil, fmt.Errorf("not supported on non-Linux systems")
+}
 func (t *Tracer) Start() {
 }
 func (t *Tracer) AddFdInstallWatcher(pid uint32) (err error) {
@@ -23,5 +36,29 @@ func (t *Tracer) AddFdInstallWatcher(pid uint32) (err error) {
 func (t *Tracer) RemoveFdInstallWatcher(pid uint32) (err error) {
 	return fmt.Errorf("not supported on non-Linux systems")
 }
+func (t *Tracer) QueueStats() QueueStats {
+	return QueueStats{}
+}
+func (t *Tracer) Stats() (Stats, error) {
+	return Stats{}, fmt.Errorf("not supported on non-Linux systems")
+}
+func (t *Tracer) Verification() VerificationResult {
+	return VerificationResult{}
+}
+func (t *Tracer) UnavailableFields() ([]string, error) {
+	return nil, fmt.Errorf("not supported on non-Linux systems")
+}
+func (t *Tracer) EphemeralPortUsage() []PortUsage {
+	return nil
+}
+func (t *Tracer) Poll() ([]Aggregate, error) {
+	return nil, fmt.Errorf("not supported on non-Linux systems")
+}
+func (t *Tracer) SuppressedEvents() (map[uint32]uint64, error) {
+	return nil, fmt.Errorf("not supported on non-Linux systems")
+}
+func (t *Tracer) ListenerStats() ([]ListenerStats, error) {
+	return nil, fmt.Errorf("not supported on non-Linux systems")
+}
 func (t *Tracer) Stop() {
 }
@@ -0,0 +1,153 @@
+package tracer
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of the events of UDP packets, which are turned into UDP flow events
+// instead of being delivered as TCP events. These constants should be in
+// sync with the equivalent definitions in the ebpf program.
+const (
+	eventUDPSend EventType = 9
+	eventUDPRecv EventType = 10
+)
+
+// udpFlowKey identifies a UDP flow, like the keys of the udpflows_ipv4 and
+// udpflows_ipv6 maps.
+type udpFlowKey struct {
+	ipv6  bool
+	saddr [16]byte
+	daddr [16]byte
+	sport uint16
+	dport uint16
+	netns uint32
+}
+
+type udpFlow struct {
+	// first is the event of the first packet seen
+	first Event
+	// lastTimestamp is the kernel timestamp of the last report
+	lastTimestamp uint64
+	// lastSeen is when the last report was received
+	lastSeen time.Time
+}
+
+// udpTracker turns the UDP packets reported by the eBPF program, once per
+// flow and refresh interval, into flow start and end events.
+type udpTracker struct {
+	cb   UDPCallback
+	idle time.Duration
+	// forget removes an expired flow from the eBPF maps, so that its next
+	// packet is reported right away
+	forget func(udpFlowKey)
+
+	mu    sync.Mutex
+	flows map[udpFlowKey]*udpFlow
+}
+
+func newUDPTracker(cb UDPCallback, idle time.Duration, forget func(udpFlowKey)) *udpTracker {
+	return &udpTracker{
+		cb:     cb,
+		idle:   idle,
+		forget: forget,
+		flows:  make(map[udpFlowKey]*udpFlow),
+	}
+}
+
+// refreshInterval is how often the eBPF program reports a flow that is
+// still active. It has to be well below the idle timeout for the flow not
+// to expire between two reports.
+func (u *udpTracker) refreshInterval() time.Duration {
+	return u.idle / 4
+}
+
+// filter removes the UDP events from events, starting the flows seen for
+// the first time.
+func (u *udpTracker) filter(events []Event) []Event {
+	n := 0
+	for i := range events {
+		if events[i].Type != eventUDPSend && events[i].Type != eventUDPRecv {
+			events[n] = events[i]
+			n++
+			continue
+		}
+		u.add(&events[i])
+	}
+	return events[:n]
+}
+
+func (u *udpTracker) add(e *Event) {
+	k := udpFlowKey{
+		ipv6:  e.IPv6,
+		saddr: e.SAddr,
+		daddr: e.DAddr,
+		sport: e.SPort,
+		dport: e.DPort,
+		netns: e.NetNS,
+	}
+	now := time.Now()
+
+	u.mu.Lock()
+	if f, ok := u.flows[k]; ok {
+		f.lastTimestamp = e.Timestamp
+		f.lastSeen = now
+		u.mu.Unlock()
+		return
+	}
+	u.flows[k] = &udpFlow{
+		first:         *e,
+		lastTimestamp: e.Timestamp,
+		lastSeen:      now,
+	}
+	u.mu.Unlock()
+
+	u.send(e, UDPFlowStart, e.Timestamp)
+}
+
+// run expires the idle flows until stopChan is closed. The flows still
+// active at that point don't get an end event.
+func (u *udpTracker) run(stopChan chan struct{}) {
+	ticker := time.NewTicker(u.refreshInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case now := <-ticker.C:
+			u.expire(now)
+		}
+	}
+}
+
+func (u *udpTracker) expire(now time.Time) {
+	var ended []udpFlow
+
+	u.mu.Lock()
+	for k, f := range u.flows {
+		if now.Sub(f.lastSeen) < u.idle {
+			continue
+		}
+		delete(u.flows, k)
+		u.forget(k)
+		ended = append(ended, *f)
+	}
+	u.mu.Unlock()
+
+	for i := range ended {
+		u.send(&ended[i].first, UDPFlowEnd, ended[i].lastTimestamp)
+	}
+}
+
+func (u *udpTracker) send(e *Event, typ UDPEventType, timestamp uint64) {
+	if e.IPv6 {
+		ev := e.udpV6(typ)
+		ev.Timestamp = timestamp
+		u.cb.UDPEventV6(ev)
+	} else {
+		ev := e.udpV4(typ)
+		ev.Timestamp = timestamp
+		u.cb.UDPEventV4(ev)
+	}
+}
@@ -0,0 +1,91 @@
+package tracer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func udpEvent(typ EventType, sport uint16, timestamp uint64) Event {
+	e := Event{
+		Type:      typ,
+		Timestamp: timestamp,
+		Pid:       42,
+		SPort:     sport,
+		DPort:     53,
+		NetNS:     testNetNS,
+	}
+	copy(e.SAddr[:], net.ParseIP("10.0.0.1").To16())
+	copy(e.DAddr[:], net.ParseIP("10.0.0.53").To16())
+	return e
+}
+
+func TestUDPTrackerStart(t *testing.T) {
+	var r recorder
+	u := newUDPTracker(&r, time.Minute, func(udpFlowKey) {})
+
+	events := []Event{
+		udpEvent(eventUDPSend, 40000, 100),
+		{Type: EventConnect, SockID: 1},
+		// same flow, answer received
+		udpEvent(eventUDPRecv, 40000, 200),
+		udpEvent(eventUDPRecv, 40001, 300),
+	}
+	events = u.filter(events)
+	if len(events) != 1 || events[0].Type != EventConnect {
+		t.Errorf("UDP events not filtered: %+v", events)
+	}
+
+	if len(r.udpV4) != 2 {
+		t.Fatalf("got %d flow events, want 2: %+v", len(r.udpV4), r.udpV4)
+	}
+	first, second := r.udpV4[0], r.udpV4[1]
+	if first.Type != UDPFlowStart || first.SPort != 40000 || first.Timestamp != 100 || !first.Outbound {
+		t.Errorf("unexpected start of the first flow: %+v", first)
+	}
+	if !first.DAddr.Equal(net.ParseIP("10.0.0.53")) {
+		t.Errorf("got remote address %v, want 10.0.0.53", first.DAddr)
+	}
+	if second.Type != UDPFlowStart || second.SPort != 40001 || second.Outbound {
+		t.Errorf("unexpected start of the second flow: %+v", second)
+	}
+}
+
+func TestUDPTrackerExpire(t *testing.T) {
+	var r recorder
+	var forgotten []udpFlowKey
+	idle := time.Minute
+	u := newUDPTracker(&r, idle, func(k udpFlowKey) {
+		forgotten = append(forgotten, k)
+	})
+
+	u.filter([]Event{
+		udpEvent(eventUDPSend, 40000, 100),
+		udpEvent(eventUDPSend, 40000, 200),
+	})
+	r.udpV4 = nil
+
+	u.expire(time.Now().Add(idle / 2))
+	if len(r.udpV4) != 0 || len(forgotten) != 0 {
+		t.Fatalf("active flow expired: %+v", r.udpV4)
+	}
+
+	u.expire(time.Now().Add(idle))
+	if len(r.udpV4) != 1 {
+		t.Fatalf("got %d flow events, want 1: %+v", len(r.udpV4), r.udpV4)
+	}
+	end := r.udpV4[0]
+	if end.Type != UDPFlowEnd || end.SPort != 40000 || end.Timestamp != 200 {
+		t.Errorf("unexpected end of flow: %+v", end)
+	}
+	if len(forgotten) != 1 || forgotten[0].sport != 40000 {
+		t.Errorf("expired flow not removed from the eBPF maps: %+v", forgotten)
+	}
+
+	// the next packet starts a new flow
+	r.udpV4 = nil
+	u.filter([]Event{udpEvent(eventUDPSend, 40000, 300)})
+	if len(r.udpV4) != 1 || r.udpV4[0].Type != UDPFlowStart || r.udpV4[0].Timestamp != 300 {
+		t.Errorf("flow not started again: %+v", r.udpV4)
+	}
+}
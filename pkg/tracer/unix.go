@@ -0,0 +1,111 @@
+// +build linux
+
+package tracer
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// unixEventSize is the size of struct unix_event_t.
+const unixEventSize = 200
+
+// unixEvent mirrors the layout of struct unix_event_t in tcptracer-bpf.h.
+type unixEvent struct {
+	Timestamp uint64
+	CPU       uint64
+	Type      uint32
+	Pid       uint32
+	Comm      [16]byte
+	PeerPid   uint32
+	NetNS     uint32
+	PeerComm  [16]byte
+	SockID    uint64
+	Ino       uint64
+	PathLen   uint32
+	_         uint32
+	Path      [108]byte
+	_         [4]byte
+}
+
+func (e *unixEvent) unmarshal(data []byte) error {
+	if len(data) < unixEventSize {
+		return fmt.Errorf("unix_event_t too short: %d bytes", len(data))
+	}
+	e.Timestamp = nativeEndian.Uint64(data[0:8])
+	e.CPU = nativeEndian.Uint64(data[8:16])
+	e.Type = nativeEndian.Uint32(data[16:20])
+	e.Pid = nativeEndian.Uint32(data[20:24])
+	copy(e.Comm[:], data[24:40])
+	e.PeerPid = nativeEndian.Uint32(data[40:44])
+	e.NetNS = nativeEndian.Uint32(data[44:48])
+	copy(e.PeerComm[:], data[48:64])
+	e.SockID = nativeEndian.Uint64(data[64:72])
+	e.Ino = nativeEndian.Uint64(data[72:80])
+	e.PathLen = nativeEndian.Uint32(data[80:84])
+	copy(e.Path[:], data[88:196])
+	return nil
+}
+
+// path returns the socket path. Abstract names start with a NUL byte and
+// may contain others, they are returned with a "@" instead of the first
+// one, like ss and /proc/net/unix do.
+func (e *unixEvent) path() string {
+	n := int(e.PathLen)
+	if n > len(e.Path) {
+		n = len(e.Path)
+	}
+	p := e.Path[:n]
+	if len(p) > 0 && p[0] == 0 {
+		return "@" + string(p[1:])
+	}
+	if i := bytes.IndexByte(p, 0); i >= 0 {
+		p = p[:i]
+	}
+	return string(p)
+}
+
+func (e *unixEvent) event() UnixEvent {
+	return UnixEvent{
+		Timestamp: e.Timestamp,
+		CPU:       e.CPU,
+		Type:      EventType(e.Type),
+		Pid:       e.Pid,
+		Comm:      commToString(e.Comm[:]),
+		PeerPid:   e.PeerPid,
+		PeerComm:  commToString(e.PeerComm[:]),
+		Path:      e.path(),
+		NetNS:     e.NetNS,
+		SockID:    e.SockID,
+		Ino:       e.Ino,
+	}
+}
+
+// deliverUnixEvents passes the queued AF_UNIX socket events to cb, counting
+// them in delivered, until the queue is closed.
+func deliverUnixEvents(q *eventQueue, cb UnixCallback, delivered *eventCounters) {
+	var raw unixEvent
+	events := make([]UnixEvent, 0, maxBatchSize)
+	decode := func(data []byte) error {
+		if err := raw.unmarshal(data); err != nil {
+			return err
+		}
+		events = append(events, raw.event())
+		return nil
+	}
+
+	for {
+		events = events[:0]
+		lost, ok := q.popBatch(decode)
+		if !ok {
+			return
+		}
+		delivered.addUnix(events)
+		for i := range events {
+			cb.UnixEvent(events[i])
+		}
+		if lost > 0 {
+			cb.LostUnix(lost)
+		}
+	}
+}
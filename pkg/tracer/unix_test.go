@@ -0,0 +1,112 @@
+// +build linux
+
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func encodeUnixEvent(t *testing.T, e *unixEvent) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, nativeEndian, e); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newRawUnixEvent(typ EventType, path string) *unixEvent {
+	e := &unixEvent{
+		Timestamp: 1000,
+		CPU:       2,
+		Type:      uint32(typ),
+		Pid:       4242,
+		PeerPid:   1,
+		NetNS:     testNetNS,
+		SockID:    7,
+		Ino:       31337,
+		PathLen:   uint32(len(path)),
+	}
+	copy(e.Comm[:], "curl")
+	copy(e.PeerComm[:], "dockerd")
+	copy(e.Path[:], path)
+	return e
+}
+
+func TestUnixEventUnmarshal(t *testing.T) {
+	raw := newRawUnixEvent(EventConnect, "\x00abstract")
+	data := encodeUnixEvent(t, raw)
+	if len(data) != unixEventSize {
+		t.Fatalf("encoded event is %d bytes, want %d", len(data), unixEventSize)
+	}
+
+	var e unixEvent
+	if err := e.unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	want := UnixEvent{
+		Timestamp: 1000,
+		CPU:       2,
+		Type:      EventConnect,
+		Pid:       4242,
+		Comm:      "curl",
+		PeerPid:   1,
+		PeerComm:  "dockerd",
+		Path:      "@abstract",
+		NetNS:     testNetNS,
+		SockID:    7,
+		Ino:       31337,
+	}
+	if got := e.event(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if err := e.unmarshal(data[:unixEventSize-1]); err == nil {
+		t.Error("no error for a truncated event")
+	}
+}
+
+func TestDeliverUnixEvents(t *testing.T) {
+	q := newEventQueue(2, QueueDropNewest)
+	q.push(encodeUnixEvent(t, newRawUnixEvent(EventConnect, "/run/docker.sock")))
+	q.push([]byte{1, 2, 3})
+	// dropped, the queue is full
+	q.push(encodeUnixEvent(t, newRawUnixEvent(EventClose, "/run/docker.sock")))
+	q.addLost(5)
+
+	var r recorder
+	delivered := newEventCounters()
+	done := make(chan struct{})
+	go func() {
+		deliverUnixEvents(q, &r, delivered)
+		close(done)
+	}()
+
+	// the close of the queue is only seen once it is empty
+	for {
+		q.mu.Lock()
+		empty := q.count == 0 && q.pendingLost == 0
+		q.mu.Unlock()
+		if empty {
+			break
+		}
+	}
+	q.close()
+	<-done
+
+	if len(r.unix) != 1 || r.unix[0].Path != "/run/docker.sock" || r.unix[0].PeerComm != "dockerd" {
+		t.Errorf("unexpected events %+v", r.unix)
+	}
+	if r.lostUnix != 5 {
+		t.Errorf("got %d lost events, want 5", r.lostUnix)
+	}
+	if got := delivered.snapshot(); got[EventConnect] != 1 || len(got) != 1 {
+		t.Errorf("unexpected delivered counters %v", got)
+	}
+	kernelLost, dropped, invalid := q.counters()
+	if kernelLost != 5 || dropped != 1 || invalid != 1 {
+		t.Errorf("got %d lost, %d dropped, %d invalid, want 5, 1, 1", kernelLost, dropped, invalid)
+	}
+}
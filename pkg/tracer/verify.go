@@ -0,0 +1,398 @@
+// +build linux
+
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Addresses of the verification connections. They differ from the ones used
+// for guessing so that a coincidental match is not confirmed.
+const (
+	verifySourceIPv4 = "127.0.0.4"
+	verifyListenIPv4 = "127.0.0.3"
+	verifyIPv6       = "::1"
+)
+
+// Values of sk_uid and sk_mark for the verification connections, different
+// from the guessing ones for the same reason.
+const (
+	verifyUIDValue  uint32 = 0x6b2d0f4c
+	verifyMarkValue uint32 = 0x4d0e1f6a
+)
+
+// verifyExpectation is the connect event expected for a verification
+// connection.
+type verifyExpectation struct {
+	ipv6  bool
+	saddr [16]byte
+	daddr [16]byte
+	sport uint16
+	dport uint16
+	netns uint32
+	// uid, mark and ifindex are the values the connection could set,
+	// their defaults otherwise
+	uid     uint32
+	mark    uint32
+	ifindex uint32
+	ino     uint64
+	// unavailable are the fields that were not guessed, as in
+	// tcpTracerStatus.Unavailable
+	unavailable uint64
+
+	events chan Event
+}
+
+// verifier diverts the events of the verification connections from the
+// callback.
+type verifier struct {
+	pid uint32
+
+	mu       sync.Mutex
+	expected []*verifyExpectation
+	result   VerificationResult
+}
+
+func newVerifier() *verifier {
+	return &verifier{
+		pid: uint32(os.Getpid()),
+	}
+}
+
+func (v *verifier) expect(e *verifyExpectation) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.expected = append(v.expected, e)
+}
+
+func (v *verifier) forget(e *verifyExpectation) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for i := range v.expected {
+		if v.expected[i] == e {
+			v.expected = append(v.expected[:i], v.expected[i+1:]...)
+			return
+		}
+	}
+}
+
+// match returns the expectation an event belongs to. Since the event may be
+// decoded wrongly, it is enough for one of the ports to match.
+func (v *verifier) match(e *Event) *verifyExpectation {
+	if e.Pid != v.pid {
+		return nil
+	}
+	for _, exp := range v.expected {
+		if e.IPv6 != exp.ipv6 {
+			continue
+		}
+		if e.SPort == exp.sport || e.DPort == exp.dport ||
+			e.SPort == exp.dport || e.DPort == exp.sport {
+			return exp
+		}
+	}
+	return nil
+}
+
+// filter removes the events of the verification connections from events,
+// passing the connect events to the verification.
+func (v *verifier) filter(events []Event) []Event {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.expected) == 0 {
+		return events
+	}
+
+	n := 0
+	for i := range events {
+		exp := v.match(&events[i])
+		if exp == nil {
+			events[n] = events[i]
+			n++
+			continue
+		}
+		if events[i].Type == EventConnect {
+			select {
+			case exp.events <- events[i]:
+			default:
+			}
+		}
+	}
+	return events[:n]
+}
+
+func (v *verifier) setResult(res VerificationResult) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.result = res
+}
+
+func (v *verifier) getResult() VerificationResult {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.result
+}
+
+// mismatchedField compares an event with the expected values and returns the
+// guessing state of the first wrong field, in guessing order. The family is
+// implied by the event being received, and the protocol is not sent. The
+// fields that were not guessed are not compared.
+func mismatchedField(e *Event, exp *verifyExpectation) (uint64, bool) {
+	if !exp.ipv6 {
+		if e.SAddr != exp.saddr {
+			return guessSaddr, true
+		}
+		if e.DAddr != exp.daddr {
+			return guessDaddr, true
+		}
+		if e.SPort != exp.sport {
+			return guessSport, true
+		}
+	}
+	if e.DPort != exp.dport {
+		return guessDport, true
+	}
+	if e.NetNS != exp.netns {
+		return guessNetns, true
+	}
+	if exp.ipv6 {
+		if e.DAddr != exp.daddr {
+			return guessDaddrIPv6, true
+		}
+		if e.SAddr != exp.saddr {
+			return guessSaddrIPv6, true
+		}
+		if e.SPort != exp.sport {
+			return guessSportIPv6, true
+		}
+	}
+	// connect events are sent when the connection is established, with
+	// the state read from the socket as the old state
+	if e.OldState != TCPSynSent {
+		return guessState, true
+	}
+	if e.UID != exp.uid && !exp.isUnavailable(guessUID) {
+		return guessUID, true
+	}
+	if e.Mark != exp.mark && !exp.isUnavailable(guessMark) {
+		return guessMark, true
+	}
+	if e.IfIndex != exp.ifindex && !exp.isUnavailable(guessBoundDevIf) {
+		return guessBoundDevIf, true
+	}
+	if e.Ino != exp.ino {
+		return guessSocketIno, true
+	}
+	return 0, false
+}
+
+func (exp *verifyExpectation) isUnavailable(what uint64) bool {
+	return exp.unavailable&(1<<what) != 0
+}
+
+// verifySockOpts sets SO_MARK and SO_BINDTODEVICE on the verification
+// connections, recording them in exp. Without the privileges to set them,
+// the mark and bound device are expected to be unset.
+func verifySockOpts(exp *verifyExpectation, lo *net.Interface) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if setMark(verifyMarkValue)(network, address, c) == nil {
+			exp.mark = verifyMarkValue
+		}
+		if bindToDevice(lo.Name)(network, address, c) == nil {
+			exp.ifindex = uint32(lo.Index)
+		}
+		return nil
+	}
+}
+
+// verifyConnection makes a connection to l and waits for its connect event.
+// It returns the guessing state of the first wrong field, if any.
+func (v *verifier) verifyConnection(ctx context.Context, cfg *GuessConfig, network string, l net.Listener, local *net.TCPAddr, netns, unavailable uint64) (uint64, bool, error) {
+	lo, err := net.InterfaceByName(loopbackInterface)
+	if err != nil {
+		return 0, false, fmt.Errorf("error getting loopback interface: %v", err)
+	}
+
+	laddr := l.Addr().(*net.TCPAddr)
+	exp := &verifyExpectation{
+		ipv6:        network == "tcp6",
+		dport:       uint16(laddr.Port),
+		netns:       uint32(netns),
+		unavailable: unavailable,
+		events:      make(chan Event, 1),
+	}
+	copy(exp.saddr[:], local.IP.To16())
+	copy(exp.daddr[:], laddr.IP.To16())
+
+	v.expect(exp)
+	defer v.forget(exp)
+
+	// filter only reads the ports of the expectation, the other fields are
+	// compared once its event is received
+	dialer := net.Dialer{
+		LocalAddr: local,
+		Timeout:   cfg.VerifyTimeout,
+		Control:   verifySockOpts(exp, lo),
+	}
+	prev := setfsuid(verifyUIDValue)
+	// as when guessing, without CAP_SETUID we keep our uid
+	exp.uid = setfsuid(verifyUIDValue)
+	conn, err := dialer.DialContext(ctx, network, l.Addr().String())
+	setfsuid(prev)
+	if err != nil {
+		return 0, false, fmt.Errorf("error dialing %q: %v", l.Addr(), err)
+	}
+	defer conn.Close()
+
+	sport, err := strconv.Atoi(portOf(conn.LocalAddr()))
+	if err != nil {
+		return 0, false, fmt.Errorf("error converting source port: %v", err)
+	}
+	ino, err := socketIno(conn)
+	if err != nil {
+		return 0, false, fmt.Errorf("error getting socket inode: %v", err)
+	}
+	v.mu.Lock()
+	exp.sport = uint16(sport)
+	exp.ino = ino
+	v.mu.Unlock()
+
+	select {
+	case e := <-exp.events:
+		what, mismatch := mismatchedField(&e, exp)
+		return what, mismatch, nil
+	case <-time.After(cfg.VerifyTimeout):
+		return 0, false, fmt.Errorf("no event for verification connection to %q", l.Addr())
+	case <-ctx.Done():
+		return 0, false, ctx.Err()
+	}
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
+
+func acceptAndClose(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+}
+
+// verifyOnce makes the verification connections. It returns the guessing
+// state of the first wrong field found, if any, ignoring the unavailable
+// fields.
+func (v *verifier) verifyOnce(ctx context.Context, cfg *GuessConfig, unavailable uint64) (uint64, bool, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	netns, err := ownNetNS()
+	if err != nil {
+		return 0, false, fmt.Errorf("error getting current netns: %v", err)
+	}
+
+	families := []struct {
+		network  string
+		listenIP string
+		localIP  string
+	}{
+		{"tcp4", verifyListenIPv4, verifySourceIPv4},
+		{"tcp6", verifyIPv6, verifyIPv6},
+	}
+
+	for _, f := range families {
+		l, err := net.Listen(f.network, net.JoinHostPort(f.listenIP, "0"))
+		if err != nil {
+			if f.network == "tcp6" {
+				// IPv6 may be disabled, there is nothing to verify then
+				continue
+			}
+			return 0, false, err
+		}
+		go acceptAndClose(l)
+
+		for i := 0; i < cfg.VerifyConnections; i++ {
+			local := &net.TCPAddr{IP: net.ParseIP(f.localIP)}
+			what, mismatch, err := v.verifyConnection(ctx, cfg, f.network, l, local, netns, unavailable)
+			if err != nil || mismatch {
+				l.Close()
+				return what, mismatch, err
+			}
+		}
+		l.Close()
+	}
+
+	return 0, false, nil
+}
+
+// verify checks the guessed offsets and guesses them again, skipping the
+// wrong ones, until the verification passes or cfg.VerifyAttempts is
+// reached. The result is available with Tracer.Verification.
+func (t *Tracer) verify(ctx context.Context, cfg GuessConfig) {
+	var res VerificationResult
+	skips := make(offsetSkips)
+
+	run := func(f func() error) error {
+		if cfg.PrivateNetNS {
+			return runInPrivateNetNS(f)
+		}
+		return f()
+	}
+
+	for {
+		var what uint64
+		var mismatch bool
+		unavailable, err := t.unavailableMask()
+		if err == nil {
+			err = run(func() error {
+				var err error
+				what, mismatch, err = t.verifier.verifyOnce(ctx, &cfg, unavailable)
+				return err
+			})
+		}
+		if err != nil {
+			res.Err = err
+			break
+		}
+		if !mismatch {
+			res.Verified = true
+			break
+		}
+
+		res.Mismatches = append(res.Mismatches, whatString[what])
+		if res.Reguessed >= cfg.VerifyAttempts {
+			res.Err = fmt.Errorf("verification still failing after guessing again %d times", res.Reguessed)
+			break
+		}
+
+		restart := &guessRestart{
+			what:  what,
+			skips: skips,
+		}
+		if err := guess(ctx, t.m, cfg, restart); err != nil {
+			res.Err = fmt.Errorf("error guessing offsets again: %w", err)
+			break
+		}
+		res.Reguessed++
+	}
+
+	res.Done = true
+	t.verifier.setResult(res)
+}
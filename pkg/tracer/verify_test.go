@@ -0,0 +1,175 @@
+// +build linux
+
+package tracer
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMismatchedField(t *testing.T) {
+	newExpectation := func(ipv6 bool) *verifyExpectation {
+		exp := &verifyExpectation{
+			ipv6:    ipv6,
+			sport:   40000,
+			dport:   8080,
+			netns:   testNetNS,
+			uid:     verifyUIDValue,
+			mark:    verifyMarkValue,
+			ifindex: 1,
+			ino:     12345,
+		}
+		if ipv6 {
+			copy(exp.saddr[:], net.ParseIP("::1"))
+			copy(exp.daddr[:], net.ParseIP("::1"))
+		} else {
+			copy(exp.saddr[:], net.ParseIP(verifySourceIPv4).To16())
+			copy(exp.daddr[:], net.ParseIP(verifyListenIPv4).To16())
+		}
+		return exp
+	}
+	eventFor := func(exp *verifyExpectation) Event {
+		return Event{
+			Type:     EventConnect,
+			IPv6:     exp.ipv6,
+			SAddr:    exp.saddr,
+			DAddr:    exp.daddr,
+			SPort:    exp.sport,
+			DPort:    exp.dport,
+			NetNS:    exp.netns,
+			State:    TCPEstablished,
+			OldState: TCPSynSent,
+			UID:      exp.uid,
+			Mark:     exp.mark,
+			IfIndex:  exp.ifindex,
+			Ino:      exp.ino,
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		ipv6   bool
+		mangle func(e *Event)
+		want   uint64
+	}{
+		{"saddr", false, func(e *Event) { e.SAddr[15]++ }, guessSaddr},
+		{"daddr", false, func(e *Event) { e.DAddr[15]++ }, guessDaddr},
+		{"sport", false, func(e *Event) { e.SPort++ }, guessSport},
+		{"dport", false, func(e *Event) { e.DPort++ }, guessDport},
+		{"netns", false, func(e *Event) { e.NetNS++ }, guessNetns},
+		{"state", false, func(e *Event) { e.OldState = TCPEstablished }, guessState},
+		{"uid", false, func(e *Event) { e.UID = 0 }, guessUID},
+		{"mark", false, func(e *Event) { e.Mark = 0 }, guessMark},
+		{"ifindex", false, func(e *Event) { e.IfIndex = 0 }, guessBoundDevIf},
+		{"inode", false, func(e *Event) { e.Ino = 0 }, guessSocketIno},
+		{"first field in guessing order", false, func(e *Event) { e.Ino = 0; e.DPort++ }, guessDport},
+		{"daddr ipv6", true, func(e *Event) { e.DAddr[0]++ }, guessDaddrIPv6},
+		{"saddr ipv6", true, func(e *Event) { e.SAddr[0]++ }, guessSaddrIPv6},
+		{"sport ipv6", true, func(e *Event) { e.SPort++ }, guessSportIPv6},
+		{"dport before ipv6 addresses", true, func(e *Event) { e.SAddr[0]++; e.DPort++ }, guessDport},
+		{"mark ipv6", true, func(e *Event) { e.Mark = 0 }, guessMark},
+	} {
+		exp := newExpectation(tt.ipv6)
+		e := eventFor(exp)
+		if what, mismatch := mismatchedField(&e, exp); mismatch {
+			t.Errorf("%s: unexpected mismatch of %s before breaking the event", tt.name, whatString[what])
+		}
+		tt.mangle(&e)
+		what, mismatch := mismatchedField(&e, exp)
+		if !mismatch || what != tt.want {
+			t.Errorf("%s: got %s (%v), want %s", tt.name, whatString[what], mismatch, whatString[tt.want])
+		}
+	}
+}
+
+func TestMismatchedFieldUnavailable(t *testing.T) {
+	exp := &verifyExpectation{
+		sport:       40000,
+		dport:       8080,
+		uid:         verifyUIDValue,
+		mark:        verifyMarkValue,
+		ifindex:     1,
+		ino:         12345,
+		unavailable: 1<<guessUID | 1<<guessMark | 1<<guessBoundDevIf,
+	}
+	e := Event{
+		Type:     EventConnect,
+		SPort:    exp.sport,
+		DPort:    exp.dport,
+		OldState: TCPSynSent,
+		Ino:      exp.ino,
+	}
+	// the fields that were not guessed are 0 in the events
+	if what, mismatch := mismatchedField(&e, exp); mismatch {
+		t.Errorf("unexpected mismatch of unavailable field %s", whatString[what])
+	}
+	e.Ino = 0
+	if what, mismatch := mismatchedField(&e, exp); !mismatch || what != guessSocketIno {
+		t.Errorf("got %s (%v), want %s", whatString[what], mismatch, whatString[guessSocketIno])
+	}
+}
+
+func TestStartSockField(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		what        uint64
+		unavailable uint64
+		want        uint64
+	}{
+		{"uid", guessUID, 0, guessUID},
+		{"skip uid", guessUID, 1 << guessUID, guessMark},
+		{"skip uid and mark", guessUID, 1<<guessUID | 1<<guessMark, guessBoundDevIf},
+		{"skip all", guessUID, 1<<guessUID | 1<<guessMark | 1<<guessBoundDevIf, guessSocketIno},
+		{"skip bound device", guessBoundDevIf, 1 << guessBoundDevIf, guessSocketIno},
+		{"mark after uid", guessMark, 1 << guessUID, guessMark},
+	} {
+		status := &tcpTracerStatus{
+			OffsetState:     18,
+			OffsetSaddrIPv6: 56,
+			OffsetSocketIno: 40,
+			Unavailable:     tt.unavailable,
+		}
+		startSockField(status, tt.what)
+		if status.What != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, whatString[status.What], whatString[tt.want])
+			continue
+		}
+		switch tt.want {
+		case guessBoundDevIf:
+			if status.OffsetBoundDevIf != status.OffsetState+1 {
+				t.Errorf("%s: bound device offset %d, want %d", tt.name, status.OffsetBoundDevIf, status.OffsetState+1)
+			}
+		case guessSocketIno:
+			if status.OffsetSocket != status.OffsetSaddrIPv6+16 || status.OffsetSocketIno != 0 {
+				t.Errorf("%s: socket offsets %d, %d, want %d, 0", tt.name, status.OffsetSocket, status.OffsetSocketIno, status.OffsetSaddrIPv6+16)
+			}
+		}
+	}
+
+	if got := unavailableFieldNames(1<<guessUID | 1<<guessBoundDevIf); len(got) != 2 ||
+		got[0] != whatString[guessUID] || got[1] != whatString[guessBoundDevIf] {
+		t.Errorf("unexpected unavailable field names %q", got)
+	}
+}
+
+func TestStartIPv6Source(t *testing.T) {
+	status := &tcpTracerStatus{
+		OffsetSport:     782,
+		OffsetFamily:    16,
+		OffsetDaddrIPv6: 56,
+		OffsetSaddrIPv6: 100,
+	}
+	startIPv6Source(status, true)
+	if status.What != guessSaddrIPv6 || status.OffsetSaddrIPv6 != 0 {
+		t.Errorf("with loopback: guessing %s from %d, want %s from 0", whatString[status.What], status.OffsetSaddrIPv6, whatString[guessSaddrIPv6])
+	}
+
+	// without IPv6, the baseline layout is assumed
+	startIPv6Source(status, false)
+	if status.What != guessState || status.OffsetState != status.OffsetFamily+1 {
+		t.Errorf("without loopback: guessing %s from %d, want %s from %d", whatString[status.What], status.OffsetState, whatString[guessState], status.OffsetFamily+1)
+	}
+	if status.OffsetSaddrIPv6 != 72 || status.OffsetSportIPv6 != 782 {
+		t.Errorf("without loopback: source offsets %d, %d, want 72, 782", status.OffsetSaddrIPv6, status.OffsetSportIPv6)
+	}
+}
@@ -43,24 +43,105 @@ struct bpf_map_def SEC("maps/tcp_event_ipv6") tcp_event_ipv6 = {
 	.namespace = "",
 };
 
+/* This is a key/value store with the keys being the cpu number
+ * and the values being a perf file descriptor.
+ */
+struct bpf_map_def SEC("maps/unix_event") unix_event = {
+	.type = BPF_MAP_TYPE_PERF_EVENT_ARRAY,
+	.key_size = sizeof(int),
+	.value_size = sizeof(__u32),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* This is a key/value store with a single entry, at key 0, holding the
+ * struct tcptracer_config_t.
+ */
+struct bpf_map_def SEC("maps/tcptracer_config") tcptracer_config = {
+	.type = BPF_MAP_TYPE_ARRAY,
+	.key_size = sizeof(__u32),
+	.value_size = sizeof(struct tcptracer_config_t),
+	.max_entries = 1,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* This is a key/value store with the keys being a struct aggregate_key_t and
+ * the values being the number of events, in aggregation mode. Userspace
+ * removes the entries that stay unchanged between two reads; new keys are
+ * not counted while the map is full.
+ */
+struct bpf_map_def SEC("maps/aggregates") aggregates = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(struct aggregate_key_t),
+	.value_size = sizeof(__u64),
+	.max_entries = 10240,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* This is a key/value store with the keys being a pid and the values being
+ * its struct ratelimit_t, when the events are rate limited. Userspace removes
+ * the entries of the processes that exited; new processes are not limited
+ * while the map is full.
+ */
+struct bpf_map_def SEC("maps/ratelimit") ratelimit = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u32),
+	.value_size = sizeof(struct ratelimit_t),
+	.max_entries = 10240,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* This is a key/value store with the keys being the cpu number
+ * and the values being a struct tcptracer_cpu_stats_t.
+ */
+struct bpf_map_def SEC("maps/tcptracer_stats") tcptracer_stats = {
+	.type = BPF_MAP_TYPE_ARRAY,
+	.key_size = sizeof(__u32),
+	.value_size = sizeof(struct tcptracer_cpu_stats_t),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
 /* These maps are used to match the kprobe & kretprobe of connect */
 
 /* This is a key/value store with the keys being a pid
- * and the values being a struct sock *.
+ * and the values being a struct connect_sock_t.
  */
 struct bpf_map_def SEC("maps/connectsock_ipv4") connectsock_ipv4 = {
 	.type = BPF_MAP_TYPE_HASH,
 	.key_size = sizeof(__u64),
-	.value_size = sizeof(void *),
+	.value_size = sizeof(struct connect_sock_t),
 	.max_entries = 1024,
 	.pinning = 0,
 	.namespace = "",
 };
 
 /* This is a key/value store with the keys being a pid
- * and the values being a struct sock *.
+ * and the values being a struct connect_sock_t.
  */
 struct bpf_map_def SEC("maps/connectsock_ipv6") connectsock_ipv6 = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u64),
+	.value_size = sizeof(struct connect_sock_t),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* This map is used to match the kprobe of inet_accept and the kretprobe of
+ * inet_csk_accept, which returns the new struct sock before it is grafted on
+ * the new struct socket.
+ */
+
+/* This is a key/value store with the keys being a pid
+ * and the values being a struct socket *.
+ */
+struct bpf_map_def SEC("maps/acceptsock") acceptsock = {
 	.type = BPF_MAP_TYPE_HASH,
 	.key_size = sizeof(__u64),
 	.value_size = sizeof(void *),
@@ -69,6 +150,37 @@ struct bpf_map_def SEC("maps/connectsock_ipv6") connectsock_ipv6 = {
 	.namespace = "",
 };
 
+/* This is a key/value store with the keys being a struct sock * and the
+ * values the reason why it is being closed, found from its state transitions.
+ * tcp_close reads the reason and marks the entry with CLOSE_REASON_CLOSED,
+ * so that the transitions it causes are not recorded, and the entry is
+ * removed on the transition to TCP_CLOSE, or by tcp_close if the socket is
+ * already closed.
+ */
+struct bpf_map_def SEC("maps/closereason") closereason = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u64),
+	.value_size = sizeof(__u32),
+	.max_entries = 10240,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* This is a key/value store with the keys being a struct sock * of a child
+ * socket not accepted yet and the values being its creation time.
+ * Children that are never accepted, because the listener is closed, are not
+ * removed but their entry is replaced when the memory of the socket is reused
+ * by another child.
+ */
+struct bpf_map_def SEC("maps/childsock_ts") childsock_ts = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u64),
+	.value_size = sizeof(__u64),
+	.max_entries = 10240,
+	.pinning = 0,
+	.namespace = "",
+};
+
 /* This is a key/value store with the keys being an ipv4_tuple_t
  * and the values being a struct pid_comm_t.
  */
@@ -93,6 +205,103 @@ struct bpf_map_def SEC("maps/tuplepid_ipv6") tuplepid_ipv6 = {
 	.namespace = "",
 };
 
+/* These are key/value stores with the keys being a UDP flow, as an
+ * ipv4_tuple_t or ipv6_tuple_t with the ports in host byte order, and the
+ * values being the last time the flow was reported. Userspace removes the
+ * flows once they expire.
+ */
+struct bpf_map_def SEC("maps/udpflows_ipv4") udpflows_ipv4 = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(struct ipv4_tuple_t),
+	.value_size = sizeof(__u64),
+	.max_entries = 10240,
+	.pinning = 0,
+	.namespace = "",
+};
+
+struct bpf_map_def SEC("maps/udpflows_ipv6") udpflows_ipv6 = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(struct ipv6_tuple_t),
+	.value_size = sizeof(__u64),
+	.max_entries = 10240,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* This is a key/value store with the keys being a pid and the values being
+ * a struct udp_recvmsg_t, to match the kprobe & kretprobe of udp_recvmsg and
+ * udpv6_recvmsg.
+ */
+struct bpf_map_def SEC("maps/udprecv") udprecv = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u64),
+	.value_size = sizeof(struct udp_recvmsg_t),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* This is a key/value store with the keys being a pid and the values being
+ * the struct sock * passed to inet_csk_get_port by bind(), to find it when
+ * inet_bind or inet6_bind return.
+ */
+struct bpf_map_def SEC("maps/bindsock") bindsock = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u64),
+	.value_size = sizeof(void *),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* This is a key/value store with the keys being the sock id of a listening
+ * socket and the values being its struct listen_stats_t. The entries are
+ * removed when the socket stops listening.
+ */
+struct bpf_map_def SEC("maps/listenstats") listenstats = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u64),
+	.value_size = sizeof(struct listen_stats_t),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* These maps are used to match the kprobe & kretprobe of unix_stream_connect
+ * and unix_accept, with the keys being a pid and the values being a struct
+ * unix_connect_t and the struct socket * of the new socket.
+ */
+struct bpf_map_def SEC("maps/unixconnect") unixconnect = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u64),
+	.value_size = sizeof(struct unix_connect_t),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+struct bpf_map_def SEC("maps/unixaccept") unixaccept = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u64),
+	.value_size = sizeof(void *),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+/* This is a key/value store with the keys being the struct sock * of a
+ * connected AF_UNIX stream socket and the values being its connect or accept
+ * event, sent again when the socket is released.
+ */
+struct bpf_map_def SEC("maps/unixconns") unixconns = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(__u64),
+	.value_size = sizeof(struct unix_event_t),
+	.max_entries = 10240,
+	.pinning = 0,
+	.namespace = "",
+};
+
 /* This is a key/value store with the keys being a pid
  * and the values being a fd unsigned int.
  */
@@ -146,6 +355,12 @@ static bool is_ipv4_mapped_ipv6(u64 saddr_h, u64 saddr_l, u64 daddr_h, u64 daddr
 	}
 }
 
+/* is_ipv4_mapped returns whether a single address is IPv4-mapped */
+__attribute__((always_inline))
+static bool is_ipv4_mapped(u64 addr_h, u64 addr_l) {
+	return is_ipv4_mapped_ipv6(addr_h, addr_l, addr_h, addr_l);
+}
+
 struct bpf_map_def SEC("maps/tcptracer_status") tcptracer_status = {
 	.type = BPF_MAP_TYPE_HASH,
 	.key_size = sizeof(__u64),
@@ -155,16 +370,271 @@ struct bpf_map_def SEC("maps/tcptracer_status") tcptracer_status = {
 	.namespace = "",
 };
 
+/* connection_event returns whether events of the given type can be
+ * aggregated, sampled and rate limited. The UDP and listening socket events
+ * are rate limited already, and are always sent.
+ */
 __attribute__((always_inline))
-static int are_offsets_ready_v4(struct tcptracer_status_t *status, struct sock *skp, u64 pid) {
-	u64 zero = 0;
+static bool connection_event(u32 type)
+{
+	switch (type) {
+	case TCP_EVENT_TYPE_UDP_SEND:
+	case TCP_EVENT_TYPE_UDP_RECV:
+	case TCP_EVENT_TYPE_LISTEN_OVERFLOW:
+	case TCP_EVENT_TYPE_SYN_RECV:
+		return false;
+	}
+	return true;
+}
+
+/* aggregated returns whether events of the given type are counted in the
+ * aggregates map instead of being sent.
+ */
+__attribute__((always_inline))
+static bool aggregated(u32 type)
+{
+	struct tcptracer_config_t *config;
+	u32 zero = 0;
+
+	if (!connection_event(type)) {
+		return false;
+	}
+
+	config = bpf_map_lookup_elem(&tcptracer_config, &zero);
+	return config != NULL && config->aggregate;
+}
+
+/* take_token takes a token from the bucket of pid, refilled with
+ * config->rate_limit tokens per second up to config->rate_burst. It returns
+ * false, counting the event as suppressed, if the bucket is empty.
+ */
+__attribute__((always_inline))
+static bool take_token(struct tcptracer_config_t *config, u32 pid)
+{
+	struct ratelimit_t *rl;
+	u64 now = bpf_ktime_get_ns();
+	u64 max = (u64)config->rate_burst * NSEC_PER_SEC;
+	u64 elapsed, tokens;
+
+	rl = bpf_map_lookup_elem(&ratelimit, &pid);
+	if (rl == NULL) {
+		struct ratelimit_t new_rl = {
+			.tokens = max - NSEC_PER_SEC,
+			.last_ns = now,
+		};
+		// if the map is full the process is not limited
+		bpf_map_update_elem(&ratelimit, &pid, &new_rl, BPF_NOEXIST);
+		return true;
+	}
+
+	// the bucket is full after max / rate_limit nanoseconds, which also
+	// keeps the product below from overflowing
+	elapsed = now - rl->last_ns;
+	if (elapsed > max / config->rate_limit) {
+		elapsed = max / config->rate_limit;
+	}
+	tokens = rl->tokens + elapsed * config->rate_limit;
+	if (tokens > max) {
+		tokens = max;
+	}
+	rl->last_ns = now;
+
+	if (tokens < NSEC_PER_SEC) {
+		rl->tokens = tokens;
+		__sync_fetch_and_add(&rl->suppressed, 1);
+		return false;
+	}
+	rl->tokens = tokens - NSEC_PER_SEC;
+	return true;
+}
+
+/* rate_limit_event returns whether an event of pid is sent under the rate
+ * limit of the process, for the AF_UNIX socket events, which are not
+ * sampled.
+ */
+__attribute__((always_inline))
+static bool rate_limit_event(u32 pid)
+{
+	struct tcptracer_config_t *config;
+	u32 zero = 0;
+
+	config = bpf_map_lookup_elem(&tcptracer_config, &zero);
+	if (config == NULL || config->rate_limit == 0) {
+		return true;
+	}
+	return take_token(config, pid);
+}
+
+/* sample_event returns whether an event is sent, setting the sample rate it
+ * is sent with. The connections are sampled by their sock id, so that all
+ * the events of a connection are sent or none, before the rate limit of the
+ * process is applied.
+ */
+__attribute__((always_inline))
+static bool sample_event(u32 type, u32 pid, u64 sock_id, u16 *sample_rate)
+{
+	struct tcptracer_config_t *config;
+	u32 zero = 0;
+
+	*sample_rate = 1;
+	if (!connection_event(type)) {
+		return true;
+	}
+
+	config = bpf_map_lookup_elem(&tcptracer_config, &zero);
+	if (config == NULL) {
+		return true;
+	}
+
+	if (config->sample_rate > 1) {
+		*sample_rate = config->sample_rate;
+		if (sock_id % config->sample_rate != 0) {
+			return false;
+		}
+	}
+
+	if (config->rate_limit == 0) {
+		return true;
+	}
+	return take_token(config, pid);
+}
+
+__attribute__((always_inline))
+static void count_aggregate(struct aggregate_key_t *key)
+{
+	u64 one = 1;
+	u64 *countp;
+
+	countp = bpf_map_lookup_elem(&aggregates, key);
+	if (countp != NULL) {
+		__sync_fetch_and_add(countp, 1);
+		return;
+	}
+
+	if (bpf_map_update_elem(&aggregates, key, &one, BPF_NOEXIST) == 0) {
+		return;
+	}
+	// another cpu added the key first, unless the map is full
+	countp = bpf_map_lookup_elem(&aggregates, key);
+	if (countp != NULL) {
+		__sync_fetch_and_add(countp, 1);
+	}
+}
+
+/* bpf_perf_event_output() fails when the perf ring buffer of the cpu is full.
+ * The kernel reports those events as lost to userspace, but we also count
+ * them here to know which cpus are affected.
+ */
+__attribute__((always_inline))
+static void send_ipv4_event(struct pt_regs *ctx, u32 cpu, struct tcp_ipv4_event_t *evt)
+{
+	struct tcptracer_cpu_stats_t *stats;
+
+	if (aggregated(evt->type)) {
+		struct aggregate_key_t key = {
+			.daddr_l = evt->daddr,
+			.netns = evt->netns,
+			.pid = evt->pid,
+			.type = evt->type,
+			.dport = evt->dport,
+		};
+		count_aggregate(&key);
+		return;
+	}
 
+	if (!sample_event(evt->type, evt->pid, evt->info.sock_id, &evt->sample_rate)) {
+		return;
+	}
+
+	if (bpf_perf_event_output(ctx, &tcp_event_ipv4, cpu, evt, sizeof(*evt)) == 0) {
+		return;
+	}
+
+	stats = bpf_map_lookup_elem(&tcptracer_stats, &cpu);
+	if (stats != NULL) {
+		__sync_fetch_and_add(&stats->lost_ipv4, 1);
+	}
+}
+
+__attribute__((always_inline))
+static void send_ipv6_event(struct pt_regs *ctx, u32 cpu, struct tcp_ipv6_event_t *evt)
+{
+	struct tcptracer_cpu_stats_t *stats;
+
+	if (aggregated(evt->type)) {
+		struct aggregate_key_t key = {
+			.daddr_h = evt->daddr_h,
+			.daddr_l = evt->daddr_l,
+			.netns = evt->netns,
+			.pid = evt->pid,
+			.type = evt->type,
+			.dport = evt->dport,
+			.ipv6 = 1,
+		};
+		count_aggregate(&key);
+		return;
+	}
+
+	if (!sample_event(evt->type, evt->pid, evt->info.sock_id, &evt->sample_rate)) {
+		return;
+	}
+
+	if (bpf_perf_event_output(ctx, &tcp_event_ipv6, cpu, evt, sizeof(*evt)) == 0) {
+		return;
+	}
+
+	stats = bpf_map_lookup_elem(&tcptracer_stats, &cpu);
+	if (stats != NULL) {
+		__sync_fetch_and_add(&stats->lost_ipv6, 1);
+	}
+}
+
+/* count_not_ready counts the events of other processes that are not sent
+ * because the offsets are being guessed, e.g. again after a failed
+ * verification.
+ */
+__attribute__((always_inline))
+static void count_not_ready(struct tcptracer_status_t *status)
+{
+	struct tcptracer_cpu_stats_t *stats;
+	u32 cpu = bpf_get_smp_processor_id();
+
+	if (status->state == TCPTRACER_STATE_UNINITIALIZED ||
+	    bpf_get_current_pid_tgid() >> 32 == status->pid_tgid >> 32) {
+		return;
+	}
+
+	stats = bpf_map_lookup_elem(&tcptracer_stats, &cpu);
+	if (stats != NULL) {
+		__sync_fetch_and_add(&stats->not_ready, 1);
+	}
+}
+
+/* offsets_ready returns whether the offsets are known, counting the events
+ * lost otherwise.
+ */
+__attribute__((always_inline))
+static bool offsets_ready(struct tcptracer_status_t *status)
+{
+	if (status == NULL) {
+		return 0;
+	}
+	if (status->state == TCPTRACER_STATE_READY) {
+		return 1;
+	}
+	count_not_ready(status);
+	return 0;
+}
+
+__attribute__((always_inline))
+static int are_offsets_ready_v4(struct tcptracer_status_t *status, struct sock *skp, u64 pid) {
 	switch (status->state) {
 		case TCPTRACER_STATE_UNINITIALIZED:
 			return 0;
 		case TCPTRACER_STATE_CHECKING:
 			break;
 		case TCPTRACER_STATE_CHECKED:
+			count_not_ready(status);
 			return 0;
 		case TCPTRACER_STATE_READY:
 			return 1;
@@ -176,34 +646,16 @@ static int are_offsets_ready_v4(struct tcptracer_status_t *status, struct sock *
 	// threads must be ignored here. Userland must take care to generate
 	// connections from the correct thread. In Golang, this can be achieved
 	// with runtime.LockOSThread.
-	if (status->pid_tgid != pid)
-		return 0;
-
-	struct tcptracer_status_t new_status = { };
-	new_status.state = TCPTRACER_STATE_CHECKED;
-	new_status.pid_tgid = status->pid_tgid;
-	new_status.what = status->what;
-	new_status.offset_saddr = status->offset_saddr;
-	new_status.offset_daddr = status->offset_daddr;
-	new_status.offset_sport = status->offset_sport;
-	new_status.offset_dport = status->offset_dport;
-	new_status.offset_netns = status->offset_netns;
-	new_status.offset_ino = status->offset_ino;
-	new_status.offset_family = status->offset_family;
-	new_status.offset_daddr_ipv6 = status->offset_daddr_ipv6;
-	new_status.err = 0;
-	new_status.saddr = status->saddr;
-	new_status.daddr = status->daddr;
-	new_status.sport = status->sport;
-	new_status.dport = status->dport;
-	new_status.netns = status->netns;
-	new_status.family = status->family;
-
-	int i;
-	for (i = 0; i < 4; i++) {
-		new_status.daddr_ipv6[i] = status->daddr_ipv6[i];
+	if (status->pid_tgid != pid) {
+		count_not_ready(status);
+		return 0;
 	}
 
+	// status points to the map value: it is updated in place, since a
+	// copy of it doesn't fit on the stack. Only the value of the field
+	// being guessed changes.
+	status->err = 0;
+
 	u32 possible_saddr;
 	u32 possible_daddr;
 	u16 possible_sport;
@@ -211,33 +663,40 @@ static int are_offsets_ready_v4(struct tcptracer_status_t *status, struct sock *
 	possible_net_t *possible_skc_net;
 	u32 possible_netns;
 	u16 possible_family;
+	u8 possible_state;
+	u32 possible_protocol;
+	u32 possible_uid;
+	u32 possible_mark;
+	u32 possible_bound_dev_if;
+	struct socket *possible_socket;
+	u64 possible_socket_ino;
 	long ret = 0;
 
 	switch (status->what) {
 		case GUESS_SADDR:
 			possible_saddr = 0;
 			bpf_probe_read(&possible_saddr, sizeof(possible_saddr), ((char *)skp) + status->offset_saddr);
-			new_status.saddr = possible_saddr;
+			status->saddr = possible_saddr;
 			break;
 		case GUESS_DADDR:
 			possible_daddr = 0;
 			bpf_probe_read(&possible_daddr, sizeof(possible_daddr), ((char *)skp) + status->offset_daddr);
-			new_status.daddr = possible_daddr;
+			status->daddr = possible_daddr;
 			break;
 		case GUESS_FAMILY:
 			possible_family = 0;
 			bpf_probe_read(&possible_family, sizeof(possible_family), ((char *)skp) + status->offset_family);
-			new_status.family = possible_family;
+			status->family = possible_family;
 			break;
 		case GUESS_SPORT:
 			possible_sport = 0;
 			bpf_probe_read(&possible_sport, sizeof(possible_sport), ((char *)skp) + status->offset_sport);
-			new_status.sport = possible_sport;
+			status->sport = possible_sport;
 			break;
 		case GUESS_DPORT:
 			possible_dport = 0;
 			bpf_probe_read(&possible_dport, sizeof(possible_dport), ((char *)skp) + status->offset_dport);
-			new_status.dport = possible_dport;
+			status->dport = possible_dport;
 			break;
 		case GUESS_NETNS:
 			possible_netns = 0;
@@ -248,31 +707,69 @@ static int are_offsets_ready_v4(struct tcptracer_status_t *status, struct sock *
 			// to the next offset_netns
 			ret = bpf_probe_read(&possible_netns, sizeof(possible_netns), ((char *)possible_skc_net) + status->offset_ino);
 			if (ret == -EFAULT) {
-				new_status.err = 1;
+				status->err = 1;
+				break;
+			}
+			status->netns = possible_netns;
+			break;
+		case GUESS_STATE:
+			possible_state = 0;
+			bpf_probe_read(&possible_state, sizeof(possible_state), ((char *)skp) + status->offset_state);
+			status->tcp_state = possible_state;
+			break;
+		case GUESS_PROTOCOL:
+			possible_protocol = 0;
+			bpf_probe_read(&possible_protocol, sizeof(possible_protocol), ((char *)skp) + status->offset_protocol);
+			status->protocol = possible_protocol;
+			break;
+		case GUESS_UID:
+			possible_uid = 0;
+			bpf_probe_read(&possible_uid, sizeof(possible_uid), ((char *)skp) + status->offset_uid);
+			status->uid = possible_uid;
+			break;
+		case GUESS_MARK:
+			possible_mark = 0;
+			bpf_probe_read(&possible_mark, sizeof(possible_mark), ((char *)skp) + status->offset_mark);
+			status->mark = possible_mark;
+			break;
+		case GUESS_BOUND_DEV_IF:
+			possible_bound_dev_if = 0;
+			bpf_probe_read(&possible_bound_dev_if, sizeof(possible_bound_dev_if), ((char *)skp) + status->offset_bound_dev_if);
+			status->bound_dev_if = possible_bound_dev_if;
+			break;
+		case GUESS_SOCKET_INO:
+			possible_socket_ino = 0;
+			possible_socket = NULL;
+			bpf_probe_read(&possible_socket, sizeof(possible_socket), ((char *)skp) + status->offset_socket);
+			// like for the netns, an invalid pointer means we
+			// need to go to the next offset_socket
+			ret = bpf_probe_read(&possible_socket_ino, sizeof(possible_socket_ino), ((char *)possible_socket) + status->offset_socket_ino);
+			if (ret == -EFAULT) {
+				status->err = 1;
 				break;
 			}
-			new_status.netns = possible_netns;
+			status->socket_ino = possible_socket_ino;
 			break;
 		default:
 			// not for us
 			return 0;
 	}
 
-	bpf_map_update_elem(&tcptracer_status, &zero, &new_status, BPF_ANY);
+	// set last, so that userspace reads the value once it is there
+	status->state = TCPTRACER_STATE_CHECKED;
 
 	return 0;
 }
 
 __attribute__((always_inline))
 static int are_offsets_ready_v6(struct tcptracer_status_t *status, struct sock *skp, u64 pid) {
-	u64 zero = 0;
-
 	switch (status->state) {
 		case TCPTRACER_STATE_UNINITIALIZED:
 			return 0;
 		case TCPTRACER_STATE_CHECKING:
 			break;
 		case TCPTRACER_STATE_CHECKED:
+			count_not_ready(status);
 			return 0;
 		case TCPTRACER_STATE_READY:
 			return 1;
@@ -284,50 +781,47 @@ static int are_offsets_ready_v6(struct tcptracer_status_t *status, struct sock *
 	// threads must be ignored here. Userland must take care to generate
 	// connections from the correct thread. In Golang, this can be achieved
 	// with runtime.LockOSThread.
-	if (status->pid_tgid != pid)
-		return 0;
-
-	struct tcptracer_status_t new_status = { };
-	new_status.state = TCPTRACER_STATE_CHECKED;
-	new_status.pid_tgid = status->pid_tgid;
-	new_status.what = status->what;
-	new_status.offset_saddr = status->offset_saddr;
-	new_status.offset_daddr = status->offset_daddr;
-	new_status.offset_sport = status->offset_sport;
-	new_status.offset_dport = status->offset_dport;
-	new_status.offset_netns = status->offset_netns;
-	new_status.offset_ino = status->offset_ino;
-	new_status.offset_family = status->offset_family;
-	new_status.offset_daddr_ipv6 = status->offset_daddr_ipv6;
-	new_status.err = 0;
-	new_status.saddr = status->saddr;
-	new_status.daddr = status->daddr;
-	new_status.sport = status->sport;
-	new_status.dport = status->dport;
-	new_status.netns = status->netns;
-	new_status.family = status->family;
-
-	int i;
-	for (i = 0; i < 4; i++) {
-		new_status.daddr_ipv6[i] = status->daddr_ipv6[i];
+	if (status->pid_tgid != pid) {
+		count_not_ready(status);
+		return 0;
 	}
 
+	// status points to the map value: it is updated in place, since a
+	// copy of it doesn't fit on the stack. Only the value of the field
+	// being guessed changes.
+	status->err = 0;
+
+	int i;
 	u32 possible_daddr_ipv6[4] = { };
+	u32 possible_saddr_ipv6[4] = { };
+	u16 possible_sport;
 	switch (status->what) {
 		case GUESS_DADDR_IPV6:
 			bpf_probe_read(&possible_daddr_ipv6, sizeof(possible_daddr_ipv6), ((char *)skp) + status->offset_daddr_ipv6);
 
-			int i;
 			for (i = 0; i < 4; i++) {
-				new_status.daddr_ipv6[i] = possible_daddr_ipv6[i];
+				status->daddr_ipv6[i] = possible_daddr_ipv6[i];
 			}
 			break;
-		default:
-			// not for us
-			return 0;
+		case GUESS_SADDR_IPV6:
+			bpf_probe_read(&possible_saddr_ipv6, sizeof(possible_saddr_ipv6), ((char *)skp) + status->offset_saddr_ipv6);
+
+			for (i = 0; i < 4; i++) {
+				status->saddr_ipv6[i] = possible_saddr_ipv6[i];
+			}
+			break;
+		case GUESS_SPORT_IPV6:
+			possible_sport = 0;
+			bpf_probe_read(&possible_sport, sizeof(possible_sport), ((char *)skp) + status->offset_sport_ipv6);
+			status->sport_ipv6 = possible_sport;
+			break;
+		default:
+			// not for us
+			return 0;
 	}
 
-	bpf_map_update_elem(&tcptracer_status, &zero, &new_status, BPF_ANY);
+	// set last, so that userspace reads the value once it is there
+	status->state = TCPTRACER_STATE_CHECKED;
 
 	return 0;
 }
@@ -340,7 +834,7 @@ static bool check_family(struct sock *sk, u16 expected_family) {
 	family = 0;
 
 	status = bpf_map_lookup_elem(&tcptracer_status, &zero);
-	if (status == NULL || status->state != TCPTRACER_STATE_READY) {
+	if (!offsets_ready(status)) {
 		return 0;
 	}
 
@@ -349,6 +843,83 @@ static bool check_family(struct sock *sk, u16 expected_family) {
 	return family == expected_family;
 }
 
+/* hash_sock returns an identifier of the socket that doesn't expose kernel
+ * addresses, using the finalizer of MurmurHash3 on the pointer xored with a
+ * random key. It is unique as long as the socket exists.
+ */
+__attribute__((always_inline))
+static u64 hash_sock(struct tcptracer_status_t *status, struct sock *skp)
+{
+	u64 h = (u64)skp ^ status->sock_id_key;
+
+	h ^= h >> 33;
+	h *= 0xff51afd7ed558ccdULL;
+	h ^= h >> 33;
+	h *= 0xc4ceb9fe1a85ec53ULL;
+	h ^= h >> 33;
+	return h;
+}
+
+/* read_socket_ino reads the inode number of a struct socket, as shown in
+ * /proc/<pid>/fd/ (socket:[ino]).
+ */
+__attribute__((always_inline))
+static u64 read_socket_ino(struct tcptracer_status_t *status, struct socket *sock)
+{
+	u64 ino = 0;
+
+	if (sock == NULL) {
+		return 0;
+	}
+	bpf_probe_read(&ino, sizeof(ino), ((char *)sock) + status->offset_socket_ino);
+	return ino;
+}
+
+/* read_sock_info reads the socket fields that are sent with the events but
+ * not part of the tuple.
+ */
+__attribute__((always_inline))
+static void read_sock_info(struct tcptracer_status_t *status, struct sock *skp, struct sock_info_t *info)
+{
+	struct socket *sock = NULL;
+
+	info->sock_id = hash_sock(status, skp);
+	bpf_probe_read(&sock, sizeof(sock), ((char *)skp) + status->offset_socket);
+	info->ino = read_socket_ino(status, sock);
+	bpf_probe_read(&info->state, sizeof(info->state), ((char *)skp) + status->offset_state);
+	if (!(status->unavailable & (1 << GUESS_UID))) {
+		bpf_probe_read(&info->uid, sizeof(info->uid), ((char *)skp) + status->offset_uid);
+	}
+	if (!(status->unavailable & (1 << GUESS_MARK))) {
+		bpf_probe_read(&info->mark, sizeof(info->mark), ((char *)skp) + status->offset_mark);
+	}
+	if (!(status->unavailable & (1 << GUESS_BOUND_DEV_IF))) {
+		bpf_probe_read(&info->ifindex, sizeof(info->ifindex), ((char *)skp) + status->offset_bound_dev_if);
+	}
+}
+
+/* read_tcp_stats reads the TCP statistics sent with close events, when
+ * userspace found the offsets of struct tcp_sock.
+ */
+__attribute__((always_inline))
+static void read_tcp_stats(struct tcptracer_status_t *status, struct sock *skp, struct tcp_stats_t *stats)
+{
+	void *ca_ops = NULL;
+
+	if (!status->tcp_stats_ready) {
+		return;
+	}
+
+	bpf_probe_read(&stats->srtt_us, sizeof(stats->srtt_us), ((char *)skp) + status->offset_srtt);
+	bpf_probe_read(&stats->mdev_us, sizeof(stats->mdev_us), ((char *)skp) + status->offset_mdev);
+	bpf_probe_read(&stats->total_retrans, sizeof(stats->total_retrans), ((char *)skp) + status->offset_total_retrans);
+	bpf_probe_read(&stats->snd_cwnd, sizeof(stats->snd_cwnd), ((char *)skp) + status->offset_snd_cwnd);
+	bpf_probe_read(&ca_ops, sizeof(ca_ops), ((char *)skp) + status->offset_ca_ops);
+	if (ca_ops != NULL) {
+		bpf_probe_read(&stats->ca_name, sizeof(stats->ca_name), ((char *)ca_ops) + status->offset_ca_name);
+	}
+}
+
 __attribute__((always_inline))
 static int read_ipv4_tuple(struct ipv4_tuple_t *tuple, struct tcptracer_status_t *status, struct sock *skp)
 {
@@ -402,11 +973,11 @@ static int read_ipv6_tuple(struct ipv6_tuple_t *tuple, struct tcptracer_status_t
 	skc_net = NULL;
 	net_ns_inum = 0;
 
-	bpf_probe_read(&saddr_h, sizeof(saddr_h), ((char *)skp) + status->offset_daddr_ipv6 + 2 * sizeof(u64));
-	bpf_probe_read(&saddr_l, sizeof(saddr_l), ((char *)skp) + status->offset_daddr_ipv6 + 3 * sizeof(u64));
+	bpf_probe_read(&saddr_h, sizeof(saddr_h), ((char *)skp) + status->offset_saddr_ipv6);
+	bpf_probe_read(&saddr_l, sizeof(saddr_l), ((char *)skp) + status->offset_saddr_ipv6 + sizeof(u64));
 	bpf_probe_read(&daddr_h, sizeof(daddr_h), ((char *)skp) + status->offset_daddr_ipv6);
 	bpf_probe_read(&daddr_l, sizeof(daddr_l), ((char *)skp) + status->offset_daddr_ipv6 + sizeof(u64));
-	bpf_probe_read(&sport, sizeof(sport), ((char *)skp) + status->offset_sport);
+	bpf_probe_read(&sport, sizeof(sport), ((char *)skp) + status->offset_sport_ipv6);
 	bpf_probe_read(&dport, sizeof(dport), ((char *)skp) + status->offset_dport);
 	// Get network namespace id
 	bpf_probe_read(&skc_net, sizeof(void *), ((char *)skp) + status->offset_netns);
@@ -428,15 +999,329 @@ static int read_ipv6_tuple(struct ipv6_tuple_t *tuple, struct tcptracer_status_t
 	return 1;
 }
 
+/* set_state_change sets the state of a state change event, leaving the
+ * current state of the socket as the old state. new_state is negative for the
+ * other events.
+ */
+__attribute__((always_inline))
+static void set_state_change(struct sock_info_t *info, int new_state)
+{
+	if (new_state < 0) {
+		return;
+	}
+	info->old_state = info->state;
+	info->state = new_state;
+}
+
+/* send_sock_event sends an event of the given type for skp, without
+ * touching the tuple maps. Only full sockets are reported: time-wait and
+ * request sockets do not have the fields of struct inet_sock.
+ * State change, bind and listening socket events are sent even if the tuple
+ * is incomplete, e.g. before connect() picks the source port or for
+ * listening sockets. shutdown is only set for shutdown events.
+ */
+__attribute__((always_inline))
+static int send_sock_event(struct pt_regs *ctx, struct sock *skp, u32 type, int new_state, u8 shutdown)
+{
+	struct tcptracer_status_t *status;
+	u64 zero = 0;
+	u64 pid = bpf_get_current_pid_tgid();
+	u32 cpu = bpf_get_smp_processor_id();
+	u8 state = 0;
+	bool partial = new_state >= 0 || type == TCP_EVENT_TYPE_BIND ||
+		type == TCP_EVENT_TYPE_LISTEN_OVERFLOW || type == TCP_EVENT_TYPE_SYN_RECV;
+
+	if (skp == NULL) {
+		return 0;
+	}
+
+	status = bpf_map_lookup_elem(&tcptracer_status, &zero);
+	if (!offsets_ready(status)) {
+		return 0;
+	}
+
+	bpf_probe_read(&state, sizeof(state), ((char *)skp) + status->offset_state);
+	if (state == TCP_TIME_WAIT || state == TCP_NEW_SYN_RECV) {
+		return 0;
+	}
+	// tcp_set_state is also called without changing the state
+	if (state == new_state) {
+		return 0;
+	}
+
+	if (check_family(skp, AF_INET)) {
+		struct ipv4_tuple_t t = { };
+		if (!read_ipv4_tuple(&t, status, skp) && !partial) {
+			return 0;
+		}
+
+		struct tcp_ipv4_event_t evt = {
+			.timestamp = bpf_ktime_get_ns(),
+			.cpu = cpu,
+			.type = type,
+			.shutdown = shutdown,
+			.pid = pid >> 32,
+			.saddr = t.saddr,
+			.daddr = t.daddr,
+			.sport = ntohs(t.sport),
+			.dport = ntohs(t.dport),
+			.netns = t.netns,
+		};
+		bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+		read_sock_info(status, skp, &evt.info);
+		set_state_change(&evt.info, new_state);
+
+		send_ipv4_event(ctx, cpu, &evt);
+	} else if (check_family(skp, AF_INET6)) {
+		struct ipv6_tuple_t t = { };
+		if (!read_ipv6_tuple(&t, status, skp) && !partial) {
+			return 0;
+		}
+
+		if (is_ipv4_mapped_ipv6(t.saddr_h, t.saddr_l, t.daddr_h, t.daddr_l)) {
+			struct tcp_ipv4_event_t evt4 = {
+				.timestamp = bpf_ktime_get_ns(),
+				.cpu = cpu,
+				.type = type,
+				.shutdown = shutdown,
+				.pid = pid >> 32,
+				.saddr = (u32)(t.saddr_l >> 32),
+				.daddr = (u32)(t.daddr_l >> 32),
+				.sport = ntohs(t.sport),
+				.dport = ntohs(t.dport),
+				.netns = t.netns,
+			};
+			bpf_get_current_comm(&evt4.comm, sizeof(evt4.comm));
+			read_sock_info(status, skp, &evt4.info);
+			set_state_change(&evt4.info, new_state);
+
+			send_ipv4_event(ctx, cpu, &evt4);
+			return 0;
+		}
+
+		struct tcp_ipv6_event_t evt = {
+			.timestamp = bpf_ktime_get_ns(),
+			.cpu = cpu,
+			.type = type,
+			.shutdown = shutdown,
+			.pid = pid >> 32,
+			.saddr_h = t.saddr_h,
+			.saddr_l = t.saddr_l,
+			.daddr_h = t.daddr_h,
+			.daddr_l = t.daddr_l,
+			.sport = ntohs(t.sport),
+			.dport = ntohs(t.dport),
+			.netns = t.netns,
+		};
+		bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+		read_sock_info(status, skp, &evt.info);
+		set_state_change(&evt.info, new_state);
+
+		send_ipv6_event(ctx, cpu, &evt);
+	}
+	return 0;
+}
+
+/* send_state_change sends a state change event, when enabled in the config.
+ */
+__attribute__((always_inline))
+static void send_state_change(struct pt_regs *ctx, struct sock *skp, int new_state)
+{
+	struct tcptracer_config_t *config;
+	u32 zero = 0;
+
+	config = bpf_map_lookup_elem(&tcptracer_config, &zero);
+	if (config == NULL || !config->state_changes) {
+		return;
+	}
+
+	send_sock_event(ctx, skp, TCP_EVENT_TYPE_STATE_CHANGE, new_state, 0);
+}
+
+/* record_close_reason records why the socket will be closed when it leaves
+ * the established state. The first reason is kept, except for resets which
+ * are recorded by tcp_reset. Nothing is recorded once tcp_close has run.
+ */
+__attribute__((always_inline))
+static void record_close_reason(struct tcptracer_status_t *status, struct sock *skp, int new_state)
+{
+	u64 key = (u64)skp;
+	u32 reason;
+	u32 *reasonp;
+	u8 old_state = 0;
+
+	bpf_probe_read(&old_state, sizeof(old_state), ((char *)skp) + status->offset_state);
+
+	switch (new_state) {
+	case TCP_SYN_SENT:
+		// a new connection, forget the entry left by a previous socket
+		bpf_map_delete_elem(&closereason, &key);
+		return;
+	case TCP_FIN_WAIT1:
+		reason = CLOSE_REASON_ACTIVE;
+		break;
+	case TCP_CLOSE_WAIT:
+		reason = CLOSE_REASON_PASSIVE;
+		break;
+	case TCP_CLOSE:
+		// the last transition of a socket already seen by tcp_close
+		reasonp = bpf_map_lookup_elem(&closereason, &key);
+		if (reasonp != NULL && *reasonp == CLOSE_REASON_CLOSED) {
+			bpf_map_delete_elem(&closereason, &key);
+			return;
+		}
+		if (old_state == TCP_SYN_SENT || old_state == TCP_SYN_RECV) {
+			reason = CLOSE_REASON_HANDSHAKE_FAILED;
+		} else if (old_state == TCP_ESTABLISHED) {
+			// neither side sent a FIN: a timeout, a reset sent on
+			// abort or disconnect, or a reset received
+			reason = CLOSE_REASON_ABORT;
+		} else {
+			return;
+		}
+		break;
+	default:
+		return;
+	}
+
+	bpf_map_update_elem(&closereason, &key, &reason, BPF_NOEXIST);
+}
+
+/* read_close_reason returns why the socket is being closed. tcp_close runs
+ * before the transitions caused by close(), so a socket without entry is
+ * closed by this side. The entry is then marked with CLOSE_REASON_CLOSED
+ * until the transition to TCP_CLOSE, or removed if the socket is already
+ * closed.
+ */
+__attribute__((always_inline))
+static u8 read_close_reason(struct tcptracer_status_t *status, struct sock *skp)
+{
+	u64 key = (u64)skp;
+	u32 *reasonp;
+	u32 closed = CLOSE_REASON_CLOSED;
+	u8 reason = CLOSE_REASON_UNKNOWN;
+	u8 state = 0;
+
+	bpf_probe_read(&state, sizeof(state), ((char *)skp) + status->offset_state);
+
+	reasonp = bpf_map_lookup_elem(&closereason, &key);
+	if (reasonp != NULL && *reasonp != CLOSE_REASON_CLOSED) {
+		reason = *reasonp;
+	} else {
+		switch (state) {
+		case TCP_ESTABLISHED:
+			reason = CLOSE_REASON_ACTIVE;
+			break;
+		case TCP_SYN_SENT:
+		case TCP_SYN_RECV:
+			reason = CLOSE_REASON_HANDSHAKE_FAILED;
+			break;
+		}
+	}
+
+	if (state == TCP_CLOSE) {
+		bpf_map_delete_elem(&closereason, &key);
+	} else {
+		bpf_map_update_elem(&closereason, &key, &closed, BPF_ANY);
+	}
+	return reason;
+}
+
+/* update_listen_stats counts a SYN received by the listening socket skp, or
+ * an ACK completing a handshake if syn is false, and whether it is dropped
+ * because the accept queue is full. The events are sent at most once per
+ * LISTEN_EVENT_INTERVAL_NS and listening socket.
+ */
+__attribute__((always_inline))
+static int update_listen_stats(struct pt_regs *ctx, struct sock *skp, bool syn)
+{
+	struct tcptracer_status_t *status;
+	struct listen_stats_t *statsp;
+	u64 zero = 0;
+	u64 id;
+	u64 now = bpf_ktime_get_ns();
+	u32 backlog = 0;
+	u32 max_backlog = 0;
+	bool full = false;
+
+	status = bpf_map_lookup_elem(&tcptracer_status, &zero);
+	if (!offsets_ready(status)) {
+		return 0;
+	}
+
+	// as sk_acceptq_is_full
+	if (status->listen_ready) {
+		bpf_probe_read(&backlog, sizeof(backlog), ((char *)skp) + status->offset_ack_backlog);
+		bpf_probe_read(&max_backlog, sizeof(max_backlog), ((char *)skp) + status->offset_max_ack_backlog);
+		full = backlog > max_backlog;
+	}
+	if (!syn && !full) {
+		return 0;
+	}
+
+	id = hash_sock(status, skp);
+	statsp = bpf_map_lookup_elem(&listenstats, &id);
+	if (statsp == NULL) {
+		struct listen_stats_t stats = { };
+		bpf_map_update_elem(&listenstats, &id, &stats, BPF_NOEXIST);
+		statsp = bpf_map_lookup_elem(&listenstats, &id);
+		if (statsp == NULL) {
+			return 0;	// map full
+		}
+	}
+
+	statsp->backlog = backlog;
+	statsp->max_backlog = max_backlog;
+	if (syn) {
+		__sync_fetch_and_add(&statsp->syn_recv, 1);
+	}
+	if (full) {
+		if (syn) {
+			__sync_fetch_and_add(&statsp->syn_dropped, 1);
+		} else {
+			__sync_fetch_and_add(&statsp->ack_dropped, 1);
+		}
+		if (now - statsp->last_overflow_ns < LISTEN_EVENT_INTERVAL_NS) {
+			return 0;
+		}
+		statsp->last_overflow_ns = now;
+		return send_sock_event(ctx, skp, TCP_EVENT_TYPE_LISTEN_OVERFLOW, -1, 0);
+	}
+
+	if (now - statsp->last_syn_ns < LISTEN_EVENT_INTERVAL_NS) {
+		return 0;
+	}
+	statsp->last_syn_ns = now;
+	return send_sock_event(ctx, skp, TCP_EVENT_TYPE_SYN_RECV, -1, 0);
+}
+
+/* forget_listener removes the counters of skp when it stops listening.
+ */
+__attribute__((always_inline))
+static void forget_listener(struct tcptracer_status_t *status, struct sock *skp)
+{
+	u64 id;
+	u8 state = 0;
+
+	bpf_probe_read(&state, sizeof(state), ((char *)skp) + status->offset_state);
+	if (state != TCP_LISTEN) {
+		return;
+	}
+
+	id = hash_sock(status, skp);
+	bpf_map_delete_elem(&listenstats, &id);
+}
+
 SEC("kprobe/tcp_v4_connect")
 int kprobe__tcp_v4_connect(struct pt_regs *ctx)
 {
-	struct sock *sk;
+	struct connect_sock_t c = { };
 	u64 pid = bpf_get_current_pid_tgid();
 
-	sk = (struct sock *) PT_REGS_PARM1(ctx);
+	c.sk = (struct sock *) PT_REGS_PARM1(ctx);
+	c.ts = bpf_ktime_get_ns();
 
-	bpf_map_update_elem(&connectsock_ipv4, &pid, &sk, BPF_ANY);
+	bpf_map_update_elem(&connectsock_ipv4, &pid, &c, BPF_ANY);
 
 	return 0;
 }
@@ -446,16 +1331,17 @@ int kretprobe__tcp_v4_connect(struct pt_regs *ctx)
 {
 	int ret = PT_REGS_RC(ctx);
 	u64 pid = bpf_get_current_pid_tgid();
-	struct sock **skpp;
+	struct connect_sock_t *cp;
 	u64 zero = 0;
 	struct tcptracer_status_t *status;
 
-	skpp = bpf_map_lookup_elem(&connectsock_ipv4, &pid);
-	if (skpp == 0) {
+	cp = bpf_map_lookup_elem(&connectsock_ipv4, &pid);
+	if (cp == 0) {
 		return 0;	// missed entry
 	}
 
-	struct sock *skp = *skpp;
+	struct sock *skp = cp->sk;
+	u64 ts = cp->ts;
 
 	bpf_map_delete_elem(&connectsock_ipv4, &pid);
 
@@ -480,7 +1366,7 @@ int kretprobe__tcp_v4_connect(struct pt_regs *ctx)
 		return 0;
 	}
 
-	struct pid_comm_t p = { .pid = pid };
+	struct pid_comm_t p = { .pid = pid, .ts = ts };
 	bpf_get_current_comm(p.comm, sizeof(p.comm));
 	bpf_map_update_elem(&tuplepid_ipv4, &t, &p, BPF_ANY);
 
@@ -490,12 +1376,13 @@ int kretprobe__tcp_v4_connect(struct pt_regs *ctx)
 SEC("kprobe/tcp_v6_connect")
 int kprobe__tcp_v6_connect(struct pt_regs *ctx)
 {
-	struct sock *sk;
+	struct connect_sock_t c = { };
 	u64 pid = bpf_get_current_pid_tgid();
 
-	sk = (struct sock *) PT_REGS_PARM1(ctx);
+	c.sk = (struct sock *) PT_REGS_PARM1(ctx);
+	c.ts = bpf_ktime_get_ns();
 
-	bpf_map_update_elem(&connectsock_ipv6, &pid, &sk, BPF_ANY);
+	bpf_map_update_elem(&connectsock_ipv6, &pid, &c, BPF_ANY);
 
 	return 0;
 }
@@ -506,16 +1393,17 @@ int kretprobe__tcp_v6_connect(struct pt_regs *ctx)
 	int ret = PT_REGS_RC(ctx);
 	u64 pid = bpf_get_current_pid_tgid();
 	u64 zero = 0;
-	struct sock **skpp;
+	struct connect_sock_t *cp;
 	struct tcptracer_status_t *status;
-	skpp = bpf_map_lookup_elem(&connectsock_ipv6, &pid);
-	if (skpp == 0) {
+	cp = bpf_map_lookup_elem(&connectsock_ipv6, &pid);
+	if (cp == 0) {
 		return 0;	// missed entry
 	}
 
-	bpf_map_delete_elem(&connectsock_ipv6, &pid);
+	struct sock *skp = cp->sk;
+	u64 ts = cp->ts;
 
-	struct sock *skp = *skpp;
+	bpf_map_delete_elem(&connectsock_ipv6, &pid);
 
 	status = bpf_map_lookup_elem(&tcptracer_status, &zero);
 	if (status == NULL || status->state == TCPTRACER_STATE_UNINITIALIZED) {
@@ -540,6 +1428,7 @@ int kretprobe__tcp_v6_connect(struct pt_regs *ctx)
 
 	struct pid_comm_t p = { };
 	p.pid = pid;
+	p.ts = ts;
 	bpf_get_current_comm(p.comm, sizeof(p.comm));
 
 	if (is_ipv4_mapped_ipv6(t.saddr_h, t.saddr_l, t.daddr_h, t.daddr_l)) {
@@ -570,10 +1459,14 @@ int kprobe__tcp_set_state(struct pt_regs *ctx)
 	state = (int) PT_REGS_PARM2(ctx);
 
 	status = bpf_map_lookup_elem(&tcptracer_status, &zero);
-	if (status == NULL || status->state != TCPTRACER_STATE_READY) {
+	if (!offsets_ready(status)) {
 		return 0;
 	}
 
+	record_close_reason(status, skp, state);
+	send_state_change(ctx, skp, state);
+	forget_listener(status, skp);
+
 	if (state != TCP_ESTABLISHED && state != TCP_CLOSE) {
 		return 0;
 	}
@@ -609,12 +1502,19 @@ int kprobe__tcp_set_state(struct pt_regs *ctx)
 			.dport = ntohs(t.dport),
 			.netns = t.netns,
 		};
+		read_sock_info(status, skp, &evt4.info);
+		// the socket is still in TCP_SYN_SENT
+		evt4.info.old_state = evt4.info.state;
+		evt4.info.state = state;
+		if (p.ts != 0 && evt4.timestamp > p.ts) {
+			evt4.latency = evt4.timestamp - p.ts;
+		}
 		int i;
 		for (i = 0; i < TASK_COMM_LEN; i++) {
 			evt4.comm[i] = p.comm[i];
 		}
 
-		bpf_perf_event_output(ctx, &tcp_event_ipv4, cpu, &evt4, sizeof(evt4));
+		send_ipv4_event(ctx, cpu, &evt4);
 		bpf_map_delete_elem(&tuplepid_ipv4, &t);
 	} else if (check_family(skp, AF_INET6)) {
 		// output
@@ -647,12 +1547,19 @@ int kprobe__tcp_set_state(struct pt_regs *ctx)
 			.dport = ntohs(t.dport),
 			.netns = t.netns,
 		};
+		read_sock_info(status, skp, &evt6.info);
+		// the socket is still in TCP_SYN_SENT
+		evt6.info.old_state = evt6.info.state;
+		evt6.info.state = state;
+		if (p.ts != 0 && evt6.timestamp > p.ts) {
+			evt6.latency = evt6.timestamp - p.ts;
+		}
 		int i;
 		for (i = 0; i < TASK_COMM_LEN; i++) {
 			evt6.comm[i] = p.comm[i];
 		}
 
-		bpf_perf_event_output(ctx, &tcp_event_ipv6, cpu, &evt6, sizeof(evt6));
+		send_ipv6_event(ctx, cpu, &evt6);
 		bpf_map_delete_elem(&tuplepid_ipv6, &t);
 	}
 
@@ -667,13 +1574,16 @@ int kprobe__tcp_close(struct pt_regs *ctx)
 	u64 zero = 0;
 	u64 pid = bpf_get_current_pid_tgid();
 	u32 cpu = bpf_get_smp_processor_id();
+	u8 reason;
 	sk = (struct sock *) PT_REGS_PARM1(ctx);
 
 	status = bpf_map_lookup_elem(&tcptracer_status, &zero);
-	if (status == NULL || status->state != TCPTRACER_STATE_READY) {
+	if (!offsets_ready(status)) {
 		return 0;
 	}
 
+	reason = read_close_reason(status, sk);
+
 	u32 net_ns_inum;
 	u16 sport, dport;
 	sport = 0;
@@ -700,6 +1610,7 @@ int kprobe__tcp_close(struct pt_regs *ctx)
 			.timestamp = bpf_ktime_get_ns(),
 			.cpu = cpu,
 			.type = TCP_EVENT_TYPE_CLOSE,
+			.close_reason = reason,
 			.pid = pid >> 32,
 			.saddr = t.saddr,
 			.daddr = t.daddr,
@@ -708,8 +1619,10 @@ int kprobe__tcp_close(struct pt_regs *ctx)
 			.netns = t.netns,
 		};
 		bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+		read_sock_info(status, sk, &evt.info);
+		read_tcp_stats(status, sk, &evt.tcp);
 
-		bpf_perf_event_output(ctx, &tcp_event_ipv4, cpu, &evt, sizeof(evt));
+		send_ipv4_event(ctx, cpu, &evt);
 	} else if (check_family(sk, AF_INET6)) {
 		// output
 		struct ipv6_tuple_t t = { };
@@ -723,6 +1636,7 @@ int kprobe__tcp_close(struct pt_regs *ctx)
 				.timestamp = bpf_ktime_get_ns(),
 				.cpu = cpu,
 				.type = TCP_EVENT_TYPE_CLOSE,
+				.close_reason = reason,
 				.pid = pid >> 32,
 				.saddr = (u32)(t.saddr_l >> 32),
 				.daddr = (u32)(t.daddr_l >> 32),
@@ -731,8 +1645,10 @@ int kprobe__tcp_close(struct pt_regs *ctx)
 				.netns = t.netns,
 			};
 			bpf_get_current_comm(&evt4.comm, sizeof(evt4.comm));
+			read_sock_info(status, sk, &evt4.info);
+			read_tcp_stats(status, sk, &evt4.tcp);
 			if (evt4.saddr != 0 && evt4.daddr != 0 && evt4.sport != 0 && evt4.dport != 0) {
-				bpf_perf_event_output(ctx, &tcp_event_ipv4, cpu, &evt4, sizeof(evt4));
+				send_ipv4_event(ctx, cpu, &evt4);
 			}
 
 			struct ipv4_tuple_t t = {
@@ -750,6 +1666,7 @@ int kprobe__tcp_close(struct pt_regs *ctx)
 			.timestamp = bpf_ktime_get_ns(),
 			.cpu = cpu,
 			.type = TCP_EVENT_TYPE_CLOSE,
+			.close_reason = reason,
 			.pid = pid >> 32,
 			.saddr_h = t.saddr_h,
 			.saddr_l = t.saddr_l,
@@ -760,82 +1677,308 @@ int kprobe__tcp_close(struct pt_regs *ctx)
 			.netns = t.netns,
 		};
 		bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+		read_sock_info(status, sk, &evt.info);
+		read_tcp_stats(status, sk, &evt.tcp);
 
-		bpf_perf_event_output(ctx, &tcp_event_ipv6, cpu, &evt, sizeof(evt));
+		send_ipv6_event(ctx, cpu, &evt);
 	}
 	return 0;
 }
 
-SEC("kretprobe/inet_csk_accept")
-int kretprobe__inet_csk_accept(struct pt_regs *ctx)
+// tcp_send_active_reset is called when the socket is aborted, e.g. closed
+// with unread data or SO_LINGER with a zero timeout. The resets answering
+// unexpected segments are not reported: tcp_v4_send_reset may be inlined
+// and usually has no socket anyway.
+SEC("kprobe/tcp_send_active_reset")
+int kprobe__tcp_send_active_reset(struct pt_regs *ctx)
+{
+	return send_sock_event(ctx, (struct sock *) PT_REGS_PARM1(ctx), TCP_EVENT_TYPE_RESET_SENT, -1, 0);
+}
+
+// tcp_reset is called when a valid reset is received, before the socket is
+// moved to TCP_CLOSE, so the event has the state the socket was reset in.
+SEC("kprobe/tcp_reset")
+int kprobe__tcp_reset(struct pt_regs *ctx)
 {
+	struct sock *skp = (struct sock *) PT_REGS_PARM1(ctx);
 	struct tcptracer_status_t *status;
 	u64 zero = 0;
-	struct sock *newsk = (struct sock *)PT_REGS_RC(ctx);
-	u64 pid = bpf_get_current_pid_tgid();
-	u32 cpu = bpf_get_smp_processor_id();
-
-	if (newsk == NULL)
-		return 0;
+	u64 key = (u64)skp;
+	u32 reason = CLOSE_REASON_RESET;
+	u32 *reasonp;
+	u8 state = 0;
 
 	status = bpf_map_lookup_elem(&tcptracer_status, &zero);
-	if (status == NULL || status->state != TCPTRACER_STATE_READY) {
+	if (!offsets_ready(status)) {
 		return 0;
 	}
 
-	// pull in details
-	u16 lport, dport;
-	u32 net_ns_inum;
+	// a reset answering the SYN is a refused connection
+	bpf_probe_read(&state, sizeof(state), ((char *)skp) + status->offset_state);
+	if (state == TCP_SYN_SENT || state == TCP_SYN_RECV) {
+		reason = CLOSE_REASON_HANDSHAKE_FAILED;
+	}
+	// replaces the reason recorded by earlier transitions, unless the
+	// close event was already sent
+	reasonp = bpf_map_lookup_elem(&closereason, &key);
+	if (reasonp == NULL || *reasonp != CLOSE_REASON_CLOSED) {
+		bpf_map_update_elem(&closereason, &key, &reason, BPF_ANY);
+	}
 
-	lport = 0;
-	dport = 0;
+	return send_sock_event(ctx, skp, TCP_EVENT_TYPE_RESET_RECEIVED, -1, 0);
+}
 
-	bpf_probe_read(&dport, sizeof(dport), ((char *)newsk) + status->offset_dport);
-        // lport is right after dport
-	bpf_probe_read(&lport, sizeof(lport), ((char *)newsk) + status->offset_dport + sizeof(dport));
-	// Get network namespace id
-	possible_net_t *skc_net;
+// tcp_shutdown is called by shutdown(), in the context of the calling process,
+// with how being RCV_SHUTDOWN, SEND_SHUTDOWN or both.
+SEC("kprobe/tcp_shutdown")
+int kprobe__tcp_shutdown(struct pt_regs *ctx)
+{
+	int how = (int) PT_REGS_PARM2(ctx);
 
-	skc_net = NULL;
-	net_ns_inum = 0;
-	bpf_probe_read(&skc_net, sizeof(possible_net_t *), ((char *)newsk) + status->offset_netns);
-	bpf_probe_read(&net_ns_inum, sizeof(net_ns_inum), ((char *)skc_net) + status->offset_ino);
+	return send_sock_event(ctx, (struct sock *) PT_REGS_PARM1(ctx), TCP_EVENT_TYPE_SHUTDOWN, -1, how & SHUTDOWN_MASK);
+}
 
-	if (check_family(newsk, AF_INET)) {
-		struct tcp_ipv4_event_t evt = {
-			.timestamp = bpf_ktime_get_ns(),
-			.cpu = cpu,
-			.type = TCP_EVENT_TYPE_ACCEPT,
-			.netns = net_ns_inum,
-		};
-		evt.pid = pid >> 32;
-		bpf_probe_read(&evt.saddr, sizeof(u32), ((char *)newsk) + status->offset_saddr);
-		bpf_probe_read(&evt.daddr, sizeof(u32), ((char *)newsk) + status->offset_daddr);
+// tcp_time_wait replaces the socket by a time-wait socket, which tcp_set_state
+// doesn't see: the socket itself is then moved to TCP_CLOSE.
+SEC("kprobe/tcp_time_wait")
+int kprobe__tcp_time_wait(struct pt_regs *ctx)
+{
+	int state = (int) PT_REGS_PARM2(ctx);
 
-		evt.sport = lport;
-		evt.dport = ntohs(dport);
-		bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+	if (state != TCP_TIME_WAIT) {
+		return 0;
+	}
 
-		// do not send event if IP address is 0.0.0.0 or port is 0
-		if (evt.saddr != 0 && evt.daddr != 0 && evt.sport != 0 && evt.dport != 0) {
-			bpf_perf_event_output(ctx, &tcp_event_ipv4, cpu, &evt, sizeof(evt));
-		}
-	} else if (check_family(newsk, AF_INET6)) {
-		struct tcp_ipv6_event_t evt = {
-			.timestamp = bpf_ktime_get_ns(),
-			.cpu = cpu,
-			.type = TCP_EVENT_TYPE_ACCEPT,
-			.netns = net_ns_inum,
+	send_state_change(ctx, (struct sock *) PT_REGS_PARM1(ctx), state);
+	return 0;
+}
+
+// inet_csk_get_port reserves the local port of TCP sockets, on bind() and
+// listen(). The socket is still closed on bind(), listen() moves it to
+// TCP_LISTEN first.
+SEC("kprobe/inet_csk_get_port")
+int kprobe__inet_csk_get_port(struct pt_regs *ctx)
+{
+	struct sock *skp = (struct sock *) PT_REGS_PARM1(ctx);
+	struct tcptracer_status_t *status;
+	u64 zero = 0;
+	u64 pid = bpf_get_current_pid_tgid();
+	u8 state = 0;
+
+	status = bpf_map_lookup_elem(&tcptracer_status, &zero);
+	if (!offsets_ready(status)) {
+		return 0;
+	}
+
+	bpf_probe_read(&state, sizeof(state), ((char *)skp) + status->offset_state);
+	if (state != TCP_CLOSE) {
+		return 0;
+	}
+
+	bpf_map_update_elem(&bindsock, &pid, &skp, BPF_ANY);
+	return 0;
+}
+
+/* send_bind_event sends the bind event of the socket found by
+ * inet_csk_get_port, once the source address and port are set.
+ */
+__attribute__((always_inline))
+static int send_bind_event(struct pt_regs *ctx)
+{
+	int ret = PT_REGS_RC(ctx);
+	u64 pid = bpf_get_current_pid_tgid();
+	struct sock **skpp;
+	struct sock *skp = NULL;
+
+	skpp = bpf_map_lookup_elem(&bindsock, &pid);
+	if (skpp == NULL) {
+		return 0;	// not a TCP socket, or failed before the port lookup
+	}
+	bpf_probe_read(&skp, sizeof(skp), skpp);
+	bpf_map_delete_elem(&bindsock, &pid);
+
+	if (ret != 0) {
+		return 0;
+	}
+
+	return send_sock_event(ctx, skp, TCP_EVENT_TYPE_BIND, -1, 0);
+}
+
+SEC("kretprobe/inet_bind")
+int kretprobe__inet_bind(struct pt_regs *ctx)
+{
+	return send_bind_event(ctx);
+}
+
+SEC("kretprobe/inet6_bind")
+int kretprobe__inet6_bind(struct pt_regs *ctx)
+{
+	return send_bind_event(ctx);
+}
+
+// tcp_conn_request is called for the SYNs received by listening sockets,
+// IPv4 and IPv6, in softirq context: the pid of the events is the one of the
+// interrupted process. It drops the SYN if the accept queue is full.
+SEC("kprobe/tcp_conn_request")
+int kprobe__tcp_conn_request(struct pt_regs *ctx)
+{
+	return update_listen_stats(ctx, (struct sock *) PT_REGS_PARM3(ctx), true);
+}
+
+// tcp_v4_syn_recv_sock and tcp_v6_syn_recv_sock create the socket of a
+// completed handshake, unless the accept queue is full. tcp_v6_syn_recv_sock
+// calls tcp_v4_syn_recv_sock for IPv4 packets, the ACK is then counted with
+// the IPv6 socket.
+SEC("kprobe/tcp_v4_syn_recv_sock")
+int kprobe__tcp_v4_syn_recv_sock(struct pt_regs *ctx)
+{
+	struct sock *skp = (struct sock *) PT_REGS_PARM1(ctx);
+
+	if (!check_family(skp, AF_INET)) {
+		return 0;
+	}
+	return update_listen_stats(ctx, skp, false);
+}
+
+SEC("kprobe/tcp_v6_syn_recv_sock")
+int kprobe__tcp_v6_syn_recv_sock(struct pt_regs *ctx)
+{
+	return update_listen_stats(ctx, (struct sock *) PT_REGS_PARM1(ctx), false);
+}
+
+SEC("kretprobe/inet_csk_clone_lock")
+int kretprobe__inet_csk_clone_lock(struct pt_regs *ctx)
+{
+	struct sock *newsk = (struct sock *)PT_REGS_RC(ctx);
+	struct tcptracer_status_t *status;
+	u64 zero = 0;
+	u64 ts = bpf_ktime_get_ns();
+
+	if (newsk == NULL)
+		return 0;
+
+	status = bpf_map_lookup_elem(&tcptracer_status, &zero);
+	if (!offsets_ready(status)) {
+		return 0;
+	}
+
+	// the child socket enters the accept queue once created
+	u64 key = (u64)newsk;
+	bpf_map_update_elem(&childsock_ts, &key, &ts, BPF_ANY);
+	bpf_map_delete_elem(&closereason, &key);
+
+	return 0;
+}
+
+SEC("kprobe/inet_accept")
+int kprobe__inet_accept(struct pt_regs *ctx)
+{
+	struct socket *newsock;
+	u64 pid = bpf_get_current_pid_tgid();
+
+	newsock = (struct socket *) PT_REGS_PARM2(ctx);
+
+	bpf_map_update_elem(&acceptsock, &pid, &newsock, BPF_ANY);
+
+	return 0;
+}
+
+SEC("kretprobe/inet_csk_accept")
+int kretprobe__inet_csk_accept(struct pt_regs *ctx)
+{
+	struct tcptracer_status_t *status;
+	u64 zero = 0;
+	struct sock *newsk = (struct sock *)PT_REGS_RC(ctx);
+	u64 pid = bpf_get_current_pid_tgid();
+	u32 cpu = bpf_get_smp_processor_id();
+	struct socket **newsockp;
+	struct socket *newsock = NULL;
+
+	newsockp = bpf_map_lookup_elem(&acceptsock, &pid);
+	if (newsockp != NULL) {
+		newsock = *newsockp;
+		bpf_map_delete_elem(&acceptsock, &pid);
+	}
+
+	if (newsk == NULL)
+		return 0;
+
+	u64 key = (u64)newsk;
+	u64 child_ts = 0;
+	u64 *tsp = bpf_map_lookup_elem(&childsock_ts, &key);
+	if (tsp != NULL) {
+		child_ts = *tsp;
+		bpf_map_delete_elem(&childsock_ts, &key);
+	}
+
+	status = bpf_map_lookup_elem(&tcptracer_status, &zero);
+	if (!offsets_ready(status)) {
+		return 0;
+	}
+
+	// pull in details
+	u16 lport, dport;
+	u32 net_ns_inum;
+
+	lport = 0;
+	dport = 0;
+
+	bpf_probe_read(&dport, sizeof(dport), ((char *)newsk) + status->offset_dport);
+        // lport is right after dport
+	bpf_probe_read(&lport, sizeof(lport), ((char *)newsk) + status->offset_dport + sizeof(dport));
+	// Get network namespace id
+	possible_net_t *skc_net;
+
+	skc_net = NULL;
+	net_ns_inum = 0;
+	bpf_probe_read(&skc_net, sizeof(possible_net_t *), ((char *)newsk) + status->offset_netns);
+	bpf_probe_read(&net_ns_inum, sizeof(net_ns_inum), ((char *)skc_net) + status->offset_ino);
+
+	if (check_family(newsk, AF_INET)) {
+		struct tcp_ipv4_event_t evt = {
+			.timestamp = bpf_ktime_get_ns(),
+			.cpu = cpu,
+			.type = TCP_EVENT_TYPE_ACCEPT,
+			.netns = net_ns_inum,
+		};
+		evt.pid = pid >> 32;
+		bpf_probe_read(&evt.saddr, sizeof(u32), ((char *)newsk) + status->offset_saddr);
+		bpf_probe_read(&evt.daddr, sizeof(u32), ((char *)newsk) + status->offset_daddr);
+
+		evt.sport = lport;
+		evt.dport = ntohs(dport);
+		bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+		read_sock_info(status, newsk, &evt.info);
+		evt.info.ino = read_socket_ino(status, newsock);
+		if (child_ts != 0 && evt.timestamp > child_ts) {
+			evt.latency = evt.timestamp - child_ts;
+		}
+
+		// do not send event if IP address is 0.0.0.0 or port is 0
+		if (evt.saddr != 0 && evt.daddr != 0 && evt.sport != 0 && evt.dport != 0) {
+			send_ipv4_event(ctx, cpu, &evt);
+		}
+	} else if (check_family(newsk, AF_INET6)) {
+		struct tcp_ipv6_event_t evt = {
+			.timestamp = bpf_ktime_get_ns(),
+			.cpu = cpu,
+			.type = TCP_EVENT_TYPE_ACCEPT,
+			.netns = net_ns_inum,
 		};
 		evt.pid = pid >> 32;
 		bpf_probe_read(&evt.daddr_h, sizeof(u64), ((char *)newsk) + status->offset_daddr_ipv6);
 		bpf_probe_read(&evt.daddr_l, sizeof(u64), ((char *)newsk) + status->offset_daddr_ipv6 + sizeof(u64));
-		bpf_probe_read(&evt.saddr_h, sizeof(u64), ((char *)newsk) + status->offset_daddr_ipv6 + 2 * sizeof(u64));
-		bpf_probe_read(&evt.saddr_l, sizeof(u64), ((char *)newsk) + status->offset_daddr_ipv6 + 3 * sizeof(u64));
+		bpf_probe_read(&evt.saddr_h, sizeof(u64), ((char *)newsk) + status->offset_saddr_ipv6);
+		bpf_probe_read(&evt.saddr_l, sizeof(u64), ((char *)newsk) + status->offset_saddr_ipv6 + sizeof(u64));
 
 		evt.sport = lport;
 		evt.dport = ntohs(dport);
 		bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+		read_sock_info(status, newsk, &evt.info);
+		evt.info.ino = read_socket_ino(status, newsock);
+		if (child_ts != 0 && evt.timestamp > child_ts) {
+			evt.latency = evt.timestamp - child_ts;
+		}
 		if (is_ipv4_mapped_ipv6(evt.saddr_h, evt.saddr_l, evt.daddr_h, evt.daddr_l)) {
 			struct tcp_ipv4_event_t evt4 = {
 				.timestamp = bpf_ktime_get_ns(),
@@ -847,17 +1990,563 @@ int kretprobe__inet_csk_accept(struct pt_regs *ctx)
 				.sport = evt.sport,
 				.dport = evt.dport,
 				.netns = net_ns_inum,
+				.info = evt.info,
+				.latency = evt.latency,
 			};
 			bpf_get_current_comm(&evt4.comm, sizeof(evt4.comm));
 			if (evt4.saddr != 0 && evt4.daddr != 0 && evt4.sport != 0 && evt4.dport != 0) {
-				bpf_perf_event_output(ctx, &tcp_event_ipv4, cpu, &evt4, sizeof(evt4));
+				send_ipv4_event(ctx, cpu, &evt4);
 			}
 			return 0;
 		}
 		// do not send event if IP address is :: or port is 0
 		if ((evt.saddr_h || evt.saddr_l) && (evt.daddr_h || evt.daddr_l) && evt.sport != 0 && evt.dport != 0) {
-			bpf_perf_event_output(ctx, &tcp_event_ipv6, cpu, &evt, sizeof(evt));
+			send_ipv6_event(ctx, cpu, &evt);
+		}
+	}
+	return 0;
+}
+
+/* udp_config returns the config if UDP tracing is enabled and the offsets
+ * are guessed.
+ */
+__attribute__((always_inline))
+static struct tcptracer_config_t *udp_config(struct tcptracer_status_t **status)
+{
+	struct tcptracer_config_t *config;
+	u64 zero64 = 0;
+	u32 zero = 0;
+
+	config = bpf_map_lookup_elem(&tcptracer_config, &zero);
+	if (config == NULL || !config->udp) {
+		return NULL;
+	}
+
+	*status = bpf_map_lookup_elem(&tcptracer_status, &zero64);
+	if (!offsets_ready(*status)) {
+		return NULL;
+	}
+	return config;
+}
+
+/* read_msg_name reads the address of a struct sockaddr_in or sockaddr_in6
+ * set as msg_name, the first field of struct msghdr. It returns 0 if there is
+ * none.
+ */
+__attribute__((always_inline))
+static int read_msg_name(void *msg, u16 *port, void *addr, int addr_size)
+{
+	void *name = NULL;
+	u16 family = 0;
+
+	if (msg == NULL) {
+		return 0;
+	}
+	bpf_probe_read(&name, sizeof(name), msg);
+	if (name == NULL) {
+		return 0;
+	}
+
+	bpf_probe_read(&family, sizeof(family), name);
+	if ((addr_size == sizeof(u32) && family != AF_INET) || (addr_size != sizeof(u32) && family != AF_INET6)) {
+		return 0;
+	}
+	// sin_port and sin6_port follow the family, sin_addr follows the port
+	// and sin6_addr follows sin6_flowinfo
+	bpf_probe_read(port, sizeof(*port), ((char *)name) + 2);
+	bpf_probe_read(addr, addr_size, ((char *)name) + (addr_size == sizeof(u32) ? 4 : 8));
+	return 1;
+}
+
+/* send_udp_event_v4 sends an event for the UDP flow t if it is new or was
+ * last reported more than udp_refresh_ns ago. The ports of t are in host
+ * byte order.
+ */
+__attribute__((always_inline))
+static void send_udp_event_v4(struct pt_regs *ctx, struct tcptracer_config_t *config, struct tcptracer_status_t *status,
+			      struct sock *skp, struct ipv4_tuple_t *t, u32 type)
+{
+	u64 pid = bpf_get_current_pid_tgid();
+	u32 cpu = bpf_get_smp_processor_id();
+	u64 ts = bpf_ktime_get_ns();
+	u64 *last;
+
+	if (t->daddr == 0 || t->sport == 0 || t->dport == 0) {
+		return;
+	}
+
+	last = bpf_map_lookup_elem(&udpflows_ipv4, t);
+	if (last != NULL && ts - *last < config->udp_refresh_ns) {
+		return;
+	}
+	if (bpf_map_update_elem(&udpflows_ipv4, t, &ts, BPF_ANY) != 0) {
+		return;
+	}
+
+	struct tcp_ipv4_event_t evt = {
+		.timestamp = ts,
+		.cpu = cpu,
+		.type = type,
+		.pid = pid >> 32,
+		.saddr = t->saddr,
+		.daddr = t->daddr,
+		.sport = t->sport,
+		.dport = t->dport,
+		.netns = t->netns,
+	};
+	bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+	read_sock_info(status, skp, &evt.info);
+
+	send_ipv4_event(ctx, cpu, &evt);
+}
+
+__attribute__((always_inline))
+static void send_udp_event_v6(struct pt_regs *ctx, struct tcptracer_config_t *config, struct tcptracer_status_t *status,
+			      struct sock *skp, struct ipv6_tuple_t *t, u32 type)
+{
+	u64 pid = bpf_get_current_pid_tgid();
+	u32 cpu = bpf_get_smp_processor_id();
+	u64 ts = bpf_ktime_get_ns();
+	u64 *last;
+
+	if (!(t->daddr_h || t->daddr_l) || t->sport == 0 || t->dport == 0) {
+		return;
+	}
+
+	last = bpf_map_lookup_elem(&udpflows_ipv6, t);
+	if (last != NULL && ts - *last < config->udp_refresh_ns) {
+		return;
+	}
+	if (bpf_map_update_elem(&udpflows_ipv6, t, &ts, BPF_ANY) != 0) {
+		return;
+	}
+
+	struct tcp_ipv6_event_t evt = {
+		.timestamp = ts,
+		.cpu = cpu,
+		.type = type,
+		.pid = pid >> 32,
+		.saddr_h = t->saddr_h,
+		.saddr_l = t->saddr_l,
+		.daddr_h = t->daddr_h,
+		.daddr_l = t->daddr_l,
+		.sport = t->sport,
+		.dport = t->dport,
+		.netns = t->netns,
+	};
+	bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+	read_sock_info(status, skp, &evt.info);
+
+	send_ipv6_event(ctx, cpu, &evt);
+}
+
+/* handle_udp_v4 reports a UDP packet sent or received on an AF_INET socket,
+ * to the peer in msg_name or, for connected sockets, in the socket.
+ */
+__attribute__((always_inline))
+static void handle_udp_v4(struct pt_regs *ctx, struct sock *skp, void *msg, u32 type)
+{
+	struct tcptracer_config_t *config;
+	struct tcptracer_status_t *status = NULL;
+	struct ipv4_tuple_t t = { };
+	u16 dport = 0;
+	u32 daddr = 0;
+
+	config = udp_config(&status);
+	if (config == NULL || !check_family(skp, AF_INET)) {
+		return;
+	}
+
+	// the source address is 0 for sockets bound to INADDR_ANY
+	read_ipv4_tuple(&t, status, skp);
+	if (read_msg_name(msg, &dport, &daddr, sizeof(daddr))) {
+		t.daddr = daddr;
+		t.dport = dport;
+	}
+	t.sport = ntohs(t.sport);
+	t.dport = ntohs(t.dport);
+
+	send_udp_event_v4(ctx, config, status, skp, &t, type);
+}
+
+/* handle_udp_v6 is like handle_udp_v4 for AF_INET6 sockets. Packets to and
+ * from IPv4-mapped addresses are reported as IPv4.
+ */
+__attribute__((always_inline))
+static void handle_udp_v6(struct pt_regs *ctx, struct sock *skp, void *msg, u32 type)
+{
+	struct tcptracer_config_t *config;
+	struct tcptracer_status_t *status = NULL;
+	struct ipv6_tuple_t t = { };
+	u16 dport = 0;
+	u64 daddr[2] = { };
+
+	config = udp_config(&status);
+	if (config == NULL || !check_family(skp, AF_INET6)) {
+		return;
+	}
+
+	read_ipv6_tuple(&t, status, skp);
+	if (read_msg_name(msg, &dport, daddr, sizeof(daddr))) {
+		t.daddr_h = daddr[0];
+		t.daddr_l = daddr[1];
+		t.dport = dport;
+	}
+	t.sport = ntohs(t.sport);
+	t.dport = ntohs(t.dport);
+
+	if (is_ipv4_mapped(t.daddr_h, t.daddr_l)) {
+		struct ipv4_tuple_t t4 = {
+			.daddr = (u32)(t.daddr_l >> 32),
+			.sport = t.sport,
+			.dport = t.dport,
+			.netns = t.netns,
+		};
+		// the source address is :: for dual-stack sockets bound to
+		// in6addr_any
+		if (is_ipv4_mapped(t.saddr_h, t.saddr_l)) {
+			t4.saddr = (u32)(t.saddr_l >> 32);
 		}
+		send_udp_event_v4(ctx, config, status, skp, &t4, type);
+		return;
+	}
+
+	send_udp_event_v6(ctx, config, status, skp, &t, type);
+}
+
+SEC("kprobe/udp_sendmsg")
+int kprobe__udp_sendmsg(struct pt_regs *ctx)
+{
+	// udpv6_sendmsg calls udp_sendmsg with IPv4-mapped destinations, this
+	// is reported by its own probe
+	handle_udp_v4(ctx, (struct sock *) PT_REGS_PARM1(ctx), (void *) PT_REGS_PARM2(ctx), TCP_EVENT_TYPE_UDP_SEND);
+	return 0;
+}
+
+SEC("kprobe/udpv6_sendmsg")
+int kprobe__udpv6_sendmsg(struct pt_regs *ctx)
+{
+	handle_udp_v6(ctx, (struct sock *) PT_REGS_PARM1(ctx), (void *) PT_REGS_PARM2(ctx), TCP_EVENT_TYPE_UDP_SEND);
+	return 0;
+}
+
+/* store_udp_recvmsg keeps the arguments of udp_recvmsg and udpv6_recvmsg:
+ * the peer address is only known once they return.
+ */
+__attribute__((always_inline))
+static void store_udp_recvmsg(struct pt_regs *ctx)
+{
+	struct tcptracer_config_t *config;
+	struct tcptracer_status_t *status = NULL;
+	u64 pid = bpf_get_current_pid_tgid();
+
+	config = udp_config(&status);
+	if (config == NULL) {
+		return;
+	}
+
+	struct udp_recvmsg_t args = {
+		.sk = (struct sock *) PT_REGS_PARM1(ctx),
+		.msg = (void *) PT_REGS_PARM2(ctx),
+	};
+	bpf_map_update_elem(&udprecv, &pid, &args, BPF_ANY);
+}
+
+SEC("kprobe/udp_recvmsg")
+int kprobe__udp_recvmsg(struct pt_regs *ctx)
+{
+	store_udp_recvmsg(ctx);
+	return 0;
+}
+
+SEC("kretprobe/udp_recvmsg")
+int kretprobe__udp_recvmsg(struct pt_regs *ctx)
+{
+	int ret = PT_REGS_RC(ctx);
+	u64 pid = bpf_get_current_pid_tgid();
+	struct udp_recvmsg_t *argsp;
+
+	argsp = bpf_map_lookup_elem(&udprecv, &pid);
+	if (argsp == NULL) {
+		return 0;	// missed entry
+	}
+	struct udp_recvmsg_t args = { };
+	bpf_probe_read(&args, sizeof(args), argsp);
+	bpf_map_delete_elem(&udprecv, &pid);
+
+	if (ret < 0) {
+		return 0;
+	}
+
+	handle_udp_v4(ctx, args.sk, args.msg, TCP_EVENT_TYPE_UDP_RECV);
+	return 0;
+}
+
+SEC("kprobe/udpv6_recvmsg")
+int kprobe__udpv6_recvmsg(struct pt_regs *ctx)
+{
+	store_udp_recvmsg(ctx);
+	return 0;
+}
+
+SEC("kretprobe/udpv6_recvmsg")
+int kretprobe__udpv6_recvmsg(struct pt_regs *ctx)
+{
+	int ret = PT_REGS_RC(ctx);
+	u64 pid = bpf_get_current_pid_tgid();
+	struct udp_recvmsg_t *argsp;
+
+	argsp = bpf_map_lookup_elem(&udprecv, &pid);
+	if (argsp == NULL) {
+		return 0;	// missed entry
+	}
+	struct udp_recvmsg_t args = { };
+	bpf_probe_read(&args, sizeof(args), argsp);
+	bpf_map_delete_elem(&udprecv, &pid);
+
+	if (ret < 0) {
+		return 0;
+	}
+
+	handle_udp_v6(ctx, args.sk, args.msg, TCP_EVENT_TYPE_UDP_RECV);
+	return 0;
+}
+
+/* unix_enabled returns whether the AF_UNIX sockets are traced, with the
+ * status if so.
+ */
+__attribute__((always_inline))
+static bool unix_enabled(struct tcptracer_status_t **status)
+{
+	struct tcptracer_config_t *config;
+	u64 zero64 = 0;
+	u32 zero = 0;
+
+	config = bpf_map_lookup_elem(&tcptracer_config, &zero);
+	if (config == NULL || !config->unix_sockets) {
+		return false;
+	}
+
+	*status = bpf_map_lookup_elem(&tcptracer_status, &zero64);
+	if (!offsets_ready(*status) || !(*status)->unix_ready) {
+		return false;
+	}
+	return true;
+}
+
+/* read_pid_comm reads the command of the thread group leader of a struct
+ * pid, the first task of pid->tasks[PIDTYPE_PID], linked by its
+ * pid_links[PIDTYPE_PID]. It is left empty if the process exited.
+ */
+__attribute__((always_inline))
+static void read_pid_comm(struct tcptracer_status_t *status, void *pid, char *comm)
+{
+	void *node = NULL;
+
+	bpf_probe_read(&node, sizeof(node), ((char *)pid) + status->offset_pid_tasks);
+	if (node == NULL) {
+		return;
+	}
+	bpf_probe_read(comm, TASK_COMM_LEN, ((char *)node) - status->offset_task_pid_links + status->offset_task_comm);
+}
+
+/* send_unix_event fills in the socket fields of a connect or accept event,
+ * sends it unless the process is rate limited and keeps it for the close
+ * event.
+ */
+__attribute__((always_inline))
+static void send_unix_event(struct pt_regs *ctx, struct tcptracer_status_t *status, struct socket *sock,
+			    struct sock *skp, struct unix_event_t *evt)
+{
+	possible_net_t *skc_net = NULL;
+	void *peer = NULL;
+	u64 key = (u64)skp;
+
+	bpf_probe_read(&skc_net, sizeof(void *), ((char *)skp) + status->offset_netns);
+	bpf_probe_read(&evt->netns, sizeof(evt->netns), ((char *)skc_net) + status->offset_ino);
+	// sk_peer_pid is a struct pid *, the pid in the initial namespace is
+	// pid->numbers[0].nr
+	bpf_probe_read(&peer, sizeof(peer), ((char *)skp) + status->offset_peer_pid);
+	if (peer != NULL) {
+		bpf_probe_read(&evt->peer_pid, sizeof(evt->peer_pid), ((char *)peer) + status->offset_pid_nr);
+		read_pid_comm(status, peer, evt->peer_comm);
+	}
+	evt->sock_id = hash_sock(status, skp);
+	evt->ino = read_socket_ino(status, sock);
+
+	if (rate_limit_event(evt->pid)) {
+		bpf_perf_event_output(ctx, &unix_event, evt->cpu, evt, sizeof(*evt));
+	}
+	bpf_map_update_elem(&unixconns, &key, evt, BPF_ANY);
+}
+
+SEC("kprobe/unix_stream_connect")
+int kprobe__unix_stream_connect(struct pt_regs *ctx)
+{
+	struct tcptracer_status_t *status = NULL;
+	u64 pid = bpf_get_current_pid_tgid();
+
+	if (!unix_enabled(&status)) {
+		return 0;
+	}
+
+	struct unix_connect_t args = {
+		.sock = (struct socket *) PT_REGS_PARM1(ctx),
+		.uaddr = (void *) PT_REGS_PARM2(ctx),
+		.addr_len = (int) PT_REGS_PARM3(ctx),
+	};
+	bpf_map_update_elem(&unixconnect, &pid, &args, BPF_ANY);
+	return 0;
+}
+
+SEC("kretprobe/unix_stream_connect")
+int kretprobe__unix_stream_connect(struct pt_regs *ctx)
+{
+	int ret = PT_REGS_RC(ctx);
+	u64 pid = bpf_get_current_pid_tgid();
+	struct tcptracer_status_t *status = NULL;
+	struct unix_connect_t *argsp;
+	struct unix_connect_t args = { };
+	struct sock *skp = NULL;
+
+	argsp = bpf_map_lookup_elem(&unixconnect, &pid);
+	if (argsp == NULL) {
+		return 0;	// missed entry
+	}
+	bpf_probe_read(&args, sizeof(args), argsp);
+	bpf_map_delete_elem(&unixconnect, &pid);
+
+	if (ret != 0 || !unix_enabled(&status)) {
+		return 0;
+	}
+
+	bpf_probe_read(&skp, sizeof(skp), ((char *)args.sock) + status->offset_socket_sk);
+	if (skp == NULL) {
+		return 0;
+	}
+
+	struct unix_event_t evt = {
+		.timestamp = bpf_ktime_get_ns(),
+		.cpu = bpf_get_smp_processor_id(),
+		.type = TCP_EVENT_TYPE_CONNECT,
+		.pid = pid >> 32,
+	};
+	bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+	// the address passed to connect() is a copy in a struct
+	// sockaddr_storage, sun_path follows sun_family
+	if (args.addr_len > 2) {
+		evt.path_len = args.addr_len - 2;
+	}
+	if (evt.path_len > UNIX_PATH_MAX) {
+		evt.path_len = UNIX_PATH_MAX;
+	}
+	bpf_probe_read(&evt.path, sizeof(evt.path), ((char *)args.uaddr) + 2);
+
+	send_unix_event(ctx, status, args.sock, skp, &evt);
+	return 0;
+}
+
+SEC("kprobe/unix_accept")
+int kprobe__unix_accept(struct pt_regs *ctx)
+{
+	struct tcptracer_status_t *status = NULL;
+	u64 pid = bpf_get_current_pid_tgid();
+	struct socket *newsock = (struct socket *) PT_REGS_PARM2(ctx);
+
+	if (!unix_enabled(&status)) {
+		return 0;
+	}
+
+	bpf_map_update_elem(&unixaccept, &pid, &newsock, BPF_ANY);
+	return 0;
+}
+
+SEC("kretprobe/unix_accept")
+int kretprobe__unix_accept(struct pt_regs *ctx)
+{
+	int ret = PT_REGS_RC(ctx);
+	u64 pid = bpf_get_current_pid_tgid();
+	struct tcptracer_status_t *status = NULL;
+	struct socket **newsockp;
+	struct socket *newsock = NULL;
+	struct sock *skp = NULL;
+	void *addr = NULL;
+	int addr_len = 0;
+
+	newsockp = bpf_map_lookup_elem(&unixaccept, &pid);
+	if (newsockp == NULL) {
+		return 0;	// missed entry
+	}
+	bpf_probe_read(&newsock, sizeof(newsock), newsockp);
+	bpf_map_delete_elem(&unixaccept, &pid);
+
+	if (ret != 0 || newsock == NULL || !unix_enabled(&status)) {
+		return 0;
+	}
+
+	bpf_probe_read(&skp, sizeof(skp), ((char *)newsock) + status->offset_socket_sk);
+	if (skp == NULL) {
+		return 0;
+	}
+
+	struct unix_event_t evt = {
+		.timestamp = bpf_ktime_get_ns(),
+		.cpu = bpf_get_smp_processor_id(),
+		.type = TCP_EVENT_TYPE_ACCEPT,
+		.pid = pid >> 32,
+	};
+	bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+	// the accepted socket shares the struct unix_address of the listener,
+	// whose len includes sun_family
+	bpf_probe_read(&addr, sizeof(addr), ((char *)skp) + status->offset_unix_addr);
+	if (addr != NULL) {
+		bpf_probe_read(&addr_len, sizeof(addr_len), ((char *)addr) + status->offset_unix_addr_len);
+		if (addr_len > 2) {
+			evt.path_len = addr_len - 2;
+		}
+		if (evt.path_len > UNIX_PATH_MAX) {
+			evt.path_len = UNIX_PATH_MAX;
+		}
+		bpf_probe_read(&evt.path, sizeof(evt.path), ((char *)addr) + status->offset_unix_addr_name + 2);
+	}
+
+	send_unix_event(ctx, status, newsock, skp, &evt);
+	return 0;
+}
+
+SEC("kprobe/unix_release")
+int kprobe__unix_release(struct pt_regs *ctx)
+{
+	struct socket *sock = (struct socket *) PT_REGS_PARM1(ctx);
+	struct tcptracer_status_t *status = NULL;
+	u64 pid = bpf_get_current_pid_tgid();
+	struct unix_event_t *connp;
+	struct sock *skp = NULL;
+	u64 key;
+
+	if (!unix_enabled(&status)) {
+		return 0;
+	}
+
+	bpf_probe_read(&skp, sizeof(skp), ((char *)sock) + status->offset_socket_sk);
+	key = (u64)skp;
+	connp = bpf_map_lookup_elem(&unixconns, &key);
+	if (connp == NULL) {
+		return 0;	// not a connected stream socket
+	}
+
+	struct unix_event_t evt = { };
+	bpf_probe_read(&evt, sizeof(evt), connp);
+	bpf_map_delete_elem(&unixconns, &key);
+
+	evt.timestamp = bpf_ktime_get_ns();
+	evt.cpu = bpf_get_smp_processor_id();
+	evt.type = TCP_EVENT_TYPE_CLOSE;
+	evt.pid = pid >> 32;
+	bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
+
+	if (rate_limit_event(evt.pid)) {
+		bpf_perf_event_output(ctx, &unix_event, evt.cpu, &evt, sizeof(evt));
 	}
 	return 0;
 }
@@ -899,7 +2588,7 @@ int kretprobe__fd_install(struct pt_regs *ctx)
 	evt.pid = pid >> 32;
 	evt.fd = *(__u32*)fd;
 	bpf_get_current_comm(&evt.comm, sizeof(evt.comm));
-	bpf_perf_event_output(ctx, &tcp_event_ipv4, cpu, &evt, sizeof(evt));
+	send_ipv4_event(ctx, cpu, &evt);
 
 	return 0;
 }
@@ -7,6 +7,34 @@
 #define TCP_EVENT_TYPE_ACCEPT           2
 #define TCP_EVENT_TYPE_CLOSE            3
 #define TCP_EVENT_TYPE_FD_INSTALL       4
+#define TCP_EVENT_TYPE_RESET_SENT       5
+#define TCP_EVENT_TYPE_RESET_RECEIVED   6
+#define TCP_EVENT_TYPE_STATE_CHANGE     7
+#define TCP_EVENT_TYPE_SHUTDOWN         8
+/* UDP packets of a flow seen for the first time or again after
+ * udp_refresh_ns, reported with the TCP events */
+#define TCP_EVENT_TYPE_UDP_SEND         9
+#define TCP_EVENT_TYPE_UDP_RECV         10
+#define TCP_EVENT_TYPE_BIND             11
+#define TCP_EVENT_TYPE_LISTEN_OVERFLOW  12
+#define TCP_EVENT_TYPE_SYN_RECV         13
+
+/* Minimum interval between the SYN received and listen overflow events of a
+ * listening socket, in nanoseconds */
+#define LISTEN_EVENT_INTERVAL_NS 1000000000ULL
+
+#define NSEC_PER_SEC 1000000000ULL
+
+/* Why a connection was closed, sent with close events */
+#define CLOSE_REASON_UNKNOWN          0
+#define CLOSE_REASON_ACTIVE           1
+#define CLOSE_REASON_PASSIVE          2
+#define CLOSE_REASON_RESET            3
+#define CLOSE_REASON_ABORT            4
+#define CLOSE_REASON_HANDSHAKE_FAILED 5
+/* Marks the sockets already seen by tcp_close in the closereason map, never
+ * sent */
+#define CLOSE_REASON_CLOSED           0xff
 
 #define GUESS_SADDR      0
 #define GUESS_DADDR      1
@@ -15,11 +43,43 @@
 #define GUESS_DPORT      4
 #define GUESS_NETNS      5
 #define GUESS_DADDR_IPV6 6
+#define GUESS_SADDR_IPV6 7
+#define GUESS_STATE      8
+#define GUESS_PROTOCOL   9
+#define GUESS_UID        10
+#define GUESS_MARK       11
+#define GUESS_BOUND_DEV_IF 12
+#define GUESS_SOCKET_INO 13
+#define GUESS_SPORT_IPV6 14
 
 #ifndef TASK_COMM_LEN
 #define TASK_COMM_LEN 16
 #endif
 
+/* Fields of the socket common to all the events */
+struct sock_info_t {
+	/* the struct sock pointer, hashed */
+	__u64 sock_id;
+	__u64 ino;
+	__u32 uid;
+	__u32 mark;
+	__u32 ifindex;
+	__u8 state;
+	/* the previous state, for state change events */
+	__u8 old_state;
+	__u8 dummy[2];
+};
+
+/* TCP statistics of close events, see struct tcp_info */
+struct tcp_stats_t {
+	__u32 srtt_us;
+	__u32 mdev_us;
+	__u32 total_retrans;
+	__u32 snd_cwnd;
+	/* TCP_CA_NAME_MAX */
+	char ca_name[16];
+};
+
 struct tcp_ipv4_event_t {
 	__u64 timestamp;
 	__u64 cpu;
@@ -32,7 +92,16 @@ struct tcp_ipv4_event_t {
 	__u16 dport;
 	__u32 netns;
 	__u32 fd;
-	__u32 dummy;
+	__u8 close_reason;
+	/* RCV_SHUTDOWN and SEND_SHUTDOWN flags, for shutdown events */
+	__u8 shutdown;
+	/* the event is sent for 1 in sample_rate connections */
+	__u16 sample_rate;
+	struct sock_info_t info;
+	/* handshake latency for connect events, time spent in the accept
+	 * queue for accept events, in nanoseconds */
+	__u64 latency;
+	struct tcp_stats_t tcp;
 };
 
 struct tcp_ipv6_event_t {
@@ -50,7 +119,16 @@ struct tcp_ipv6_event_t {
 	__u16 dport;
 	__u32 netns;
 	__u32 fd;
-	__u32 dummy;
+	__u8 close_reason;
+	/* RCV_SHUTDOWN and SEND_SHUTDOWN flags, for shutdown events */
+	__u8 shutdown;
+	/* the event is sent for 1 in sample_rate connections */
+	__u16 sample_rate;
+	struct sock_info_t info;
+	/* handshake latency for connect events, time spent in the accept
+	 * queue for accept events, in nanoseconds */
+	__u64 latency;
+	struct tcp_stats_t tcp;
 };
 
 // tcp_set_state doesn't run in the context of the process that initiated the
@@ -75,9 +153,125 @@ struct ipv6_tuple_t {
 	__u32 netns;
 };
 
+/* Settings of the tracer, written by userspace before the probes are
+ * enabled */
+struct tcptracer_config_t {
+	/* send an event for every TCP state transition */
+	__u32 state_changes;
+	/* trace the UDP flows */
+	__u32 udp;
+	/* how often a UDP flow still active is reported again */
+	__u64 udp_refresh_ns;
+	/* trace the AF_UNIX stream sockets */
+	__u32 unix_sockets;
+	/* count the connection events in the aggregates map instead of
+	 * sending them */
+	__u32 aggregate;
+	/* send the connection events of 1 in sample_rate connections */
+	__u32 sample_rate;
+	/* token bucket limiting the connection events sent per process, in
+	 * events per second, 0 for no limit */
+	__u32 rate_limit;
+	__u32 rate_burst;
+	__u32 dummy;
+};
+
+/* Token bucket of a process, in the ratelimit map */
+struct ratelimit_t {
+	/* available tokens, in billionths of event */
+	__u64 tokens;
+	__u64 last_ns;
+	/* events not sent because the bucket was empty */
+	__u64 suppressed;
+};
+
+/* Key of the aggregates map */
+struct aggregate_key_t {
+	/* remote address, IPv4 addresses are in the low 32 bits of daddr_l */
+	__u64 daddr_h;
+	__u64 daddr_l;
+	__u32 netns;
+	__u32 pid;
+	__u32 type;
+	__u16 dport;
+	__u8 ipv6;
+	__u8 dummy;
+};
+
+#ifndef UNIX_PATH_MAX
+#define UNIX_PATH_MAX 108
+#endif
+
+/* Connect, accept and close events of AF_UNIX stream sockets, with the type
+ * being a TCP_EVENT_TYPE_* */
+struct unix_event_t {
+	__u64 timestamp;
+	__u64 cpu;
+	__u32 type;
+	__u32 pid;
+	char comm[TASK_COMM_LEN];
+	/* the process that connected, or called listen() for the peer of
+	 * a connecting socket */
+	__u32 peer_pid;
+	__u32 netns;
+	/* the command of peer_pid, when the connect or accept event is sent */
+	char peer_comm[TASK_COMM_LEN];
+	/* the struct sock pointer, hashed */
+	__u64 sock_id;
+	__u64 ino;
+	/* path is not NUL terminated for abstract names, starting with a NUL */
+	__u32 path_len;
+	__u32 dummy;
+	char path[UNIX_PATH_MAX];
+	__u8 padding[4];
+};
+
+struct unix_connect_t {
+	struct socket *sock;
+	/* struct sockaddr_un * */
+	void *uaddr;
+	__u64 addr_len;
+};
+
+struct udp_recvmsg_t {
+	struct sock *sk;
+	/* struct msghdr *, its msg_name is filled with the peer address */
+	void *msg;
+};
+
+/* Counters of a listening socket, in the listenstats map */
+struct listen_stats_t {
+	__u64 syn_recv;
+	/* SYNs, and ACKs completing the handshake, dropped because the accept
+	 * queue was full */
+	__u64 syn_dropped;
+	__u64 ack_dropped;
+	/* when the last events were sent, for rate limiting */
+	__u64 last_syn_ns;
+	__u64 last_overflow_ns;
+	/* accept queue length and limit, when last updated */
+	__u32 backlog;
+	__u32 max_backlog;
+};
+
+struct tcptracer_cpu_stats_t {
+	__u64 lost_ipv4;
+	__u64 lost_ipv6;
+	/* events not sent while the offsets were guessed */
+	__u64 not_ready;
+};
+
+struct connect_sock_t {
+	struct sock *sk;
+	/* when connect() started */
+	__u64 ts;
+};
+
 struct pid_comm_t {
 	__u64 pid;
 	char comm[TASK_COMM_LEN];
+	/* when connect() started */
+	__u64 ts;
 };
 
 #define TCPTRACER_STATE_UNINITIALIZED 0
@@ -98,17 +292,70 @@ struct tcptracer_status_t {
 	__u64 offset_ino;
 	__u64 offset_family;
 	__u64 offset_daddr_ipv6;
+	__u64 offset_saddr_ipv6;
+	__u64 offset_state;
+	__u64 offset_protocol;
+	__u64 offset_uid;
+	__u64 offset_mark;
+	__u64 offset_bound_dev_if;
+	__u64 offset_socket;
+	__u64 offset_socket_ino;
+	__u64 offset_sport_ipv6;
+	/* fields that userspace can't guess without privileges, as a mask of
+	 * 1 << GUESS_*, they are not read */
+	__u64 unavailable;
+
+	/* struct tcp_sock offsets, found with BTF by userspace, not guessed */
+	__u64 tcp_stats_ready;
+	__u64 offset_srtt;
+	__u64 offset_mdev;
+	__u64 offset_total_retrans;
+	__u64 offset_snd_cwnd;
+	__u64 offset_ca_ops;
+	__u64 offset_ca_name;
+
+	/* struct unix_sock offsets, found with BTF by userspace, not guessed */
+	__u64 unix_ready;
+	__u64 offset_socket_sk;
+	__u64 offset_peer_pid;
+	__u64 offset_pid_nr;
+	__u64 offset_unix_addr;
+	__u64 offset_unix_addr_len;
+	__u64 offset_unix_addr_name;
+	/* struct pid tasks, struct task_struct pid_links and comm, to read
+	 * the command of the peer process */
+	__u64 offset_pid_tasks;
+	__u64 offset_task_pid_links;
+	__u64 offset_task_comm;
+
+	/* struct sock accept queue offsets, found with BTF by userspace, not
+	 * guessed. listen_ready is only set if both members are u32. */
+	__u64 listen_ready;
+	__u64 offset_ack_backlog;
+	__u64 offset_max_ack_backlog;
 
 	__u64 err;
 
+	/* random key used to hash the struct sock pointers */
+	__u64 sock_id_key;
+	__u64 socket_ino;
+
 	__u32 daddr_ipv6[4];
+	__u32 saddr_ipv6[4];
 	__u32 netns;
 	__u32 saddr;
 	__u32 daddr;
+	__u32 uid;
+	__u32 mark;
+	/* the 4 bytes around sk_protocol, see offsetguess.go */
+	__u32 protocol;
+	__u32 bound_dev_if;
 	__u16 sport;
+	__u16 sport_ipv6;
 	__u16 dport;
 	__u16 family;
-	__u16 padding;
+	__u8 tcp_state;
+	__u8 padding;
 };
 
 #endif